@@ -52,15 +52,13 @@ func (db *DB) Backup(w io.Writer, since uint64) (uint64, error) {
 	err := db.View(func(txn *Txn) error {
 		opts := DefaultIteratorOptions
 		opts.AllVersions = true
+		// Ignore versions less than given timestamp
+		opts.MinVersion = since
 		it := txn.NewIterator(opts)
 		defer it.Close()
 
 		for it.Rewind(); it.Valid(); it.Next() {
 			item := it.Item()
-			if item.Version() < since {
-				// Ignore versions less than given timestamp
-				continue
-			}
 			val, err := item.Value()
 			if err != nil {
 				log.Printf("Key [%x]. Error while fetching value [%v]\n", item.Key(), err)
@@ -21,7 +21,12 @@ import (
 	"github.com/pingcap/errors"
 )
 
-const blobFileSuffix = ".blob"
+const (
+	blobFileSuffix = ".blob"
+	// activeBlobFileSuffix is the suffix of the blob file which is still written by the value log,
+	// it's renamed to blobFileSuffix once it's finished.
+	activeBlobFileSuffix = ".blob.active"
+)
 
 type blobPointer struct {
 	logicalAddr
@@ -33,6 +38,16 @@ func (bp *blobPointer) decode(val []byte) {
 	*bp = *ptr
 }
 
+// blobValueSize returns the size of the value in the blob file if vs is a blob pointer, otherwise 0.
+func blobValueSize(vs y.ValueStruct) int {
+	if vs.Meta&bitValuePointer == 0 {
+		return 0
+	}
+	var bp blobPointer
+	bp.decode(vs.Value)
+	return int(bp.length)
+}
+
 type mappingEntry struct {
 	logicalAddr
 	physicalOffset uint32
@@ -59,13 +74,20 @@ type blobFile struct {
 	fid            uint32
 	fd             *os.File
 	ref            int32
-	fileSize       uint32
+	fileSize       uint32 // accessed atomically as the gcHandler appends the discard info.
 	mappingSize    uint32
 	mmap           []byte
 	mappingEntries []mappingEntry
 
 	// only accessed by gcHandler
 	totalDiscard uint32
+
+	// writing is 1 while the file is written by blobWriter.
+	writing int32
+}
+
+func (bf *blobFile) isWriting() bool {
+	return atomic.LoadInt32(&bf.writing) == 1
 }
 
 func (bf *blobFile) loadOffsetMap() error {
@@ -75,7 +97,8 @@ func (bf *blobFile) loadOffsetMap() error {
 		return err
 	}
 	bf.mappingSize = binary.LittleEndian.Uint32(headBuf[:])
-	if bf.mappingSize == 0 {
+	// The mapping of a GC file has no entries if all the values of the old files were discarded.
+	if bf.mappingSize <= 4 {
 		return nil
 	}
 	bf.mmap, err = y.Mmap(bf.fd, false, int64(bf.mappingSize))
@@ -95,7 +118,10 @@ func (bf *blobFile) loadDiscards() error {
 	if err != nil {
 		return err
 	}
-	bf.totalDiscard = binary.LittleEndian.Uint32(footBuf[:])
+	// The file ends with the zero footer if there is no discard info.
+	if binary.LittleEndian.Uint32(footBuf[4:]) != 0 {
+		bf.totalDiscard = binary.LittleEndian.Uint32(footBuf[:])
+	}
 	return nil
 }
 
@@ -211,6 +237,80 @@ func newBlobFileName(id uint64, dir string) string {
 	return filepath.Join(dir, fmt.Sprintf("%08x", id)+blobFileSuffix)
 }
 
+func activeBlobFileName(id uint64, dir string) string {
+	return filepath.Join(dir, fmt.Sprintf("%08x", id)+activeBlobFileSuffix)
+}
+
+// blobWriter appends the large values to the active blob file when they are written to the value
+// log, so the value log and memtable only keep the blob pointers. It is only used by valueLog.write.
+type blobWriter struct {
+	bm     *blobManager
+	file   *blobFile
+	writer *fileutil.BufferedWriter
+	// maxFileSize is the size of a blob file to switch to a new one.
+	maxFileSize int64
+}
+
+func (bw *blobWriter) append(value []byte) (bp []byte, err error) {
+	if bw.file == nil || bw.writer.Offset()+4+int64(len(value)) > bw.maxFileSize {
+		if err = bw.finish(); err != nil {
+			return nil, err
+		}
+		if bw.file, bw.writer, err = bw.bm.createActiveFile(); err != nil {
+			return nil, err
+		}
+	}
+	var lenBuf [4]byte
+	binary.LittleEndian.PutUint32(lenBuf[:], uint32(len(value)))
+	if err = bw.writer.Append(lenBuf[:]); err != nil {
+		return
+	}
+	offset := uint32(bw.writer.Offset())
+	if err = bw.writer.Append(value); err != nil {
+		return
+	}
+	bp = make([]byte, 12)
+	binary.LittleEndian.PutUint32(bp, bw.file.fid)
+	binary.LittleEndian.PutUint32(bp[4:], offset)
+	binary.LittleEndian.PutUint32(bp[8:], uint32(len(value)))
+	return
+}
+
+// flush must be called before the value log entries which point to the values are written.
+func (bw *blobWriter) flush() error {
+	if bw.file == nil {
+		return nil
+	}
+	return bw.writer.Flush()
+}
+
+// activeFile returns the file to sync before the value log, it returns nil if there is no active file.
+func (bw *blobWriter) activeFile() *os.File {
+	if bw.file == nil {
+		return nil
+	}
+	return bw.file.fd
+}
+
+// finish writes the footer of the active file and renames it to a normal blob file.
+func (bw *blobWriter) finish() error {
+	if bw.file == nil {
+		return nil
+	}
+	if err := bw.writer.Append(make([]byte, 4)); err != nil {
+		return err
+	}
+	if err := bw.writer.Flush(); err != nil {
+		return err
+	}
+	if err := bw.writer.Sync(); err != nil {
+		return err
+	}
+	err := bw.bm.finishActiveFile(bw.file, uint32(bw.writer.Offset()))
+	bw.file, bw.writer = nil, nil
+	return err
+}
+
 type blobManager struct {
 	filesLock         sync.RWMutex
 	physicalFiles     map[uint32]*blobFile
@@ -229,21 +329,65 @@ func (bm *blobManager) Open(kv *DB, opt Options) error {
 	if err != nil {
 		return err
 	}
-	fileInfos, err := ioutil.ReadDir(bm.dirPath)
+	// The blob files are on the data paths, the active blob files of old versions are in ValueDir.
+	// The change log doesn't record the path of a file as scanning the few directories is cheap:
+	// a file is never moved after it's created and the file IDs are unique across the directories,
+	// so each valid file is found exactly once and openFiles fails on a duplicate.
+	dirs := []string{opt.ValueDir}
+	for _, p := range opt.DataPaths {
+		if filepath.Clean(p.Path) != filepath.Clean(opt.ValueDir) {
+			dirs = append(dirs, p.Path)
+		}
+	}
+	for _, dir := range dirs {
+		if err = bm.openFiles(dir, validFids, opt.ReadOnly); err != nil {
+			return err
+		}
+	}
+	for _, to := range bm.logicalToPhysical {
+		if _, ok := bm.physicalFiles[to]; !ok {
+			return errors.Errorf("File %d not found", to)
+		}
+	}
+	discardCh := make(chan *DiscardStats, 1024)
+	bm.discardCh = discardCh
+	gcHandler := &blobGCHandler{
+		bm:                bm,
+		discardCh:         discardCh,
+		pendingDiscards:   map[uint32][]blobPointer{},
+		gcCandidate:       map[*blobFile]struct{}{},
+		physicalCache:     make(map[uint32]*blobFile, len(bm.physicalFiles)),
+		logicalToPhysical: map[uint32]uint32{},
+	}
+	for k, v := range bm.logicalToPhysical {
+		gcHandler.logicalToPhysical[k] = v
+	}
+	for k, v := range bm.physicalFiles {
+		gcHandler.physicalCache[k] = v
+	}
+	go gcHandler.run()
+	return nil
+}
+
+// openFiles opens the blob files in dir and removes the ones that are not in validFids.
+func (bm *blobManager) openFiles(dir string, validFids map[uint32]struct{}, readOnly bool) error {
+	fileInfos, err := ioutil.ReadDir(dir)
 	if err != nil {
 		return errors.Wrapf(err, "Error while opening blob files")
 	}
 	for _, fileInfo := range fileInfos {
-		if !strings.HasSuffix(fileInfo.Name(), ".blob") {
+		name := fileInfo.Name()
+
+		active := strings.HasSuffix(name, activeBlobFileSuffix)
+		if !active && !strings.HasSuffix(name, blobFileSuffix) {
 			continue
 		}
-		fsz := len(fileInfo.Name())
-		fid64, err := strconv.ParseUint(fileInfo.Name()[:fsz-5], 16, 64)
+		fid64, err := strconv.ParseUint(name[:strings.IndexByte(name, '.')], 16, 64)
 		if err != nil {
-			return errors.Wrapf(err, "Error while parsing blob file id for file: %q", fileInfo.Name())
+			return errors.Wrapf(err, "Error while parsing blob file id for file: %q", name)
 		}
 		fid := uint32(fid64)
-		path := filepath.Join(bm.dirPath, fileInfo.Name())
+		path := filepath.Join(dir, name)
 		if _, ok := validFids[fid]; !ok {
 			_ = os.Remove(path)
 			continue
@@ -251,7 +395,21 @@ func (bm *blobManager) Open(kv *DB, opt Options) error {
 		if _, ok := bm.physicalFiles[fid]; ok {
 			return errors.Errorf("Found the same blob file twice: %d", fid)
 		}
-		blobFile, err := newBlobFile(path, fid, uint32(fileInfo.Size()))
+		fileSize := uint32(fileInfo.Size())
+		if active {
+			if readOnly {
+				return ErrReplayNeeded
+			}
+			if path, err = recoverActiveFile(path, fid64, dir); err != nil {
+				return err
+			}
+			fi, err := os.Stat(path)
+			if err != nil {
+				return err
+			}
+			fileSize = uint32(fi.Size())
+		}
+		blobFile, err := newBlobFile(path, fid, fileSize)
 		if err != nil {
 			return err
 		}
@@ -265,27 +423,6 @@ func (bm *blobManager) Open(kv *DB, opt Options) error {
 		}
 		bm.physicalFiles[fid] = blobFile
 	}
-	for _, to := range bm.logicalToPhysical {
-		if _, ok := bm.physicalFiles[to]; !ok {
-			return errors.Errorf("File %d not found", to)
-		}
-	}
-	discardCh := make(chan *DiscardStats, 1024)
-	bm.discardCh = discardCh
-	gcHandler := &blobGCHandler{
-		bm:                bm,
-		discardCh:         discardCh,
-		gcCandidate:       map[*blobFile]struct{}{},
-		physicalCache:     make(map[uint32]*blobFile, len(bm.physicalFiles)),
-		logicalToPhysical: map[uint32]uint32{},
-	}
-	for k, v := range bm.logicalToPhysical {
-		gcHandler.logicalToPhysical[k] = v
-	}
-	for k, v := range bm.physicalFiles {
-		gcHandler.physicalCache[k] = v
-	}
-	go gcHandler.run()
 	return nil
 }
 
@@ -339,6 +476,102 @@ func (bm *blobManager) addFile(file *blobFile) error {
 	return nil
 }
 
+// createActiveFile creates a blob file for blobWriter, the file is added to the change log first so
+// it's kept on recovery.
+func (bm *blobManager) createActiveFile() (*blobFile, *fileutil.BufferedWriter, error) {
+	fid := bm.kv.lc.reserveFileID()
+	dir := bm.kv.dataPath(bm.kv.pickDataPath(false))
+	path := activeBlobFileName(fid, dir)
+	fd, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0666)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = syncDir(dir); err != nil {
+		return nil, nil, err
+	}
+	writer := fileutil.NewBufferedWriter(fd, bm.kv.opt.ValueLogWriteOptions.WriteBufferSize, nil)
+	// Write 4 bytes 0 header.
+	if err = writer.Append(make([]byte, 4)); err != nil {
+		return nil, nil, err
+	}
+	file := &blobFile{
+		path:    path,
+		fid:     uint32(fid),
+		fd:      fd,
+		ref:     1,
+		writing: 1,
+	}
+	if err = bm.addFile(file); err != nil {
+		return nil, nil, err
+	}
+	return file, writer, nil
+}
+
+func (bm *blobManager) finishActiveFile(file *blobFile, fileSize uint32) error {
+	dir := filepath.Dir(file.path)
+	path := newBlobFileName(uint64(file.fid), dir)
+	if err := os.Rename(file.path, path); err != nil {
+		return err
+	}
+	file.path = path
+	atomic.StoreUint32(&file.fileSize, fileSize)
+	atomic.StoreInt32(&file.writing, 0)
+	// Let the gcHandler write the discards it has kept for the file.
+	bm.discardCh <- &DiscardStats{}
+	return syncDir(dir)
+}
+
+// recoverActiveFile truncates the incomplete value at the end of the active blob file left by a crash,
+// writes the footer and renames it to a normal blob file.
+func recoverActiveFile(path string, fid uint64, dir string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	end := 4
+	for end+4 <= len(data) {
+		valLen := int(binary.LittleEndian.Uint32(data[end:]))
+		if valLen == 0 || end+4+valLen > len(data) {
+			break
+		}
+		end += 4 + valLen
+	}
+	log.Infof("recover active blob file %d, size %d, valid size %d", fid, len(data), end)
+	fd, err := os.OpenFile(path, os.O_RDWR, 0666)
+	if err != nil {
+		return "", err
+	}
+	defer fd.Close()
+	if err = fd.Truncate(int64(end)); err != nil {
+		return "", err
+	}
+	if _, err = fd.WriteAt(make([]byte, 4), int64(end)); err != nil {
+		return "", err
+	}
+	if err = fileutil.Fsync(fd); err != nil {
+		return "", err
+	}
+	newPath := newBlobFileName(fid, dir)
+	if err = os.Rename(path, newPath); err != nil {
+		return "", err
+	}
+	return newPath, syncDir(dir)
+}
+
+// hasValue tells whether the value of the blob pointer is in the blob files, the values which are
+// lost by the crash are truncated by recoverActiveFile.
+func (bm *blobManager) hasValue(ptr []byte) bool {
+	var bp blobPointer
+	bp.decode(ptr)
+	bm.filesLock.RLock()
+	defer bm.filesLock.RUnlock()
+	if file, ok := bm.physicalFiles[bp.fid]; ok {
+		return file.isWriting() || uint64(bp.offset)+uint64(bp.length) <= uint64(atomic.LoadUint32(&file.fileSize))
+	}
+	_, ok := bm.logicalToPhysical[bp.fid]
+	return ok
+}
+
 func (bm *blobManager) addGCFile(oldFiles []*blobFile, newFile *blobFile, logicalFiles map[uint32]struct{}) error {
 	log.Infof("addGCFile old files %d, new file id %d, logical files %d", len(oldFiles), newFile.fid, len(logicalFiles))
 	buf := make([]byte, len(oldFiles)*8)
@@ -421,6 +654,7 @@ type blobGCHandler struct {
 	physicalCache     map[uint32]*blobFile
 	logicalToPhysical map[uint32]uint32
 
+	pendingDiscards      map[uint32][]blobPointer
 	gcCandidate          map[*blobFile]struct{}
 	candidateValidSize   uint32
 	candidateDiscardSize uint64
@@ -437,7 +671,8 @@ func (h *blobGCHandler) run() {
 }
 
 func (h *blobGCHandler) handleDiscardInfo(discardStats *DiscardStats) {
-	physicalDiscards := make(map[uint32][]blobPointer)
+	physicalDiscards := h.pendingDiscards
+	h.pendingDiscards = make(map[uint32][]blobPointer)
 	for _, ptr := range discardStats.ptrs {
 		physicalFid := h.getLogicalToPhysical(ptr.fid)
 		ptrs := physicalDiscards[physicalFid]
@@ -475,6 +710,11 @@ func (h *blobGCHandler) getLogicalToPhysical(logicalFid uint32) uint32 {
 
 func (h *blobGCHandler) writeDiscardToFile(physicalFid uint32, ptrs []blobPointer) error {
 	file := h.getPhysicalFile(physicalFid)
+	if file.isWriting() {
+		// The discard info can only be appended after the footer, keep it until the file is finished.
+		h.pendingDiscards[physicalFid] = append(h.pendingDiscards[physicalFid], ptrs...)
+		return nil
+	}
 	discardInfo := make([]byte, uint32(len(ptrs)*8+8))
 	totalDiscard := file.totalDiscard + uint32(len(discardInfo))
 	for i, ptr := range ptrs {
@@ -489,7 +729,7 @@ func (h *blobGCHandler) writeDiscardToFile(physicalFid uint32, ptrs []blobPointe
 		return err
 	}
 	file.totalDiscard = totalDiscard
-	file.fileSize += uint32(len(discardInfo))
+	atomic.AddUint32(&file.fileSize, uint32(len(discardInfo)))
 	if file.totalDiscard > file.fileSize/2 {
 		h.gcCandidate[file] = struct{}{}
 		h.candidateValidSize += file.fileSize - file.mappingSize - file.totalDiscard
@@ -534,7 +774,9 @@ func (h *blobGCHandler) doGCIfNeeded() error {
 		return validEntries[i].logicalAddr.Less(validEntries[j].logicalAddr)
 	})
 	newFid := uint32(h.bm.kv.lc.reserveFileID())
-	fileName := newBlobFileName(uint64(newFid), h.bm.kv.opt.Dir)
+	// The blob files written by GC are cold.
+	dir := h.bm.kv.dataPath(h.bm.kv.pickDataPath(true))
+	fileName := newBlobFileName(uint64(newFid), dir)
 	file, err := directio.OpenFile(fileName, os.O_CREATE|os.O_RDWR, 0666)
 	if err != nil {
 		return err
@@ -583,6 +825,9 @@ func (h *blobGCHandler) doGCIfNeeded() error {
 		return err
 	}
 	file.Close()
+	if err = syncDir(dir); err != nil {
+		return err
+	}
 	blobFile, err := newBlobFile(file.Name(), newFid, uint32(writer.Offset()))
 	if err != nil {
 		return err
@@ -683,7 +928,7 @@ func (bc *blobCache) read(bp blobPointer, slice *y.Slice) ([]byte, error) {
 	physicalOffset := bc.file.getPhysicalOffset(bp.logicalAddr)
 	lastPhysical := bc.lastPhysical
 	bc.lastPhysical = physicalOffset
-	if lastPhysical == 0 || bp.length > cacheSize/2 {
+	if lastPhysical == 0 || bp.length > cacheSize/2 || bc.file.isWriting() {
 		return bc.file.read(bp, slice)
 	}
 	if physicalOffset >= bc.cacheOffset && physicalOffset+bp.length < bc.cacheOffset+uint32(len(bc.cacheData)) {
@@ -694,8 +939,8 @@ func (bc *blobCache) read(bp blobPointer, slice *y.Slice) ([]byte, error) {
 		bc.cacheData = make([]byte, cacheSize)
 	}
 	readLen := uint32(len(bc.cacheData))
-	if readLen > bc.file.fileSize-physicalOffset {
-		readLen = bc.file.fileSize - physicalOffset
+	if fileSize := atomic.LoadUint32(&bc.file.fileSize); readLen > fileSize-physicalOffset {
+		readLen = fileSize - physicalOffset
 	}
 	_, err := bc.file.fd.ReadAt(bc.cacheData[:readLen], int64(physicalOffset))
 	if err != nil {
@@ -3,10 +3,14 @@ package badger
 import (
 	"fmt"
 	"io/ioutil"
+	"math"
 	"math/rand"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
+	"github.com/coocood/badger/y"
 	"github.com/stretchr/testify/require"
 )
 
@@ -106,3 +110,119 @@ func validateValue(t *testing.T, db *DB, expectedMap map[string]string) {
 	})
 	require.Nil(t, err)
 }
+
+func TestSeparateValuesOnWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	opts.ValueThreshold = 64
+	opts.ValueLogFileSize = 1 << 20
+	opts.SeparateValuesOnWrite = true
+	db, err := Open(opts)
+	require.NoError(t, err)
+	expectedMap := make(map[string]string)
+	for i := 0; i < 2500; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		val := make([]byte, 16)
+		if i%2 == 0 {
+			val = make([]byte, 1024)
+		}
+		_, _ = rand.Read(val)
+		expectedMap[string(key)] = fmt.Sprintf("%x", val)
+		txnSet(t, db, key, val, 0)
+	}
+	// The value log only keeps the pointer of the large value.
+	vs := db.get(y.KeyWithTs([]byte("key2498"), math.MaxUint64), nil)
+	require.NotZero(t, vs.Meta&bitValuePointer)
+	require.Len(t, vs.Value, 12)
+	active, err := filepath.Glob(filepath.Join(dir, "*"+activeBlobFileSuffix))
+	require.NoError(t, err)
+	require.Len(t, active, 1)
+	validateValue(t, db, expectedMap)
+
+	// IterateVLog returns the values instead of the pointers.
+	var numEntries int
+	require.NoError(t, db.IterateVLog(0, func(e Entry) {
+		if expected, ok := expectedMap[string(y.ParseKey(e.Key))]; ok {
+			require.Equal(t, expected, fmt.Sprintf("%x", e.Value))
+			numEntries++
+		}
+	}))
+	require.NotZero(t, numEntries)
+
+	require.NoError(t, db.Close())
+	active, err = filepath.Glob(filepath.Join(dir, "*"+activeBlobFileSuffix))
+	require.NoError(t, err)
+	require.Len(t, active, 0)
+	db, err = Open(opts)
+	require.NoError(t, err)
+	validateValue(t, db, expectedMap)
+	require.NoError(t, db.Close())
+}
+
+func TestSeparateValuesOnWriteRecovery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	crashDir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(crashDir)
+	opts := getTestOptions(dir)
+	opts.ValueThreshold = 64
+	opts.ValueLogFileSize = 1 << 20
+	opts.SeparateValuesOnWrite = true
+	opts.SyncWrites = true
+	db, err := Open(opts)
+	require.NoError(t, err)
+	val := make([]byte, 1024)
+	for i := 0; i < 10; i++ {
+		txnSet(t, db, []byte(fmt.Sprintf("key%d", i)), val, 0)
+	}
+
+	// Copy the files of the open DB to simulate a crash, the last value is partially written.
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	for _, fi := range files {
+		data, err := ioutil.ReadFile(filepath.Join(dir, fi.Name()))
+		require.NoError(t, err)
+		if strings.HasSuffix(fi.Name(), activeBlobFileSuffix) {
+			data = data[:len(data)-100]
+		}
+		require.NoError(t, ioutil.WriteFile(filepath.Join(crashDir, fi.Name()), data, 0666))
+	}
+	require.NoError(t, db.Close())
+
+	opts.Dir = crashDir
+	opts.ValueDir = crashDir
+	db, err = Open(opts)
+	require.NoError(t, err)
+	active, err := filepath.Glob(filepath.Join(crashDir, "*"+activeBlobFileSuffix))
+	require.NoError(t, err)
+	require.Len(t, active, 0)
+	require.NoError(t, db.View(func(txn *Txn) error {
+		for i := 0; i < 9; i++ {
+			item, err := txn.Get([]byte(fmt.Sprintf("key%d", i)))
+			require.NoError(t, err)
+			require.Equal(t, val, getItemValue(t, item))
+		}
+		// The transaction of the lost value is dropped.
+		_, err := txn.Get([]byte("key9"))
+		require.Equal(t, ErrKeyNotFound, err)
+		return nil
+	}))
+	txnSet(t, db, []byte("key9"), val, 0)
+	require.NoError(t, db.Close())
+
+	db, err = Open(opts)
+	require.NoError(t, err)
+	require.NoError(t, db.View(func(txn *Txn) error {
+		for i := 0; i < 10; i++ {
+			item, err := txn.Get([]byte(fmt.Sprintf("key%d", i)))
+			require.NoError(t, err)
+			require.Equal(t, val, getItemValue(t, item))
+		}
+		return nil
+	}))
+	require.NoError(t, db.Close())
+}
@@ -146,7 +146,7 @@ func (cs *compactStatus) compareAndAdd(_ thisAndNextLevelRLocked, cd compactDef)
 
 	y.AssertTruef(level < len(cs.levels)-1, "Got level %d. Max levels: %d", level, len(cs.levels))
 	thisLevel := cs.levels[level]
-	nextLevel := cs.levels[level+1]
+	nextLevel := cs.levels[cd.nextLevel.level]
 
 	if thisLevel.overlapsWith(cd.thisRange) {
 		return false
@@ -158,7 +158,7 @@ func (cs *compactStatus) compareAndAdd(_ thisAndNextLevelRLocked, cd compactDef)
 	// running parallel compactions for the same level.
 	// NOTE: We can directly call thisLevel.totalSize, because we already have acquire a read lock
 	// over this and the next level.
-	if cd.thisLevel.totalSize-thisLevel.deltaSize < cd.thisLevel.maxTotalSize {
+	if !cd.force && cd.thisLevel.totalSize-thisLevel.deltaSize < cd.thisLevel.maxTotalSize {
 		return false
 	}
 
@@ -177,7 +177,7 @@ func (cs *compactStatus) delete(cd compactDef) {
 	y.AssertTruef(level < len(cs.levels)-1, "Got level %d. Max levels: %d", level, len(cs.levels))
 
 	thisLevel := cs.levels[level]
-	nextLevel := cs.levels[level+1]
+	nextLevel := cs.levels[cd.nextLevel.level]
 
 	thisLevel.deltaSize -= cd.thisSize
 	found := thisLevel.remove(cd.thisRange)
@@ -0,0 +1,113 @@
+/*
+ * Copyright 2026 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"github.com/coocood/badger/options"
+)
+
+// compactionPicker decides which levels are compacted and which tables are picked for compaction.
+type compactionPicker interface {
+	// pickCompactLevels returns the levels need to be compacted, ordered by priority.
+	pickCompactLevels() []compactionPriority
+	// fillTables picks the tables to compact from cd.thisLevel and cd.nextLevel and adds cd to
+	// compactStatus. It returns false if there is nothing to compact.
+	fillTables(cd *compactDef) bool
+	// canUnstall returns true if the LSM tree is healthy enough to accept level 0 tables again
+	// after writes have been stalled.
+	canUnstall() bool
+}
+
+func newCompactionPicker(lc *levelsController) compactionPicker {
+	switch lc.kv.opt.CompactionStyle {
+	case options.TieredCompaction:
+		return &tieredPicker{lc: lc}
+	default:
+		return &leveledPicker{lc: lc}
+	}
+}
+
+// leveledPicker keeps the size of each level under its maxTotalSize.
+type leveledPicker struct {
+	lc *levelsController
+}
+
+func (p *leveledPicker) pickCompactLevels() []compactionPriority {
+	return p.lc.pickCompactLevels()
+}
+
+func (p *leveledPicker) fillTables(cd *compactDef) bool {
+	if cd.pickBy == pickBottommostByAge {
+		return p.lc.fillBottommostTable(cd)
+	}
+	if cd.thisLevel.level == 0 {
+		return p.lc.fillTablesL0(cd)
+	}
+	return p.lc.fillTables(cd)
+}
+
+func (p *leveledPicker) canUnstall() bool {
+	return !p.lc.isL0Compactable() && !p.lc.levels[p.lc.getBaseLevel()].isCompactable(0)
+}
+
+// tieredPicker treats level 0 and each of the other levels as sorted runs. When level 0 needs
+// compaction, it is merged into level 1 if their sizes are similar, otherwise level 1 is pushed
+// down first, and so on. The last level accepts any size.
+type tieredPicker struct {
+	lc *levelsController
+}
+
+func (p *tieredPicker) pickCompactLevels() []compactionPriority {
+	lc := p.lc
+	if lc.cstatus.overlapsWith(0, infRange) || !lc.isL0Compactable() {
+		return nil
+	}
+	score := float64(lc.levels[0].numTables()) / float64(lc.kv.opt.NumLevelZeroTables)
+	size := lc.levels[0].getTotalSize()
+	lastLevel := len(lc.levels) - 1
+	for l := 0; l < lastLevel; l++ {
+		nextSize := lc.levels[l+1].getTotalSize()
+		if l+1 == lastLevel || float64(nextSize) <= float64(size)*lc.kv.opt.TieredSizeRatio {
+			return []compactionPriority{{level: l, score: score}}
+		}
+		// The next level is too big to merge into, push it down to make room.
+		size = nextSize
+	}
+	return nil
+}
+
+func (p *tieredPicker) fillTables(cd *compactDef) bool {
+	// The compactions are not triggered by the size of the levels.
+	cd.force = true
+	if cd.thisLevel.level == 0 {
+		return p.lc.fillTablesL0(cd)
+	}
+
+	cd.thisLevel.RLock()
+	tables := cd.thisLevel.tables
+	if len(tables) == 0 {
+		cd.thisLevel.RUnlock()
+		return false
+	}
+	kr := keyRange{left: tables[0].Smallest(), right: tables[len(tables)-1].Biggest()}
+	cd.thisLevel.RUnlock()
+	return p.lc.fillTablesInRange(cd, kr)
+}
+
+func (p *tieredPicker) canUnstall() bool {
+	return !p.lc.isL0Compactable()
+}
@@ -0,0 +1,83 @@
+/*
+ * Copyright 2026 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"path/filepath"
+	"sync/atomic"
+)
+
+// dataPath returns the directory of the data path.
+func (db *DB) dataPath(pathID uint32) string {
+	return db.opt.DataPaths[pathID].Path
+}
+
+// dataPathID returns the ID of the data path that holds the file.
+func (db *DB) dataPathID(fileName string) uint32 {
+	dir := filepath.Dir(fileName)
+	for i, p := range db.opt.DataPaths {
+		if filepath.Clean(p.Path) == dir {
+			return uint32(i)
+		}
+	}
+	return 0
+}
+
+// pickDataPath returns the data path for a new file. The hot files go to the first path below its
+// target size, the cold files go to the last path.
+func (db *DB) pickDataPath(cold bool) uint32 {
+	last := len(db.opt.DataPaths) - 1
+	if cold || last == 0 {
+		return uint32(last)
+	}
+	sizes := db.dataPathSizes()
+	for i, p := range db.opt.DataPaths[:last] {
+		if p.TargetSize == 0 || sizes[i] < p.TargetSize {
+			return uint32(i)
+		}
+	}
+	return uint32(last)
+}
+
+// dataPathSizes returns the total size of the table and blob files on each data path.
+func (db *DB) dataPathSizes() []int64 {
+	sizes := make([]int64, len(db.opt.DataPaths))
+	for _, l := range db.lc.levels {
+		l.RLock()
+		for _, t := range l.tables {
+			sizes[db.dataPathID(t.Filename())] += t.Size()
+		}
+		l.RUnlock()
+	}
+	bm := &db.blobManger
+	bm.filesLock.RLock()
+	for _, f := range bm.physicalFiles {
+		sizes[db.dataPathID(f.path)] += int64(atomic.LoadUint32(&f.fileSize))
+	}
+	bm.filesLock.RUnlock()
+	return sizes
+}
+
+// syncDataPaths syncs the directories of the data paths.
+func (db *DB) syncDataPaths() error {
+	for _, p := range db.opt.DataPaths {
+		if err := syncDir(p.Path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
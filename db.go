@@ -29,6 +29,7 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/coocood/badger/options"
 	"github.com/coocood/badger/skl"
 	"github.com/coocood/badger/table"
 	"github.com/coocood/badger/y"
@@ -58,6 +59,8 @@ type DB struct {
 	dirLockGuard *directoryLockGuard
 	// nil if Dir and ValueDir are the same
 	valueDirGuard *directoryLockGuard
+	// The guards of the data paths other than Dir and ValueDir.
+	dataPathGuards []*directoryLockGuard
 
 	closers   closers
 	mt        *table.MemTable   // Our latest (actively written) in-memory table
@@ -79,9 +82,15 @@ type DB struct {
 
 	limiter *rate.Limiter
 
+	indexCache *table.IndexCache
+
 	metrics  *y.MetricsSet
 	lsmSize  int64
 	vlogSize int64
+	// The memory of mt reserved in the WriteBufferManager.
+	mtSize int64
+	// flushRequested is set if the WriteBufferManager asks to flush mt.
+	flushRequested int32
 
 	blobManger blobManager
 }
@@ -104,6 +113,16 @@ func replayFunction(out *DB) func(Entry) error {
 		out.mt.PutToSkl(nk, vs)
 	}
 
+	// A pending txn is only broken by a corruption skipped in the SkipCorruptedRecords mode.
+	rec := &logRecovery{mode: out.opt.RecoveryMode, report: &out.vlog.recoveryReport}
+	dropTxn := func() {
+		if rec.mode == options.SkipCorruptedRecords && lastCommit != 0 {
+			rec.lostTxn(lastCommit)
+			txn = txn[:0]
+			lastCommit = 0
+		}
+	}
+
 	first := true
 	return func(e Entry) error { // Function for replaying.
 		if first {
@@ -142,6 +161,7 @@ func replayFunction(out *DB) func(Entry) error {
 
 		} else if e.meta&bitTxn == 0 {
 			// This entry is from a rewrite.
+			dropTxn()
 			toLSM(nk, v)
 
 			// We shouldn't get this entry in the middle of a transaction.
@@ -150,6 +170,9 @@ func replayFunction(out *DB) func(Entry) error {
 
 		} else {
 			txnTs := y.ParseTs(nk)
+			if lastCommit != txnTs {
+				dropTxn()
+			}
 			if lastCommit == 0 {
 				lastCommit = txnTs
 			}
@@ -161,12 +184,18 @@ func replayFunction(out *DB) func(Entry) error {
 	}
 }
 
+// RecoveryReport returns the corruption handled while replaying the value log on Open.
+func (db *DB) RecoveryReport() RecoveryReport {
+	return db.vlog.recoveryReport
+}
+
 // Open returns a new DB object.
 func Open(opt Options) (db *DB, err error) {
 	opt.maxBatchSize = (15 * opt.MaxTableSize) / 100
 	opt.maxBatchCount = opt.maxBatchSize / int64(skl.MaxNodeSize)
 
-	if opt.ValueThreshold > math.MaxUint16-16 {
+	// A value stored in the LSM tree must fit into a table.
+	if int64(opt.ValueThreshold) >= opt.MaxTableSize {
 		return nil, ErrValueThreshold
 	}
 
@@ -175,7 +204,20 @@ func Open(opt Options) (db *DB, err error) {
 		opt.Truncate = false
 	}
 
-	for _, path := range []string{opt.Dir, opt.ValueDir} {
+	if len(opt.DataPaths) == 0 {
+		opt.DataPaths = []DataPath{{Path: opt.Dir}}
+	}
+	if opt.WriteBufferManager == nil {
+		opt.WriteBufferManager = NewWriteBufferManager(0)
+	}
+	if opt.TieredSizeRatio <= 0 {
+		opt.TieredSizeRatio = DefaultOptions.TieredSizeRatio
+	}
+	dirs := []string{opt.Dir, opt.ValueDir}
+	for _, p := range opt.DataPaths {
+		dirs = append(dirs, p.Path)
+	}
+	for _, path := range dirs {
 		dirExists, err := exists(path)
 		if err != nil {
 			return nil, y.Wrapf(err, "Invalid Dir: %q", path)
@@ -220,6 +262,28 @@ func Open(opt Options) (db *DB, err error) {
 			_ = valueDirLockGuard.release()
 		}
 	}()
+	lockedDirs := map[string]struct{}{absDir: {}, absValueDir: {}}
+	var dataPathGuards []*directoryLockGuard
+	defer func() {
+		for _, guard := range dataPathGuards {
+			_ = guard.release()
+		}
+	}()
+	for _, p := range opt.DataPaths {
+		absPath, err := filepath.Abs(p.Path)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := lockedDirs[absPath]; ok {
+			continue
+		}
+		lockedDirs[absPath] = struct{}{}
+		guard, err := acquireDirectoryLock(p.Path, lockFile, opt.ReadOnly)
+		if err != nil {
+			return nil, err
+		}
+		dataPathGuards = append(dataPathGuards, guard)
+	}
 	if !(opt.ValueLogFileSize <= 2<<30 && opt.ValueLogFileSize >= 1<<20) {
 		return nil, ErrValueLogSize
 	}
@@ -241,17 +305,19 @@ func Open(opt Options) (db *DB, err error) {
 	}
 
 	db = &DB{
-		imm:           make([]*table.MemTable, 0, opt.NumMemtables),
-		flushChan:     make(chan *flushTask, opt.NumMemtables),
-		writeCh:       make(chan *request, kvWriteChCapacity),
-		memTableCh:    make(chan *table.MemTable, 1),
-		ingestCh:      make(chan *ingestTask),
-		opt:           opt,
-		manifest:      manifestFile,
-		dirLockGuard:  dirLockGuard,
-		valueDirGuard: valueDirLockGuard,
-		orc:           orc,
-		metrics:       y.NewMetricSet(opt.Dir),
+		imm:            make([]*table.MemTable, 0, opt.NumMemtables),
+		flushChan:      make(chan *flushTask, opt.NumMemtables),
+		writeCh:        make(chan *request, kvWriteChCapacity),
+		memTableCh:     make(chan *table.MemTable, 1),
+		ingestCh:       make(chan *ingestTask),
+		opt:            opt,
+		manifest:       manifestFile,
+		dirLockGuard:   dirLockGuard,
+		valueDirGuard:  valueDirLockGuard,
+		dataPathGuards: dataPathGuards,
+		orc:            orc,
+		metrics:        y.NewMetricSet(opt.Dir),
+		indexCache:     table.NewIndexCache(opt.IndexCacheSize),
 	}
 	db.vlog.metrics = db.metrics
 
@@ -261,17 +327,17 @@ func Open(opt Options) (db *DB, err error) {
 	}
 
 	db.closers.memtable = y.NewCloser(1)
-	go func() {
-		lc := db.closers.memtable
+	// The goroutine must not read db, it's reset when Open fails.
+	go func(lc *y.Closer, memTableCh chan<- *table.MemTable, arenaSize int64) {
 		for {
 			select {
-			case db.memTableCh <- table.NewMemTable(arenaSize(db.opt)):
+			case memTableCh <- table.NewMemTable(arenaSize):
 			case <-lc.HasBeenClosed():
 				lc.Done()
 				return
 			}
 		}
-	}()
+	}(db.closers.memtable, db.memTableCh, arenaSize(opt))
 
 	// Calculate initial size.
 	db.calculateSize()
@@ -328,9 +394,13 @@ func Open(opt Options) (db *DB, err error) {
 
 	db.writeCh = make(chan *request, kvWriteChCapacity)
 	db.closers.writes = startWriteWorker(db)
+	if !opt.ReadOnly {
+		opt.WriteBufferManager.register(db)
+	}
 
 	valueDirLockGuard = nil
 	dirLockGuard = nil
+	dataPathGuards = nil
 	manifestFile = nil
 	return db, nil
 }
@@ -366,7 +436,7 @@ func (db *DB) prepareExternalFiles(files []*os.File) ([]*table.Table, error) {
 	tbls := make([]*table.Table, len(files))
 	for i, fd := range files {
 		id := db.lc.reserveFileID()
-		filename := table.NewFilename(id, db.opt.Dir)
+		filename := table.NewFilename(id, db.dataPath(0))
 
 		err := os.Link(fd.Name(), filename)
 		if err != nil {
@@ -378,7 +448,7 @@ func (db *DB) prepareExternalFiles(files []*os.File) ([]*table.Table, error) {
 			return nil, err
 		}
 
-		tbl, err := table.OpenTable(fd, db.opt.TableLoadingMode)
+		tbl, err := table.OpenTableWithIndexCache(fd, db.opt.TableLoadingMode, db.indexCache)
 		if err != nil {
 			return nil, err
 		}
@@ -390,7 +460,7 @@ func (db *DB) prepareExternalFiles(files []*os.File) ([]*table.Table, error) {
 		return bytes.Compare(tbls[i].Smallest(), tbls[j].Smallest()) < 0
 	})
 
-	return tbls, syncDir(db.lc.kv.opt.Dir)
+	return tbls, syncDir(db.dataPath(0))
 }
 
 func (db *DB) checkExternalTables(tbls []*table.Table) error {
@@ -420,6 +490,7 @@ func (db *DB) checkExternalTables(tbls []*table.Table) error {
 func (db *DB) Close() (err error) {
 	log.Infof("Closing database")
 
+	db.opt.WriteBufferManager.unregister(db)
 	// Stop writes next.
 	db.closers.writes.SignalAndWait()
 
@@ -440,8 +511,10 @@ func (db *DB) Close() (err error) {
 				db.Lock()
 				defer db.Unlock()
 				y.Assert(db.mt != nil)
+				ft := newFlushTask(db.mt, db.logOff)
 				select {
-				case db.flushChan <- newFlushTask(db.mt, db.logOff):
+				case db.flushChan <- ft:
+					ft.memSize = db.markMemTableImmutable()
 					db.imm = append(db.imm, db.mt) // Flusher will attempt to remove this from s.imm.
 					db.mt = nil                    // Will segfault if we try writing!
 					log.Infof("pushed to flush chan\n")
@@ -460,6 +533,8 @@ func (db *DB) Close() (err error) {
 		}
 	}
 	db.flushChan <- newFlushTask(nil, logOffset{}) // Tell flusher to quit.
+	// The empty memtable is not flushed.
+	db.opt.WriteBufferManager.free(db.markMemTableImmutable())
 
 	if db.closers.memtable != nil {
 		db.closers.memtable.SignalAndWait()
@@ -474,7 +549,7 @@ func (db *DB) Close() (err error) {
 	// We don't need to care about cstatus since no parallel compaction is running.
 	cd := compactDef{
 		thisLevel: db.lc.levels[0],
-		nextLevel: db.lc.levels[1],
+		nextLevel: db.lc.levels[db.lc.getBaseLevel()],
 	}
 	if db.lc.fillTablesL0(&cd) {
 		if err := db.lc.runCompactDef(0, cd, nil); err != nil {
@@ -500,6 +575,11 @@ func (db *DB) Close() (err error) {
 			err = errors.Wrap(guardErr, "DB.Close")
 		}
 	}
+	for _, guard := range db.dataPathGuards {
+		if guardErr := guard.release(); err == nil {
+			err = errors.Wrap(guardErr, "DB.Close")
+		}
+	}
 	if manifestErr := db.manifest.close(); err == nil {
 		err = errors.Wrap(manifestErr, "DB.Close")
 	}
@@ -513,6 +593,9 @@ func (db *DB) Close() (err error) {
 	if syncErr := syncDir(db.opt.ValueDir); err == nil {
 		err = errors.Wrap(syncErr, "DB.Close")
 	}
+	if syncErr := db.syncDataPaths(); err == nil {
+		err = errors.Wrap(syncErr, "DB.Close")
+	}
 
 	return err
 }
@@ -630,7 +713,7 @@ var requestPool = sync.Pool{
 	},
 }
 
-func (db *DB) sendToWriteCh(entries []*Entry) (*request, error) {
+func (db *DB) sendToWriteCh(entries []*Entry, needSync bool) (*request, error) {
 	var count, size int64
 	for _, e := range entries {
 		size += int64(e.estimateSize())
@@ -644,6 +727,9 @@ func (db *DB) sendToWriteCh(entries []*Entry) (*request, error) {
 	// Txns should not interleave among other txns or rewrites.
 	req := requestPool.Get().(*request)
 	req.Entries = entries
+	req.size = size
+	req.start = time.Now()
+	req.sync = needSync
 	req.Wg = sync.WaitGroup{}
 	req.Wg.Add(1)
 	db.writeCh <- req // Handled in writeWorker.
@@ -652,6 +738,15 @@ func (db *DB) sendToWriteCh(entries []*Entry) (*request, error) {
 	return req, nil
 }
 
+// Sync syncs the value log to disk, the writes committed before it are durable once it returns.
+func (db *DB) Sync() error {
+	req, err := db.sendToWriteCh(nil, true)
+	if err != nil {
+		return err
+	}
+	return req.Wait()
+}
+
 // batchSet applies a list of badger.Entry. If a request level error occurs it
 // will be returned.
 //   Check(kv.BatchSet(entries))
@@ -659,7 +754,7 @@ func (db *DB) batchSet(entries []*Entry) error {
 	sort.Slice(entries, func(i, j int) bool {
 		return y.CompareKeysWithVer(entries[i].Key, entries[j].Key) < 0
 	})
-	req, err := db.sendToWriteCh(entries)
+	req, err := db.sendToWriteCh(entries, db.opt.SyncWrites)
 	if err != nil {
 		return err
 	}
@@ -674,7 +769,7 @@ func (db *DB) batchSet(entries []*Entry) error {
 //      Check(err)
 //   }
 func (db *DB) batchSetAsync(entries []*Entry, f func(error)) error {
-	req, err := db.sendToWriteCh(entries)
+	req, err := db.sendToWriteCh(entries, db.opt.SyncWrites)
 	if err != nil {
 		return err
 	}
@@ -688,13 +783,42 @@ func (db *DB) batchSetAsync(entries []*Entry, f func(error)) error {
 
 // ensureRoomForWrite is always called serially.
 func (db *DB) ensureRoomForWrite() error {
-	if db.mt.MemSize() < db.opt.MaxTableSize {
+	size := db.mt.MemSize()
+	wbm := db.opt.WriteBufferManager
+	wbm.reserve(size - atomic.SwapInt64(&db.mtSize, size))
+	if wbm.shouldFlush() {
+		wbm.flushLargest()
+	}
+	if size < db.opt.MaxTableSize && (atomic.LoadInt32(&db.flushRequested) == 0 || db.mt.Empty()) {
 		return nil
 	}
 	_, err := db.flushMemTable()
 	return err
 }
 
+// requestFlush asks the write worker to flush mt, an empty request wakes it up if it's idle. A busy
+// write worker flushes mt with its next write.
+func (db *DB) requestFlush() {
+	if !atomic.CompareAndSwapInt32(&db.flushRequested, 0, 1) {
+		return
+	}
+	req := &request{}
+	req.Wg.Add(1)
+	select {
+	case db.writeCh <- req:
+	default:
+	}
+}
+
+// markMemTableImmutable moves the memory of mt to the memtables waiting to be flushed in the
+// WriteBufferManager, it returns the memory to free once mt is flushed.
+func (db *DB) markMemTableImmutable() int64 {
+	atomic.StoreInt32(&db.flushRequested, 0)
+	size := atomic.SwapInt64(&db.mtSize, 0)
+	db.opt.WriteBufferManager.scheduleFree(size)
+	return size
+}
+
 func (db *DB) flushMemTable() (*sync.WaitGroup, error) {
 	newMemTable := <-db.memTableCh
 	for {
@@ -705,6 +829,7 @@ func (db *DB) flushMemTable() (*sync.WaitGroup, error) {
 			log.Infof("Flushing memtable, mt.size=%d, size of flushChan: %d\n",
 				db.mt.MemSize(), len(db.flushChan))
 			// We manage to push this task. Let's modify imm.
+			ft.memSize = db.markMemTableImmutable()
 			db.imm = append(db.imm, db.mt)
 			db.mt = newMemTable
 			db.Unlock()
@@ -735,11 +860,12 @@ func (db *DB) writeLevel0Table(s *table.MemTable, f *os.File, bb *blobFileBuilde
 	for iter.Rewind(); iter.Valid(); iter.Next() {
 		key := iter.Key()
 		value := iter.Value()
-		if bb != nil && len(value.Value) > db.opt.ValueThreshold {
+		if bb != nil && value.Meta&bitValuePointer == 0 && len(value.Value) > db.opt.ValueThreshold {
 			bp, err := bb.append(value.Value)
 			if err != nil {
 				return err
 			}
+			b.AddBlobSize(len(value.Value))
 			value.Meta |= bitValuePointer
 			value.Value = bp
 		}
@@ -761,6 +887,8 @@ type flushTask struct {
 	mt  *table.MemTable
 	off logOffset
 	wg  sync.WaitGroup
+	// The memory to free in the WriteBufferManager.
+	memSize int64
 }
 
 func newFlushTask(mt *table.MemTable, off logOffset) *flushTask {
@@ -792,21 +920,22 @@ func (db *DB) runFlushMemTable(c *y.Closer) error {
 		}
 
 		fileID := db.lc.reserveFileID()
-		fileName := table.NewFilename(fileID, db.opt.Dir)
+		dir := db.dataPath(db.pickDataPath(false))
+		fileName := table.NewFilename(fileID, dir)
 		fd, err := directio.OpenFile(fileName, os.O_CREATE|os.O_RDWR, 0666)
 		if err != nil {
 			return y.Wrap(err)
 		}
 		var bb *blobFileBuilder
 		if db.opt.ValueThreshold > 0 {
-			bb, err = newBlobFileBuilder(fileID, db.opt.Dir, db.opt.TableBuilderOptions.WriteBufferSize)
+			bb, err = newBlobFileBuilder(fileID, dir, db.opt.TableBuilderOptions.WriteBufferSize)
 			if err != nil {
 				return y.Wrap(err)
 			}
 		}
 		// Don't block just to sync the directory entry.
 		dirSyncCh := make(chan error)
-		go func() { dirSyncCh <- syncDir(db.opt.Dir) }()
+		go func() { dirSyncCh <- syncDir(dir) }()
 
 		err = db.writeLevel0Table(ft.mt, fd, bb)
 		dirSyncErr := <-dirSyncCh
@@ -835,7 +964,7 @@ func (db *DB) runFlushMemTable(c *y.Closer) error {
 		if err != nil {
 			return err
 		}
-		tbl, err := table.OpenTable(fd, db.opt.TableLoadingMode)
+		tbl, err := table.OpenTableWithIndexCache(fd, db.opt.TableLoadingMode, db.indexCache)
 		if err != nil {
 			log.Infof("ERROR while opening table: %v", err)
 			return err
@@ -852,6 +981,7 @@ func (db *DB) runFlushMemTable(c *y.Closer) error {
 		y.Assert(ft.mt == db.imm[0]) //For now, single threaded.
 		db.imm = db.imm[1:]
 		ft.mt.DecrRef() // Return memory.
+		db.opt.WriteBufferManager.free(ft.memSize)
 		db.Unlock()
 		ft.wg.Done()
 	}
@@ -897,6 +1027,13 @@ func (db *DB) calculateSize() {
 	if db.opt.ValueDir != db.opt.Dir {
 		_, vlogSize = totalSize(db.opt.ValueDir)
 	}
+	// The data paths other than Dir hold more tables.
+	for _, p := range db.opt.DataPaths {
+		if filepath.Clean(p.Path) != filepath.Clean(db.opt.Dir) {
+			pathSize, _ := totalSize(p.Path)
+			lsmSize += pathSize
+		}
+	}
 	atomic.StoreInt64(&db.lsmSize, lsmSize)
 	atomic.StoreInt64(&db.vlogSize, vlogSize)
 	db.metrics.LSMSize.Set(float64(lsmSize))
@@ -925,6 +1062,87 @@ func (db *DB) Size() (lsm int64, vlog int64) {
 	return atomic.LoadInt64(&db.lsmSize), atomic.LoadInt64(&db.vlogSize)
 }
 
+// CompactRange compacts the keys in [start, end] down to the last level. A nil start or end means
+// the range is unbounded on that side. It blocks until the compaction is done. It returns
+// ErrCompactionBusy if the tables in range are kept by other compactions for too long, and
+// ErrCompactionStopped if the DB is closed.
+func (db *DB) CompactRange(start, end []byte, opts CompactRangeOptions) error {
+	if db.opt.ReadOnly {
+		return ErrInvalidRequest
+	}
+	return db.lc.compactRange(start, end, opts.MaxSubCompaction, nil)
+}
+
+// Flatten compacts all the data into the last level. The compaction workers are paused until it
+// returns, workers is the max number of sub compactions of each compaction. onProgress is called
+// after the tables of a level are compacted into the next level if it is not nil. It makes one pass
+// over the levels, so the data written during Flatten may be left above the last level.
+func (db *DB) Flatten(workers int, onProgress func(level int)) error {
+	if db.opt.ReadOnly {
+		return ErrInvalidRequest
+	}
+	db.lc.pauseCompaction()
+	defer db.lc.resumeCompaction()
+	return db.lc.compactRange(nil, nil, workers, onProgress)
+}
+
+// EstimateRange returns the approximate size and number of entries of the keys in [start, end).
+// A nil start or end means the range is unbounded on that side.
+func (db *DB) EstimateRange(start, end []byte) RangeEstimate {
+	var est RangeEstimate
+	startKey := y.KeyWithTs(start, math.MaxUint64)
+	var endKey []byte
+	if end != nil {
+		endKey = y.KeyWithTs(end, math.MaxUint64)
+	}
+	tables := db.getMemTables()
+	for _, mt := range tables {
+		it := mt.NewIterator(false)
+		for it.Seek(startKey); it.Valid(); it.Next() {
+			if endKey != nil && y.CompareKeysWithVer(it.Key(), endKey) >= 0 {
+				break
+			}
+			vs := it.Value()
+			est.MemTableSize += int64(len(it.Key())) + int64(vs.EncodedSize())
+		}
+		it.Close()
+		mt.DecrRef()
+	}
+	db.lc.estimateRange(startKey, endKey, &est)
+	return est
+}
+
+// CreateSnapshot pins the current read timestamp with the given name. The snapshot is persisted in
+// the MANIFEST, the versions visible to it are kept by compactions until ReleaseSnapshot is called,
+// even across restarts. Use NewTransactionAtSnapshot to read from it.
+func (db *DB) CreateSnapshot(name string) error {
+	if db.opt.managedTxns {
+		return ErrManagedTxn
+	}
+	return db.createSnapshot(name, db.orc.readTs())
+}
+
+func (db *DB) createSnapshot(name string, readTs uint64) error {
+	if db.opt.ReadOnly {
+		return ErrInvalidRequest
+	}
+	return db.manifest.createSnapshot(name, readTs)
+}
+
+// ReleaseSnapshot removes the snapshot, the versions pinned by it can be discarded after the
+// transactions reading from it are done.
+func (db *DB) ReleaseSnapshot(name string) error {
+	if db.opt.ReadOnly {
+		return ErrInvalidRequest
+	}
+	return db.manifest.releaseSnapshot(name)
+}
+
+// LevelStats returns the statistics of every level of the LSM tree.
+func (db *DB) LevelStats() []LevelStat {
+	return db.lc.getLevelStats()
+}
+
 func (db *DB) Tables() []TableInfo {
 	return db.lc.getTableInfo()
 }
@@ -938,6 +1156,13 @@ func (db *DB) GetVLogOffset() uint64 {
 func (db *DB) IterateVLog(offset uint64, fn func(e Entry)) error {
 	startFid := uint32(offset >> 32)
 	vOffset := uint32(offset)
+	var slice y.Slice
+	blobCache := map[uint32]*blobCache{}
+	defer func() {
+		for _, bc := range blobCache {
+			bc.file.decrRef()
+		}
+	}()
 	for fid := startFid; fid <= db.vlog.maxFid(); fid++ {
 		lf, err := db.vlog.getFile(fid)
 		if err != nil {
@@ -946,8 +1171,16 @@ func (db *DB) IterateVLog(offset uint64, fn func(e Entry)) error {
 		if fid != startFid {
 			vOffset = 0
 		}
-		endOffset, err := db.vlog.iterate(lf, vOffset, func(e Entry) error {
+		endOffset, err := db.vlog.iterate(lf, vOffset, nil, func(e Entry) error {
 			if e.meta&bitTxn > 0 {
+				if e.meta&bitValuePointer > 0 {
+					val, err := db.blobManger.read(e.Value, &slice, blobCache)
+					if err != nil {
+						return err
+					}
+					e.Value = val
+					e.meta &^= bitValuePointer
+				}
 				fn(e)
 			}
 			return nil
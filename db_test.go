@@ -27,14 +27,20 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"runtime"
 	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/coocood/badger/options"
 	"github.com/coocood/badger/table"
 	"github.com/coocood/badger/y"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/stretchr/testify/require"
 )
 
@@ -1057,7 +1063,7 @@ func TestLSMOnly(t *testing.T) {
 	require.NotEqual(t, dopts.ValueThreshold, opts.ValueThreshold)
 	require.NotEqual(t, dopts.ValueLogFileSize, opts.ValueLogFileSize)
 
-	dopts.ValueThreshold = 1 << 16
+	dopts.ValueThreshold = int(dopts.MaxTableSize)
 	_, err = Open(dopts)
 	require.Equal(t, ErrValueThreshold, err)
 
@@ -1077,6 +1083,101 @@ func TestLSMOnly(t *testing.T) {
 	}
 }
 
+func TestLargeValue(t *testing.T) {
+	sizes := []int{1 << 20, 3<<20 + 7, 6 << 20}
+	values := make([][]byte, len(sizes))
+	for i, sz := range sizes {
+		values[i] = make([]byte, sz)
+		_, err := rand.Read(values[i])
+		require.NoError(t, err)
+	}
+	check := func(db *DB) {
+		require.NoError(t, db.View(func(txn *Txn) error {
+			for i, v := range values {
+				item, err := txn.Get([]byte(fmt.Sprintf("key%d", i)))
+				require.NoError(t, err)
+				require.Equal(t, v, getItemValue(t, item))
+			}
+			return nil
+		}))
+	}
+	for _, threshold := range []int{8 << 20, 1 << 10} {
+		dir, err := ioutil.TempDir("", "badger")
+		require.NoError(t, err)
+		opts := DefaultOptions
+		opts.Dir = dir
+		opts.ValueDir = dir
+		opts.ValueThreshold = threshold
+		db, err := Open(opts)
+		require.NoError(t, err)
+		for i, v := range values {
+			txnSet(t, db, []byte(fmt.Sprintf("key%d", i)), v, 0x00)
+		}
+		// Read from the memtable.
+		check(db)
+		wg, err := db.flushMemTable()
+		require.NoError(t, err)
+		wg.Wait()
+		// Read from the L0 table or blob file.
+		check(db)
+		require.NoError(t, db.Close())
+
+		db, err = Open(opts)
+		require.NoError(t, err)
+		check(db)
+		require.NoError(t, db.Close())
+		os.RemoveAll(dir)
+	}
+}
+
+func TestGroupCommit(t *testing.T) {
+	histogram := func(o prometheus.Observer) *dto.Histogram {
+		var m dto.Metric
+		require.NoError(t, o.(prometheus.Histogram).Write(&m))
+		return m.GetHistogram()
+	}
+	for _, maxEntries := range []int{0, 4} {
+		dir, err := ioutil.TempDir("", "badger")
+		require.NoError(t, err)
+		opts := getTestOptions(dir)
+		opts.SyncWrites = true
+		opts.ValueLogWriteOptions.GroupCommitDelay = 20 * time.Millisecond
+		opts.ValueLogWriteOptions.GroupCommitMaxEntries = maxEntries
+		db, err := Open(opts)
+		require.NoError(t, err)
+
+		var wg sync.WaitGroup
+		for i := 0; i < 64; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				txnSet(t, db, []byte(fmt.Sprintf("key%d", i)), []byte("value"), 0)
+			}(i)
+		}
+		wg.Wait()
+
+		batchRequests := histogram(db.metrics.WriteBatchRequests)
+		require.Equal(t, uint64(64), uint64(batchRequests.GetSampleSum()))
+		require.Equal(t, uint64(64), histogram(db.metrics.CommitDuration).GetSampleCount())
+		require.NotZero(t, histogram(db.metrics.WriteBatchSize).GetSampleCount())
+		require.Equal(t, batchRequests.GetSampleCount(), histogram(db.metrics.WriteQueueDepth).GetSampleCount())
+		if maxEntries == 0 {
+			// The requests are grouped by the delay.
+			require.True(t, batchRequests.GetSampleCount() < 32)
+		} else {
+			// A request has an entry and the txn fin entry.
+			for _, b := range batchRequests.GetBucket() {
+				if b.GetUpperBound() >= 2 {
+					require.Equal(t, batchRequests.GetSampleCount(), b.GetCumulativeCount())
+					break
+				}
+			}
+		}
+		require.NoError(t, db.Close())
+		os.RemoveAll(dir)
+	}
+}
+
 func TestMinReadTs(t *testing.T) {
 	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
 		for i := 0; i < 10; i++ {
@@ -1195,6 +1296,264 @@ func TestCompactionFilter(t *testing.T) {
 	require.True(t, dropAppearOldCount > 0)
 }
 
+func TestCompactRange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	opts.DoNotCompact = true
+	opts.NumLevelZeroTables = 100
+	opts.NumLevelZeroTablesStall = 200
+	db, err := Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+
+	val := make([]byte, 16)
+	for i := 0; i < 10000; i++ {
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			return txn.Set([]byte(fmt.Sprintf("key%05d", i)), val)
+		}))
+	}
+	for len(db.Tables()) == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.NoError(t, db.CompactRange(nil, nil, CompactRangeOptions{}))
+
+	for i := 0; i < 10000; i += 2 {
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			return txn.Delete([]byte(fmt.Sprintf("key%05d", i)))
+		}))
+	}
+	for db.lc.levels[0].numTables() == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	// The deleted keys overlap with the tables in the last level, so sub compactions are used.
+	require.NoError(t, db.CompactRange(nil, nil, CompactRangeOptions{MaxSubCompaction: 2}))
+	lastLevel := opts.TableBuilderOptions.MaxLevels - 1
+	for _, info := range db.Tables() {
+		require.Equal(t, lastLevel, info.Level)
+	}
+
+	require.NoError(t, db.View(func(txn *Txn) error {
+		for i := 0; i < 10000; i++ {
+			_, err := txn.Get([]byte(fmt.Sprintf("key%05d", i)))
+			if i%2 == 0 {
+				require.Equal(t, ErrKeyNotFound, err)
+			} else {
+				require.NoError(t, err)
+			}
+		}
+		return nil
+	}))
+}
+
+func TestFlatten(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		val := make([]byte, 16)
+		for i := 0; i < 10000; i++ {
+			require.NoError(t, db.Update(func(txn *Txn) error {
+				return txn.Set([]byte(fmt.Sprintf("key%05d", i%5000)), val)
+			}))
+		}
+		for len(db.Tables()) == 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		var levels []int
+		require.NoError(t, db.Flatten(2, func(level int) {
+			levels = append(levels, level)
+		}))
+		require.NotEmpty(t, levels)
+		lastLevel := db.opt.TableBuilderOptions.MaxLevels - 1
+		for _, info := range db.Tables() {
+			require.Equal(t, lastLevel, info.Level)
+		}
+		require.Equal(t, int32(0), atomic.LoadInt32(&db.lc.pausedCompactors))
+
+		require.NoError(t, db.View(func(txn *Txn) error {
+			for i := 0; i < 5000; i++ {
+				_, err := txn.Get([]byte(fmt.Sprintf("key%05d", i)))
+				require.NoError(t, err)
+			}
+			return nil
+		}))
+
+		// Only the levels which have tables are reported.
+		levels = levels[:0]
+		require.NoError(t, db.Flatten(2, func(level int) {
+			levels = append(levels, level)
+		}))
+		require.Empty(t, levels)
+
+		// Flatten returns while the writes keep coming.
+		stop := make(chan struct{})
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				require.NoError(t, db.Update(func(txn *Txn) error {
+					return txn.Set([]byte(fmt.Sprintf("key%05d", i%5000)), val)
+				}))
+			}
+		}()
+		flattened := func() bool {
+			for _, info := range db.Tables() {
+				if info.Level != lastLevel {
+					return false
+				}
+			}
+			return true
+		}
+		for flattened() {
+			time.Sleep(10 * time.Millisecond)
+		}
+		require.NoError(t, db.Flatten(2, nil))
+		close(stop)
+		wg.Wait()
+	})
+}
+
+func TestLevelStats(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		val := make([]byte, 16)
+		for i := 0; i < 5000; i++ {
+			require.NoError(t, db.Update(func(txn *Txn) error {
+				return txn.Set([]byte(fmt.Sprintf("key%05d", i)), val)
+			}))
+		}
+		for len(db.Tables()) == 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
+		require.NoError(t, db.CompactRange(nil, nil, CompactRangeOptions{}))
+
+		stats := db.LevelStats()
+		require.Len(t, stats, db.opt.TableBuilderOptions.MaxLevels)
+		require.True(t, stats[0].CompactionStats.BytesWrite > 0)
+		require.Equal(t, 1.0, stats[0].WriteAmp)
+		lastLevel := stats[len(stats)-1]
+		require.True(t, lastLevel.NumTables > 0)
+		require.True(t, lastLevel.Size > 0)
+		require.True(t, lastLevel.CompactionStats.BytesWrite > 0)
+		require.True(t, lastLevel.WriteAmp > 0)
+		for _, stat := range stats {
+			require.Empty(t, stat.Compacting)
+		}
+		require.Zero(t, lastLevel.Score)
+
+		var numEntries uint64
+		for _, info := range db.Tables() {
+			numEntries += info.NumEntries
+			require.True(t, info.MinVersion > 0)
+			require.True(t, info.MinVersion <= info.MaxVersion)
+			require.True(t, info.MaxVersion <= 5000)
+			require.False(t, info.CreatedAt.IsZero())
+		}
+		require.True(t, numEntries > 0)
+
+		// The score is reported even if the level doesn't need compaction.
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			return txn.Set([]byte("key"), val)
+		}))
+		wg, err := db.flushMemTable()
+		require.NoError(t, err)
+		wg.Wait()
+		stats = db.LevelStats()
+		require.Equal(t, 1/float64(db.opt.NumLevelZeroTables), stats[0].Score)
+	})
+}
+
+func TestEstimateRange(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		val := make([]byte, 16)
+		for i := 0; i < 20000; i++ {
+			require.NoError(t, db.Update(func(txn *Txn) error {
+				return txn.Set([]byte(fmt.Sprintf("key%05d", i)), val)
+			}))
+		}
+		for len(db.Tables()) == 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
+		require.NoError(t, db.CompactRange(nil, nil, CompactRangeOptions{}))
+
+		total := db.EstimateRange(nil, nil)
+		require.True(t, total.SSTSize > 0)
+		require.True(t, total.NumEntries > 0)
+		require.True(t, total.MemTableSize > 0)
+
+		var numEntries uint64
+		for _, info := range db.Tables() {
+			numEntries += info.NumEntries
+		}
+		require.Equal(t, int64(numEntries), total.NumEntries)
+
+		// The flushed keys are evenly distributed, so the estimation of a half should be about a half.
+		mid := []byte(fmt.Sprintf("key%05d", numEntries/2))
+		left, right := db.EstimateRange(nil, mid), db.EstimateRange(mid, nil)
+		require.InEpsilon(t, total.SSTSize/2, left.SSTSize, 0.1)
+		require.InEpsilon(t, total.SSTSize/2, right.SSTSize, 0.1)
+		require.InEpsilon(t, total.NumEntries/2, left.NumEntries, 0.1)
+
+		none := db.EstimateRange([]byte("a"), []byte("b"))
+		require.Equal(t, RangeEstimate{}, none)
+
+		// Only the entries in the range count for the memtables.
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			return txn.Set([]byte("zz"), val)
+		}))
+		point := db.EstimateRange([]byte("zz"), []byte("zz\x00"))
+		require.True(t, point.MemTableSize > 0)
+		require.True(t, point.MemTableSize < 100)
+	})
+}
+
+func TestTieredCompaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	opts.CompactionStyle = options.TieredCompaction
+	opts.NumLevelZeroTables = 2
+	opts.NumLevelZeroTablesStall = 10
+	// A ratio not greater than 0 uses the default.
+	opts.TieredSizeRatio = 0
+	db, err := Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+	require.Equal(t, DefaultOptions.TieredSizeRatio, db.opt.TieredSizeRatio)
+
+	val := make([]byte, 16)
+	for i := 0; i < 20000; i++ {
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			return txn.Set([]byte(fmt.Sprintf("key%05d", i%10000)), val)
+		}))
+	}
+	compacted := func() bool {
+		for _, info := range db.Tables() {
+			if info.Level > 0 {
+				return true
+			}
+		}
+		return false
+	}
+	for start := time.Now(); !compacted(); time.Sleep(10 * time.Millisecond) {
+		require.True(t, time.Since(start) < 10*time.Second, "no table is compacted out of level 0")
+	}
+
+	require.NoError(t, db.View(func(txn *Txn) error {
+		for i := 0; i < 10000; i++ {
+			_, err := txn.Get([]byte(fmt.Sprintf("key%05d", i)))
+			require.NoError(t, err)
+		}
+		return nil
+	}))
+}
+
 func (f *testFilter) Guards() []Guard {
 	return []Guard{
 		{
@@ -1752,3 +2111,785 @@ func ExampleTxn_NewIterator() {
 	// Output:
 	// Counted 1000 elements
 }
+
+func TestSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	db, err := Open(opts)
+	require.NoError(t, err)
+
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key%05d", i)) }
+	val := func(i, ver int) []byte { return []byte(fmt.Sprintf("val%05d-%08d", i, ver)) }
+	write := func(ver int) {
+		for i := 0; i < 1000; i++ {
+			require.NoError(t, db.Update(func(txn *Txn) error {
+				return txn.Set(key(i), val(i, ver))
+			}))
+		}
+	}
+	verify := func(txn *Txn, ver int) {
+		for i := 0; i < 1000; i++ {
+			item, err := txn.Get(key(i))
+			require.NoError(t, err)
+			v, err := item.Value()
+			require.NoError(t, err)
+			require.Equal(t, val(i, ver), v)
+		}
+	}
+	numEntries := func() (n uint64) {
+		for _, info := range db.Tables() {
+			n += info.NumEntries
+		}
+		return
+	}
+	compact := func() {
+		wg, err := db.flushMemTable()
+		require.NoError(t, err)
+		wg.Wait()
+		require.NoError(t, db.CompactRange(nil, nil, CompactRangeOptions{}))
+	}
+
+	write(1)
+	require.NoError(t, db.CreateSnapshot("export"))
+	require.Equal(t, ErrSnapshotExists, db.CreateSnapshot("export"))
+	write(2)
+	require.NoError(t, db.Close())
+
+	db, err = Open(opts)
+	require.NoError(t, err)
+	write(3)
+	require.NoError(t, db.View(func(txn *Txn) error {
+		verify(txn, 3)
+		return nil
+	}))
+	require.NoError(t, db.CompactRange(nil, nil, CompactRangeOptions{}))
+
+	txn, err := db.NewTransactionAtSnapshot("export")
+	require.NoError(t, err)
+	verify(txn, 1)
+	pinned := numEntries()
+
+	require.NoError(t, db.ReleaseSnapshot("export"))
+	require.Equal(t, ErrSnapshotNotFound, db.ReleaseSnapshot("export"))
+	_, err = db.NewTransactionAtSnapshot("export")
+	require.Equal(t, ErrSnapshotNotFound, err)
+	// The open transaction still keeps the versions of the released snapshot.
+	write(4)
+	compact()
+	verify(txn, 1)
+	txn.Discard()
+	require.NoError(t, db.Close())
+
+	db, err = Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+	write(5)
+	require.NoError(t, db.View(func(txn *Txn) error {
+		verify(txn, 5)
+		return nil
+	}))
+	compact()
+	require.True(t, numEntries() < pinned)
+}
+
+func TestIteratorVersionRange(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		key := func(i int) []byte { return []byte(fmt.Sprintf("key%02d", i)) }
+		val := func(i, batch int) []byte { return []byte(fmt.Sprintf("val%02d-%d", i, batch)) }
+		// write writes a batch and returns the version range of it.
+		write := func(batch, n int, flush bool) (minVer, maxVer uint64) {
+			minVer = db.orc.readTs() + 1
+			for i := 0; i < n; i++ {
+				require.NoError(t, db.Update(func(txn *Txn) error {
+					if batch == 2 && i == n-1 {
+						return txn.Delete(key(i))
+					}
+					return txn.Set(key(i), val(i, batch))
+				}))
+			}
+			maxVer = db.orc.readTs()
+			if flush {
+				wg, err := db.flushMemTable()
+				require.NoError(t, err)
+				wg.Wait()
+			}
+			return
+		}
+		write(1, 10, true)
+		min2, max2 := write(2, 10, true)
+		min3, _ := write(3, 5, false)
+
+		require.NoError(t, db.View(func(txn *Txn) error {
+			opts := DefaultIteratorOptions
+			opts.AllVersions = true
+			opts.MinVersion, opts.MaxVersion = min2, max2
+			it := txn.NewIterator(opts)
+			var n int
+			for it.Rewind(); it.Valid(); it.Next() {
+				item := it.Item()
+				require.True(t, item.Version() >= min2 && item.Version() <= max2)
+				require.Equal(t, bytes.Equal(item.Key(), key(9)), item.IsDeleted())
+				require.Equal(t, bytes.Equal(item.Key(), key(9)), item.IsTombstone())
+				n++
+			}
+			it.Close()
+			require.Equal(t, 10, n)
+
+			opts.AllVersions = false
+			for _, reverse := range []bool{false, true} {
+				opts.Reverse = reverse
+				it = txn.NewIterator(opts)
+				n = 0
+				for it.Rewind(); it.Valid(); it.Next() {
+					v, err := it.Item().Value()
+					require.NoError(t, err)
+					require.Equal(t, val(int(it.Item().Key()[4]-'0'), 2), v)
+					n++
+				}
+				it.Close()
+				require.Equal(t, 9, n)
+			}
+
+			opts = DefaultIteratorOptions
+			opts.MinVersion = min3
+			it = txn.NewIterator(opts)
+			n = 0
+			for it.Rewind(); it.Valid(); it.Next() {
+				n++
+			}
+			it.Close()
+			require.Equal(t, 5, n)
+			return nil
+		}))
+
+		opts := IteratorOptions{MinVersion: min2, MaxVersion: max2}
+		l0 := db.lc.levels[0]
+		l0.RLock()
+		require.Len(t, l0.tables, 2)
+		require.False(t, opts.OverlapTable(l0.tables[0]))
+		require.True(t, opts.OverlapTable(l0.tables[1]))
+		l0.RUnlock()
+	})
+}
+
+type countingPropsCollector struct {
+	numKeys int
+}
+
+func (c *countingPropsCollector) Add(key, value, userMeta []byte, deleted bool) {
+	c.numKeys++
+}
+
+func (c *countingPropsCollector) Finish() map[string][]byte {
+	return map[string][]byte{"test.num_keys": []byte(strconv.Itoa(c.numKeys))}
+}
+
+func TestTableInfoProperties(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	opts.TableBuilderOptions.TablePropertiesCollectorFactory = func() options.TablePropertiesCollector {
+		return new(countingPropsCollector)
+	}
+	db, err := Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+
+	for i := 0; i < 100; i++ {
+		txnSet(t, db, []byte(fmt.Sprintf("key%03d", i)), []byte("val"), 0)
+	}
+	for i := 0; i < 100; i += 4 {
+		txnDelete(t, db, []byte(fmt.Sprintf("key%03d", i)))
+	}
+	wg, err := db.flushMemTable()
+	require.NoError(t, err)
+	wg.Wait()
+
+	infos := db.Tables()
+	require.Len(t, infos, 1)
+	require.Equal(t, uint64(25), infos[0].NumDeletes)
+	require.Equal(t, []byte(strconv.Itoa(int(infos[0].NumEntries))), infos[0].UserProperties["test.num_keys"])
+}
+
+func TestTombstoneCompaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	opts.TombstoneCompactionRatio = 0.5
+	db, err := Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key%04d", i)) }
+	for i := 0; i < 1000; i++ {
+		txnSet(t, db, key(i), make([]byte, 16), 0)
+	}
+	wg, err := db.flushMemTable()
+	require.NoError(t, err)
+	wg.Wait()
+	require.NoError(t, db.CompactRange(nil, nil, CompactRangeOptions{}))
+
+	for i := 0; i < 1000; i++ {
+		txnDelete(t, db, key(i))
+	}
+	// Reading at the latest version lets the compactions discard the deleted versions.
+	require.NoError(t, db.View(func(txn *Txn) error {
+		_, err := txn.Get(key(999))
+		require.Equal(t, ErrKeyNotFound, err)
+		return nil
+	}))
+	wg, err = db.flushMemTable()
+	require.NoError(t, err)
+	wg.Wait()
+
+	// Compact the tombstones into level 1, which is far below its target size. They are kept as the
+	// keys are in the last level.
+	cd := compactDef{thisLevel: db.lc.levels[0], nextLevel: db.lc.levels[1]}
+	require.True(t, db.lc.fillTablesL0(&cd))
+	require.Len(t, cd.top, 1)
+	require.True(t, tombstoneRatio(cd.top[0]) >= 0.5)
+	err = db.lc.runCompactDef(0, cd, db.lc.kv.limiter)
+	db.lc.cstatus.delete(cd)
+	require.NoError(t, err)
+
+	hasTombstones := func() bool {
+		for _, info := range db.Tables() {
+			if info.NumDeletes > 0 {
+				return true
+			}
+		}
+		return false
+	}
+	for i := 0; i < 1000 && hasTombstones(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.False(t, hasTombstones())
+	require.NoError(t, db.View(func(txn *Txn) error {
+		_, err := txn.Get(key(0))
+		require.Equal(t, ErrKeyNotFound, err)
+		return nil
+	}))
+}
+
+type expiringFilter struct {
+	expired *int32
+}
+
+func (f *expiringFilter) Filter(key, val, userMeta []byte) Decision {
+	if atomic.LoadInt32(f.expired) > 0 && bytes.HasPrefix(key, []byte("key")) {
+		return DecisionDrop
+	}
+	return DecisionKeep
+}
+
+func (f *expiringFilter) Guards() []Guard {
+	return nil
+}
+
+func TestPeriodicCompaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	var expired int32
+	opts := getTestOptions(dir)
+	opts.PeriodicCompactionSeconds = 1
+	opts.CompactionFilterFactory = func(targetLevel int, smallest, biggest []byte) CompactionFilter {
+		return &expiringFilter{expired: &expired}
+	}
+	db, err := Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key%04d", i)) }
+	for i := 0; i < 200; i++ {
+		txnSet(t, db, key(i), make([]byte, 16), 0)
+	}
+	wg, err := db.flushMemTable()
+	require.NoError(t, err)
+	wg.Wait()
+	require.NoError(t, db.CompactRange(nil, nil, CompactRangeOptions{}))
+
+	exists := func() (found bool) {
+		require.NoError(t, db.View(func(txn *Txn) error {
+			_, err := txn.Get(key(0))
+			found = err == nil
+			return nil
+		}))
+		return
+	}
+	require.True(t, exists())
+	atomic.StoreInt32(&expired, 1)
+	for i := 0; i < 1000 && exists(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.False(t, exists())
+	for _, info := range db.Tables() {
+		require.Equal(t, db.opt.TableBuilderOptions.MaxLevels-1, info.Level)
+	}
+}
+
+func TestDynamicLevelBytes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	opts.LevelCompactionDynamicLevelBytes = true
+	db, err := Open(opts)
+	require.NoError(t, err)
+
+	lastLevel := len(db.lc.levels) - 1
+	require.Equal(t, lastLevel, db.lc.getBaseLevel())
+	for i := 0; i < 1000; i++ {
+		txnSet(t, db, []byte(fmt.Sprintf("key%04d", i)), make([]byte, 16), 0)
+	}
+	// Level 0 is compacted into the base level on close.
+	require.NoError(t, db.Close())
+	db, err = Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+	for l := 0; l < lastLevel; l++ {
+		require.Equal(t, 0, db.lc.levels[l].numTables())
+	}
+	require.True(t, db.lc.levels[lastLevel].numTables() > 0)
+	require.Equal(t, lastLevel, db.lc.getBaseLevel())
+
+	// Flatten compacts level 0 into the base level directly.
+	for i := 0; i < 1000; i++ {
+		txnSet(t, db, []byte(fmt.Sprintf("key%04d", i)), make([]byte, 16), 0)
+	}
+	wg, err := db.flushMemTable()
+	require.NoError(t, err)
+	wg.Wait()
+	var compacted []int
+	require.NoError(t, db.Flatten(0, func(level int) {
+		compacted = append(compacted, level)
+	}))
+	require.Equal(t, []int{0}, compacted)
+
+	// Pretend the last level has grown.
+	last := db.lc.levels[lastLevel]
+	last.Lock()
+	actualSize := last.totalSize
+	last.totalSize = 100 * opts.LevelOneSize
+	last.Unlock()
+	db.lc.updateLevelTargets()
+	require.Equal(t, lastLevel-2, db.lc.getBaseLevel())
+	for l := 1; l < lastLevel-2; l++ {
+		require.Equal(t, int64(0), db.lc.levels[l].getMaxTotalSize())
+	}
+	require.Equal(t, opts.LevelOneSize, db.lc.levels[lastLevel-2].getMaxTotalSize())
+	require.Equal(t, 10*opts.LevelOneSize, db.lc.levels[lastLevel-1].getMaxTotalSize())
+	require.Equal(t, 100*opts.LevelOneSize, last.getMaxTotalSize())
+	for _, p := range db.lc.pickCompactLevels() {
+		require.NotEqual(t, lastLevel, p.level)
+	}
+
+	last.Lock()
+	last.totalSize = actualSize
+	last.Unlock()
+	db.lc.updateLevelTargets()
+	require.Equal(t, lastLevel, db.lc.getBaseLevel())
+}
+
+func TestPartitionedIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	opts.TableLoadingMode = options.FileIO
+	opts.TableBuilderOptions.IndexPartitionSize = 64
+	opts.IndexCacheSize = 4 << 10
+	db, err := Open(opts)
+	require.NoError(t, err)
+
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key%05d", i)) }
+	for i := 0; i < 2000; i++ {
+		txnSet(t, db, key(i), []byte(fmt.Sprintf("val%013d", i)), 0)
+	}
+	require.NoError(t, db.Close())
+	db, err = Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+
+	var numPartitions uint64
+	for _, l := range db.lc.levels {
+		for _, tbl := range l.tables {
+			numPartitions += tbl.Properties().NumIndexPartitions
+		}
+	}
+	require.True(t, numPartitions > 1)
+	require.NoError(t, db.View(func(txn *Txn) error {
+		for i := 0; i < 2000; i++ {
+			item, err := txn.Get(key(i))
+			require.NoError(t, err)
+			require.Equal(t, []byte(fmt.Sprintf("val%013d", i)), getItemValue(t, item))
+		}
+		_, err := txn.Get(key(2000))
+		require.Equal(t, ErrKeyNotFound, err)
+		return nil
+	}))
+	require.True(t, db.indexCache.Size() > 0)
+	require.True(t, db.indexCache.Size() <= opts.IndexCacheSize)
+}
+
+func BenchmarkFilterType(b *testing.B) {
+	counterValue := func(c prometheus.Counter) float64 {
+		var m dto.Metric
+		y.Check(c.Write(&m))
+		return m.GetCounter().GetValue()
+	}
+	filterTypes := []struct {
+		name       string
+		filterType options.FilterType
+	}{
+		{"BBloom", options.BBloomFilter},
+		{"BlockedBloom", options.BlockedBloomFilter},
+		{"Ribbon", options.RibbonFilter},
+	}
+	const n = 100000
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key%08d", i)) }
+	for _, ft := range filterTypes {
+		b.Run(ft.name, func(b *testing.B) {
+			dir, err := ioutil.TempDir("", "badger")
+			y.Check(err)
+			defer os.RemoveAll(dir)
+			opts := DefaultOptions
+			opts.Dir, opts.ValueDir = dir, dir
+			opts.SyncWrites = false
+			opts.TableBuilderOptions.FilterType = ft.filterType
+			// The tables are compacted into the last level, whose false positive rate is about 1%.
+			opts.TableBuilderOptions.MaxLevels = 2
+			db, err := Open(opts)
+			y.Check(err)
+			for i := 0; i < n; i += 100 {
+				y.Check(db.Update(func(txn *Txn) error {
+					for j := i; j < i+100; j++ {
+						// Only the even keys are written, so the odd keys are in the range of the tables.
+						if err := txn.Set(key(2*j), make([]byte, 16)); err != nil {
+							return err
+						}
+					}
+					return nil
+				}))
+			}
+			// Close flushes the memtable and compacts level 0.
+			y.Check(db.Close())
+			db, err = Open(opts)
+			y.Check(err)
+			defer db.Close()
+
+			var filterSize int
+			for _, l := range db.lc.levels {
+				for _, tbl := range l.tables {
+					filterSize += tbl.FilterSize()
+				}
+			}
+			b.ResetTimer()
+			y.Check(db.View(func(txn *Txn) error {
+				for i := 0; i < b.N; i++ {
+					if _, err := txn.Get(key(2*(i%n) + 1)); err != ErrKeyNotFound {
+						return err
+					}
+				}
+				return nil
+			}))
+			b.StopTimer()
+
+			var gets, falsePositives float64
+			for _, l := range db.lc.levels {
+				gets += counterValue(l.metrics.NumLSMGets)
+				falsePositives += counterValue(l.metrics.NumLSMBloomFalsePositive)
+			}
+			b.ReportMetric(float64(filterSize*8)/n, "bits/key")
+			b.ReportMetric(falsePositives/gets, "fpr")
+		})
+	}
+}
+
+func TestDataPaths(t *testing.T) {
+	oldMinValid, oldMaxValid, oldMaxDiscard := minCandidateValidSize, maxCandidateValidSize, maxCandidateDiscardSize
+	defer func() {
+		minCandidateValidSize, maxCandidateValidSize, maxCandidateDiscardSize = oldMinValid, oldMaxValid, oldMaxDiscard
+	}()
+	minCandidateValidSize = 4 * 1024
+	maxCandidateValidSize = minCandidateValidSize * 4
+	maxCandidateDiscardSize = 64 * 1024
+	dirs := make([]string, 3)
+	for i := range dirs {
+		dir, err := ioutil.TempDir("", "badger")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+		dirs[i] = dir
+	}
+	fast, slow := dirs[1], dirs[2]
+	opts := getTestOptions(dirs[0])
+	opts.DataPaths = []DataPath{{Path: fast}, {Path: slow}}
+	opts.TableBuilderOptions.MaxLevels = 3
+	opts.ValueThreshold = 512
+	db, err := Open(opts)
+	require.NoError(t, err)
+
+	// The values are stored in the blob files, overwriting half of them makes the blob GC rewrite
+	// the blob files flushed on the fast path to the slow path.
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key%05d", i)) }
+	val, newVal := make([]byte, 1024), make([]byte, 1024)
+	newVal[0] = 1
+	for i := 0; i < 2000; i++ {
+		txnSet(t, db, key(i), val, 0)
+	}
+	for i := 0; i < 2000; i += 2 {
+		txnSet(t, db, key(i), newVal, 0)
+	}
+	hasBlobs := func(dir string) bool {
+		files, err := ioutil.ReadDir(dir)
+		require.NoError(t, err)
+		for _, fi := range files {
+			if strings.HasSuffix(fi.Name(), blobFileSuffix) {
+				return true
+			}
+		}
+		return false
+	}
+	require.NoError(t, db.CompactRange(nil, nil, CompactRangeOptions{}))
+	require.True(t, db.lc.levels[len(db.lc.levels)-1].numTables() > 0)
+	for start := time.Now(); !hasBlobs(slow); time.Sleep(100 * time.Millisecond) {
+		require.True(t, time.Since(start) < 10*time.Second, "no blob files on the slow path")
+	}
+
+	// checkPaths checks the tables are on the data paths of their levels and the MANIFEST, the
+	// flushed blob files are on the fast path and the blob files written by GC are on the slow path.
+	checkPaths := func(db *DB) {
+		for _, l := range db.lc.levels {
+			l.RLock()
+			for _, tbl := range l.tables {
+				dir := fast
+				if l.level == len(db.lc.levels)-1 {
+					dir = slow
+				}
+				require.Equal(t, table.NewFilename(tbl.ID(), dir), tbl.Filename())
+				require.Equal(t, db.dataPathID(tbl.Filename()), db.manifest.manifest.Tables[tbl.ID()].PathID)
+			}
+			l.RUnlock()
+		}
+		bm := &db.blobManger
+		bm.filesLock.RLock()
+		for fid, f := range bm.physicalFiles {
+			// Only the blob files written by GC have the address mapping.
+			dir := fast
+			if f.mappingSize > 0 {
+				dir = slow
+			}
+			require.Equal(t, newBlobFileName(uint64(fid), dir), f.path)
+		}
+		bm.filesLock.RUnlock()
+		files, err := ioutil.ReadDir(dirs[0])
+		require.NoError(t, err)
+		for _, fi := range files {
+			require.NotEqual(t, ".sst", filepath.Ext(fi.Name()))
+			require.False(t, strings.HasSuffix(fi.Name(), blobFileSuffix), fi.Name())
+		}
+	}
+	checkPaths(db)
+	require.NoError(t, db.Close())
+
+	db, err = Open(opts)
+	require.NoError(t, err)
+	checkPaths(db)
+	require.NoError(t, db.View(func(txn *Txn) error {
+		for i := 0; i < 2000; i++ {
+			item, err := txn.Get(key(i))
+			require.NoError(t, err)
+			if i%2 == 0 {
+				require.Equal(t, newVal, getItemValue(t, item))
+			} else {
+				require.Equal(t, val, getItemValue(t, item))
+			}
+		}
+		return nil
+	}))
+	require.NoError(t, db.Close())
+
+	// The tables can't be found if the data paths are reordered.
+	opts.DataPaths = []DataPath{{Path: slow}, {Path: fast}}
+	_, err = Open(opts)
+	require.Error(t, err)
+}
+
+func TestMemTableInsertConcurrency(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	opts.MaxTableSize = 1 << 20
+	opts.MemTableInsertConcurrency = 4
+	db, err := Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+
+	const numWriters, numTxns, txnSize = 8, 50, 100
+	key := func(w, i, j int) []byte { return []byte(fmt.Sprintf("key%02d%03d%03d", w, i, j)) }
+	var wg sync.WaitGroup
+	for w := 0; w < numWriters; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < numTxns; i++ {
+				require.NoError(t, db.Update(func(txn *Txn) error {
+					for j := 0; j < txnSize; j++ {
+						if err := txn.Set(key(w, i, j), key(w, i, j)); err != nil {
+							return err
+						}
+					}
+					return nil
+				}))
+			}
+		}(w)
+	}
+	wg.Wait()
+	require.NoError(t, db.View(func(txn *Txn) error {
+		for w := 0; w < numWriters; w++ {
+			for i := 0; i < numTxns; i++ {
+				for j := 0; j < txnSize; j++ {
+					item, err := txn.Get(key(w, i, j))
+					require.NoError(t, err)
+					require.Equal(t, key(w, i, j), getItemValue(t, item))
+				}
+			}
+		}
+		return nil
+	}))
+}
+
+func BenchmarkMemTableInsertConcurrency(b *testing.B) {
+	const txnSize = 100
+	var keyID uint64
+	concurrencies := []int{1, 4}
+	if n := runtime.GOMAXPROCS(0); n > 4 {
+		concurrencies = append(concurrencies, n)
+	}
+	for _, concurrency := range concurrencies {
+		b.Run(fmt.Sprintf("concurrency=%d", concurrency), func(b *testing.B) {
+			dir, err := ioutil.TempDir("", "badger")
+			y.Check(err)
+			defer os.RemoveAll(dir)
+			opts := DefaultOptions
+			opts.Dir, opts.ValueDir = dir, dir
+			opts.SyncWrites = false
+			opts.MemTableInsertConcurrency = concurrency
+			db, err := Open(opts)
+			y.Check(err)
+			defer db.Close()
+			val := make([]byte, 16)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					y.Check(db.Update(func(txn *Txn) error {
+						for j := 0; j < txnSize; j++ {
+							key := []byte(fmt.Sprintf("key%016d", atomic.AddUint64(&keyID, 1)))
+							if err := txn.Set(key, val); err != nil {
+								return err
+							}
+						}
+						return nil
+					}))
+				}
+			})
+			b.StopTimer()
+		})
+	}
+}
+
+func TestWriteBufferManager(t *testing.T) {
+	wbm := NewWriteBufferManager(1 << 20)
+	dbs := make([]*DB, 2)
+	for i := range dbs {
+		dir, err := ioutil.TempDir("", "badger")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+		opts := getTestOptions(dir)
+		// The memtables are only flushed because of the WriteBufferManager.
+		opts.MaxTableSize = 64 << 20
+		opts.ValueThreshold = 1024
+		opts.WriteBufferManager = wbm
+		dbs[i], err = Open(opts)
+		require.NoError(t, err)
+	}
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key%08d", i)) }
+	for i := 0; i < 20000; i += 100 {
+		for _, db := range dbs {
+			require.NoError(t, db.Update(func(txn *Txn) error {
+				for j := i; j < i+100; j++ {
+					if err := txn.Set(key(j), make([]byte, 100)); err != nil {
+						return err
+					}
+				}
+				return nil
+			}))
+		}
+		require.True(t, wbm.MutableMemoryUsage() <= wbm.BufferSize())
+	}
+	for _, db := range dbs {
+		// The memtables are flushed and maybe compacted into a single table.
+		for start := time.Now(); len(db.Tables()) == 0; time.Sleep(10 * time.Millisecond) {
+			require.True(t, time.Since(start) < 10*time.Second, "the memtable is not flushed")
+		}
+		require.NoError(t, db.View(func(txn *Txn) error {
+			for i := 0; i < 20000; i++ {
+				_, err := txn.Get(key(i))
+				require.NoError(t, err)
+			}
+			return nil
+		}))
+		require.NoError(t, db.Close())
+	}
+	require.Zero(t, wbm.MemoryUsage())
+	require.Zero(t, wbm.MutableMemoryUsage())
+}
+
+func TestWriteBufferManagerIdleDB(t *testing.T) {
+	wbm := NewWriteBufferManager(1 << 20)
+	dbs := make([]*DB, 2)
+	for i := range dbs {
+		dir, err := ioutil.TempDir("", "badger")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+		opts := getTestOptions(dir)
+		opts.MaxTableSize = 64 << 20
+		opts.ValueThreshold = 1024
+		opts.WriteBufferManager = wbm
+		dbs[i], err = Open(opts)
+		require.NoError(t, err)
+		defer dbs[i].Close()
+	}
+	idle, busy := dbs[0], dbs[1]
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key%08d", i)) }
+	write := func(db *DB, i int) {
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			for j := i; j < i+10; j++ {
+				if err := txn.Set(key(j), make([]byte, 100)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+	}
+	// The idle DB takes most of the buffer but doesn't reach the flush limit by itself.
+	var i int
+	for ; wbm.MutableMemoryUsage() < wbm.BufferSize()*3/4; i += 10 {
+		write(idle, i)
+	}
+	require.Len(t, idle.Tables(), 0)
+
+	for i := 0; i < 10000; i += 10 {
+		write(busy, i)
+	}
+	// The idle DB is asked to flush instead of flushing the small memtables of the busy DB.
+	for start := time.Now(); len(idle.Tables()) == 0; time.Sleep(10 * time.Millisecond) {
+		require.True(t, time.Since(start) < 10*time.Second, "the idle DB is not flushed")
+	}
+	require.True(t, wbm.MutableMemoryUsage() <= wbm.BufferSize())
+}
@@ -27,9 +27,9 @@ var (
 	// range.
 	ErrValueLogSize = errors.New("Invalid ValueLogFileSize, must be between 1MB and 2GB")
 
-	// ErrValueThreshold is returned when ValueThreshold is set to a value close to or greater than
-	// uint16.
-	ErrValueThreshold = errors.New("Invalid ValueThreshold, must be lower than uint16.")
+	// ErrValueThreshold is returned when ValueThreshold is set to a value which doesn't fit into a
+	// table.
+	ErrValueThreshold = errors.New("Invalid ValueThreshold, must be lower than MaxTableSize.")
 
 	// ErrKeyNotFound is returned when key isn't found on a txn.Get.
 	ErrKeyNotFound = errors.New("Key not found")
@@ -93,8 +93,25 @@ var (
 	// corrupt data to allow Badger to run properly.
 	ErrTruncateNeeded = errors.New("Value log truncate required to run DB. This might result in data loss.")
 
+	// ErrValueLogCorrupted is returned when the value log has corrupted records that the recovery
+	// mode doesn't allow to drop.
+	ErrValueLogCorrupted = errors.New("Value log is corrupted")
+
 	// ErrTruncateNeeded is returned when UserMate size exceed 255.
 	ErrUserMetaTooLarge = errors.New("UserMate size exceed 255.")
+
+	// ErrSnapshotExists is returned if a snapshot with the same name has been created.
+	ErrSnapshotExists = errors.New("Snapshot already exists")
+
+	// ErrSnapshotNotFound is returned if the snapshot doesn't exist or has been released.
+	ErrSnapshotNotFound = errors.New("Snapshot not found")
+
+	// ErrCompactionBusy is returned by CompactRange and Flatten if the tables in the range are kept
+	// by other compactions for too long.
+	ErrCompactionBusy = errors.New("Timed out waiting for the tables being compacted")
+
+	// ErrCompactionStopped is returned by CompactRange and Flatten if the DB is closed.
+	ErrCompactionStopped = errors.New("Compaction stopped as the DB is closed")
 )
 
 // Key length can't be more than uint16, as determined by table::header.
@@ -118,11 +118,18 @@ func (item *Item) hasValue() bool {
 	return true
 }
 
-// IsDeleted returns true if item contains deleted or expired value.
+// IsDeleted returns true if item contains deleted or expired value. The tombstones are only
+// returned by the iterators with AllVersions set.
 func (item *Item) IsDeleted() bool {
 	return isDeleted(item.meta)
 }
 
+// IsTombstone returns true if item is the tombstone written by a delete, it only checks the delete
+// bit while IsDeleted also covers the expired values.
+func (item *Item) IsTombstone() bool {
+	return item.meta&bitDelete > 0
+}
+
 // EstimatedSize returns approximate size of the key-value pair.
 //
 // This can be called while iterating through a store to quickly estimate the
@@ -158,6 +165,12 @@ type IteratorOptions struct {
 	EndKey         []byte
 	endKeyWithTS   []byte
 
+	// MinVersion and MaxVersion limit the versions to iterate, zero MaxVersion means no limit.
+	// Without AllVersions, a key is returned only if its latest version at MaxVersion is not less
+	// than MinVersion. Tables with no version in the range are skipped.
+	MinVersion uint64
+	MaxVersion uint64
+
 	internalAccess bool // Used to allow internal access to badger keys.
 }
 
@@ -165,6 +178,21 @@ func (opts *IteratorOptions) hasRange() bool {
 	return len(opts.startKeyWithTS) > 0 && len(opts.endKeyWithTS) > 0
 }
 
+func (opts *IteratorOptions) hasVersionRange() bool {
+	return opts.MinVersion > 0 || opts.MaxVersion > 0
+}
+
+func (opts *IteratorOptions) overlapVersions(t *table.Table) bool {
+	if !opts.hasVersionRange() {
+		return true
+	}
+	props := t.Properties()
+	if props.MaxVersion < opts.MinVersion {
+		return false
+	}
+	return opts.MaxVersion == 0 || props.MinVersion <= opts.MaxVersion
+}
+
 func (opts *IteratorOptions) OverlapPending(it *pendingWritesIterator) bool {
 	if it == nil {
 		return false
@@ -201,6 +229,9 @@ func (opts *IteratorOptions) OverlapMemTable(t *table.MemTable) bool {
 }
 
 func (opts *IteratorOptions) OverlapTable(t *table.Table) bool {
+	if !opts.overlapVersions(t) {
+		return false
+	}
 	if !opts.hasRange() {
 		return true
 	}
@@ -227,7 +258,16 @@ func (opts *IteratorOptions) OverlapTables(tables []*table.Table) []*table.Table
 		return nil
 	}
 	if !opts.hasRange() {
-		return tables
+		if !opts.hasVersionRange() {
+			return tables
+		}
+		overlapTables := make([]*table.Table, 0, len(tables))
+		for _, t := range tables {
+			if opts.overlapVersions(t) {
+				overlapTables = append(overlapTables, t)
+			}
+		}
+		return overlapTables
 	}
 	startIdx := sort.Search(len(tables), func(i int) bool {
 		t := tables[i]
@@ -305,6 +345,9 @@ func (txn *Txn) NewIterator(opt IteratorOptions) *Iterator {
 		opt:    opt,
 		readTs: txn.readTs,
 	}
+	if opt.MaxVersion > 0 && opt.MaxVersion < res.readTs {
+		res.readTs = opt.MaxVersion
+	}
 	res.itBuf.db = txn.db
 	res.itBuf.txn = txn
 	res.itBuf.slice = new(y.Slice)
@@ -358,7 +401,7 @@ func (it *Iterator) parseItemForward() {
 			continue
 		}
 		version := y.ParseTs(keyWithTS)
-		if version > it.readTs {
+		if version > it.readTs || version < it.opt.MinVersion {
 			iitr.Next()
 			continue
 		}
@@ -424,9 +467,9 @@ func (it *Iterator) parseItemReverseOnce() bool {
 		return false
 	}
 
-	// Skip any versions which are beyond the readTs.
+	// Skip any versions which are beyond the readTs or below the MinVersion.
 	version := y.ParseTs(key)
-	if version > it.readTs {
+	if version > it.readTs || version < it.opt.MinVersion {
 		mi.Next()
 		return false
 	}
@@ -500,7 +543,7 @@ func (it *Iterator) parseItemReverse() {
 func (it *Iterator) Seek(key []byte) {
 	it.lastKey = it.lastKey[:0]
 	if !it.opt.Reverse {
-		key = y.KeyWithTs(key, it.txn.readTs)
+		key = y.KeyWithTs(key, it.readTs)
 		it.iitr.Seek(key)
 		it.parseItemForward()
 		return
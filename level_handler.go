@@ -27,21 +27,21 @@ import (
 )
 
 type levelHandler struct {
-	// Guards tables, totalSize.
+	// Guards tables, totalSize, maxTotalSize.
 	sync.RWMutex
 
 	// For level >= 1, tables are sorted by key ranges, which do not overlap.
 	// For level 0, tables are sorted by time.
 	// For level 0, newest table are at the back. Compact the oldest one first, which is at the front.
-	tables    []*table.Table
-	totalSize int64
+	tables       []*table.Table
+	totalSize    int64
+	maxTotalSize int64
 
 	// The following are initialized once and const.
-	level        int
-	strLevel     string
-	maxTotalSize int64
-	db           *DB
-	metrics      *y.LevelMetricsSet
+	level    int
+	strLevel string
+	db       *DB
+	metrics  *y.LevelMetricsSet
 }
 
 type RefMap = map[*table.Table]struct{}
@@ -62,6 +62,18 @@ func (s *levelHandler) getTotalSize() int64 {
 	return s.totalSize
 }
 
+func (s *levelHandler) getMaxTotalSize() int64 {
+	s.RLock()
+	defer s.RUnlock()
+	return s.maxTotalSize
+}
+
+func (s *levelHandler) setMaxTotalSize(size int64) {
+	s.Lock()
+	defer s.Unlock()
+	s.maxTotalSize = size
+}
+
 // initTables replaces s.tables with given tables. This is done during loading.
 func (s *levelHandler) initTables(tables []*table.Table) {
 	s.Lock()
@@ -257,6 +269,30 @@ func (s *levelHandler) numTables() int {
 	return len(s.tables)
 }
 
+// hasTombstoneHeavyTable returns true if the tombstone ratio of any table reaches ratio.
+func (s *levelHandler) hasTombstoneHeavyTable(ratio float64) bool {
+	s.RLock()
+	defer s.RUnlock()
+	for _, t := range s.tables {
+		if tombstoneRatio(t) >= ratio {
+			return true
+		}
+	}
+	return false
+}
+
+// hasExpiredTable returns true if any table was created at least periodSecs seconds ago.
+func (s *levelHandler) hasExpiredTable(periodSecs int64) bool {
+	s.RLock()
+	defer s.RUnlock()
+	for _, t := range s.tables {
+		if isTableExpired(t, periodSecs) {
+			return true
+		}
+	}
+	return false
+}
+
 func (s *levelHandler) close() error {
 	s.RLock()
 	defer s.RUnlock()
@@ -453,6 +489,22 @@ func (s *levelHandler) overlappingTables(_ levelHandlerRLocked, kr keyRange) (in
 	return getTablesInRange(s.tables, kr.left, kr.right)
 }
 
+// hasTablesInRange returns true if any table in the level overlaps with kr.
+func (s *levelHandler) hasTablesInRange(kr keyRange) bool {
+	s.RLock()
+	defer s.RUnlock()
+	if s.level == 0 {
+		for _, t := range s.tables {
+			if kr.overlapsWith(keyRange{left: t.Smallest(), right: t.Biggest()}) {
+				return true
+			}
+		}
+		return false
+	}
+	left, right := s.overlappingTables(levelHandlerRLocked{}, kr)
+	return left < right
+}
+
 func getTablesInRange(tbls []*table.Table, start, end []byte) (int, int) {
 	left := sort.Search(len(tbls), func(i int) bool {
 		return y.CompareKeysWithVer(start, tbls[i].Biggest()) <= 0
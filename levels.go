@@ -19,9 +19,12 @@ package badger
 import (
 	"bytes"
 	"fmt"
+	"math"
 	"math/rand"
 	"os"
 	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/coocood/badger/options"
@@ -42,6 +45,13 @@ type levelsController struct {
 	kv     *DB
 
 	cstatus compactStatus
+	picker  compactionPicker
+
+	// pausedCompactors is a counter, the compaction workers don't start new compactions if it is positive.
+	pausedCompactors int32 // Atomic
+
+	// baseLevel is the level that level 0 is compacted into.
+	baseLevel int32 // Atomic
 
 	opt options.TableBuilderOptions
 }
@@ -52,21 +62,21 @@ var (
 )
 
 // revertToManifest checks that all necessary table files exist and removes all table files not
-// referenced by the manifest.  idMap is a set of table file id's that were read from the directory
-// listing.
-func revertToManifest(kv *DB, mf *Manifest, idMap map[uint64]struct{}) error {
+// referenced by the manifest.  idMap maps the table file id's that were read from the directory
+// listings to their data paths.
+func revertToManifest(kv *DB, mf *Manifest, idMap map[uint64]uint32) error {
 	// 1. Check all files in manifest exist.
-	for id := range mf.Tables {
-		if _, ok := idMap[id]; !ok {
-			return fmt.Errorf("file does not exist for table %d", id)
+	for id, tm := range mf.Tables {
+		if pathID, ok := idMap[id]; !ok || pathID != tm.PathID {
+			return fmt.Errorf("file does not exist for table %d in data path %d", id, tm.PathID)
 		}
 	}
 
 	// 2. Delete files that shouldn't exist.
-	for id := range idMap {
+	for id, pathID := range idMap {
 		if _, ok := mf.Tables[id]; !ok {
 			log.Infof("Table file %d not referenced in MANIFEST\n", id)
-			filename := table.NewFilename(id, kv.opt.Dir)
+			filename := table.NewFilename(id, kv.dataPath(pathID))
 			if err := os.Remove(filename); err != nil {
 				return y.Wrapf(err, "While removing table %d", id)
 			}
@@ -79,9 +89,10 @@ func revertToManifest(kv *DB, mf *Manifest, idMap map[uint64]struct{}) error {
 func newLevelsController(kv *DB, mf *Manifest, opt options.TableBuilderOptions) (*levelsController, error) {
 	y.Assert(kv.opt.NumLevelZeroTablesStall > kv.opt.NumLevelZeroTables)
 	s := &levelsController{
-		kv:     kv,
-		levels: make([]*levelHandler, kv.opt.TableBuilderOptions.MaxLevels),
-		opt:    opt,
+		kv:        kv,
+		levels:    make([]*levelHandler, kv.opt.TableBuilderOptions.MaxLevels),
+		opt:       opt,
+		baseLevel: 1,
 	}
 	s.cstatus.levels = make([]*levelCompactStatus, kv.opt.TableBuilderOptions.MaxLevels)
 
@@ -97,9 +108,16 @@ func newLevelsController(kv *DB, mf *Manifest, opt options.TableBuilderOptions)
 		}
 		s.cstatus.levels[i] = new(levelCompactStatus)
 	}
+	s.picker = newCompactionPicker(s)
 
 	// Compare manifest against directory, check for existent/non-existent files, and remove.
-	if err := revertToManifest(kv, mf, getIDMap(kv.opt.Dir)); err != nil {
+	idMap := make(map[uint64]uint32)
+	for i, p := range kv.opt.DataPaths {
+		for id := range getIDMap(p.Path) {
+			idMap[id] = uint32(i)
+		}
+	}
+	if err := revertToManifest(kv, mf, idMap); err != nil {
 		return nil, err
 	}
 
@@ -107,7 +125,7 @@ func newLevelsController(kv *DB, mf *Manifest, opt options.TableBuilderOptions)
 	tables := make([][]*table.Table, kv.opt.TableBuilderOptions.MaxLevels)
 	var maxFileID uint64
 	for fileID, tableManifest := range mf.Tables {
-		fname := table.NewFilename(fileID, kv.opt.Dir)
+		fname := table.NewFilename(fileID, kv.dataPath(tableManifest.PathID))
 		var flags uint32 = y.Sync
 		if kv.opt.ReadOnly {
 			flags |= y.ReadOnly
@@ -118,7 +136,7 @@ func newLevelsController(kv *DB, mf *Manifest, opt options.TableBuilderOptions)
 			return nil, errors.Wrapf(err, "Opening file: %q", fname)
 		}
 
-		t, err := table.OpenTable(fd, kv.opt.TableLoadingMode)
+		t, err := table.OpenTableWithIndexCache(fd, kv.opt.TableLoadingMode, kv.indexCache)
 		if err != nil {
 			closeAllTables(tables)
 			return nil, errors.Wrapf(err, "Opening table: %q", fname)
@@ -135,6 +153,7 @@ func newLevelsController(kv *DB, mf *Manifest, opt options.TableBuilderOptions)
 	for i, tbls := range tables {
 		s.levels[i].initTables(tbls)
 	}
+	s.updateLevelTargets()
 
 	// Make sure key ranges do not overlap etc.
 	if err := s.validate(); err != nil {
@@ -148,6 +167,10 @@ func newLevelsController(kv *DB, mf *Manifest, opt options.TableBuilderOptions)
 		_ = s.close()
 		return nil, err
 	}
+	if err := kv.syncDataPaths(); err != nil {
+		_ = s.close()
+		return nil, err
+	}
 
 	return s, nil
 }
@@ -195,7 +218,10 @@ func (lc *levelsController) runWorker(c *y.Closer) {
 		select {
 		// Can add a done channel or other stuff.
 		case <-ticker.C:
-			prios := lc.pickCompactLevels()
+			if atomic.LoadInt32(&lc.pausedCompactors) > 0 {
+				continue
+			}
+			prios := lc.picker.pickCompactLevels()
 			for _, p := range prios {
 				// TODO: Handle error.
 				didCompact, _ := lc.doCompact(p)
@@ -209,6 +235,14 @@ func (lc *levelsController) runWorker(c *y.Closer) {
 	}
 }
 
+func (lc *levelsController) pauseCompaction() {
+	atomic.AddInt32(&lc.pausedCompactors, 1)
+}
+
+func (lc *levelsController) resumeCompaction() {
+	atomic.AddInt32(&lc.pausedCompactors, -1)
+}
+
 // Returns true if level zero may be compacted, without accounting for compactions that already
 // might be happening.
 func (lc *levelsController) isL0Compactable() bool {
@@ -219,19 +253,91 @@ func (lc *levelsController) isL0Compactable() bool {
 // which are currently being compacted so that we treat them as already having started being
 // compacted (because they have been, yet their size is already counted in getTotalSize).
 func (l *levelHandler) isCompactable(deltaSize int64) bool {
-	return l.getTotalSize() >= l.maxTotalSize+deltaSize
+	l.RLock()
+	defer l.RUnlock()
+	// An empty level skipped by the dynamic level bytes has zero target size.
+	return l.totalSize > 0 && l.totalSize >= l.maxTotalSize+deltaSize
+}
+
+func (lc *levelsController) dynamicLevelBytes() bool {
+	return lc.kv.opt.LevelCompactionDynamicLevelBytes && lc.kv.opt.CompactionStyle == options.LeveledCompaction
+}
+
+func (lc *levelsController) getBaseLevel() int {
+	return int(atomic.LoadInt32(&lc.baseLevel))
+}
+
+// updateLevelTargets recomputes the target sizes of the levels and the base level from the size
+// of the levels when Options.LevelCompactionDynamicLevelBytes is set.
+// Based on: https://github.com/facebook/rocksdb/wiki/Leveled-Compaction#level_compaction_dynamic_level_bytes-is-true
+func (lc *levelsController) updateLevelTargets() {
+	if !lc.dynamicLevelBytes() {
+		return
+	}
+	lastLevel := len(lc.levels) - 1
+	baseSize := lc.kv.opt.LevelOneSize
+	multiplier := int64(lc.kv.opt.TableBuilderOptions.LevelSizeMultiplier)
+
+	// The data in the upper levels may be bigger than the last level, e.g. the option is turned on
+	// for an existing DB, so the biggest level is used as the size of the last level.
+	target := baseSize
+	firstNonEmpty := lastLevel
+	for l := lastLevel; l > 0; l-- {
+		size := lc.levels[l].getTotalSize()
+		if size > 0 {
+			firstNonEmpty = l
+		}
+		if size > target {
+			target = size
+		}
+	}
+
+	targets := make([]int64, len(lc.levels))
+	targets[lastLevel] = target
+	baseLevel := lastLevel
+	for l := lastLevel - 1; l > 0; l-- {
+		// The base level never goes below a non-empty level, otherwise level 0 would be compacted
+		// under the older data.
+		if target <= baseSize && l < firstNonEmpty {
+			break
+		}
+		target /= multiplier
+		targets[l] = target
+		baseLevel = l
+	}
+	for l := 1; l < len(lc.levels); l++ {
+		lc.levels[l].setMaxTotalSize(targets[l])
+	}
+	atomic.StoreInt32(&lc.baseLevel, int32(baseLevel))
 }
 
 type compactionPriority struct {
-	level int
-	score float64
+	level  int
+	score  float64
+	pickBy tablePickStrategy
 }
 
+// tablePickStrategy decides which tables of a level are picked for compaction.
+type tablePickStrategy int
+
+const (
+	// pickBySize picks the biggest table, it is used when the level is over its target size.
+	pickBySize tablePickStrategy = iota
+	// pickByTombstones picks the tables whose tombstone ratio reaches Options.TombstoneCompactionRatio.
+	pickByTombstones
+	// pickByAge picks the tables older than Options.PeriodicCompactionSeconds.
+	pickByAge
+	// pickBottommostByAge picks a table of the next level, which is the last level, older than
+	// Options.PeriodicCompactionSeconds and compacts it in place.
+	pickBottommostByAge
+)
+
 // pickCompactLevel determines which level to compact.
 // Based on: https://github.com/facebook/rocksdb/wiki/Leveled-Compaction
 func (lc *levelsController) pickCompactLevels() (prios []compactionPriority) {
 	// This function must use identical criteria for guaranteeing compaction's progress that
 	// addLevel0Table uses.
+	lc.updateLevelTargets()
 
 	// cstatus is checked to see if level 0's tables are already being compacted
 	if !lc.cstatus.overlapsWith(0, infRange) && lc.isL0Compactable() {
@@ -242,16 +348,21 @@ func (lc *levelsController) pickCompactLevels() (prios []compactionPriority) {
 		prios = append(prios, pri)
 	}
 
-	// now calcalute scores from level 1
-	for levelNum := 1; levelNum < len(lc.levels); levelNum++ {
+	// now calcalute scores from level 1, the last level has no next level to compact into.
+	for levelNum := 1; levelNum < len(lc.levels)-1; levelNum++ {
 		// Don't consider those tables that are already being compacted right now.
 		deltaSize := lc.cstatus.deltaSize(levelNum)
 
 		l := lc.levels[levelNum]
 		if l.isCompactable(deltaSize) {
+			// The levels above the base level have zero target size, move their data down first.
+			target := l.getMaxTotalSize()
+			if target == 0 {
+				target = 1
+			}
 			pri := compactionPriority{
 				level: levelNum,
-				score: float64(l.getTotalSize()-deltaSize) / float64(l.maxTotalSize),
+				score: float64(l.getTotalSize()-deltaSize) / float64(target),
 			}
 			prios = append(prios, pri)
 		}
@@ -259,10 +370,48 @@ func (lc *levelsController) pickCompactLevels() (prios []compactionPriority) {
 	sort.Slice(prios, func(i, j int) bool {
 		return prios[i].score > prios[j].score
 	})
+
+	// The levels with tombstone heavy tables or old tables have lower priority than the levels
+	// over their size.
+	if ratio := lc.kv.opt.TombstoneCompactionRatio; ratio > 0 {
+		for levelNum := 1; levelNum < len(lc.levels)-1; levelNum++ {
+			if lc.levels[levelNum].hasTombstoneHeavyTable(ratio) {
+				prios = append(prios, compactionPriority{level: levelNum, pickBy: pickByTombstones})
+			}
+		}
+	}
+	if lc.kv.opt.PeriodicCompactionSeconds > 0 {
+		lastLevel := len(lc.levels) - 1
+		for levelNum := 0; levelNum < lastLevel; levelNum++ {
+			if lc.levels[levelNum].hasExpiredTable(lc.kv.opt.PeriodicCompactionSeconds) {
+				prios = append(prios, compactionPriority{level: levelNum, pickBy: pickByAge})
+			}
+		}
+		if lc.levels[lastLevel].hasExpiredTable(lc.kv.opt.PeriodicCompactionSeconds) {
+			prios = append(prios, compactionPriority{level: lastLevel - 1, pickBy: pickBottommostByAge})
+		}
+	}
 	return prios
 }
 
+// tombstoneRatio returns the ratio of the deletion tombstones to all the entries of the table.
+func tombstoneRatio(t *table.Table) float64 {
+	props := t.Properties()
+	if props.NumEntries == 0 {
+		return 0
+	}
+	return float64(props.NumDeletes) / float64(props.NumEntries)
+}
+
+// isTableExpired returns true if the table was created at least periodSecs seconds ago.
+func isTableExpired(t *table.Table, periodSecs int64) bool {
+	return time.Now().Unix()-t.Properties().CreatedAt >= periodSecs
+}
+
 func (lc *levelsController) hasOverlapTable(cd compactDef) bool {
+	if cd.nextLevel.level == len(lc.levels)-1 {
+		return false
+	}
 	kr := getKeyRange(cd.top)
 	for i := cd.nextLevel.level + 1; i < len(lc.levels); i++ {
 		lh := lc.levels[i]
@@ -346,9 +495,18 @@ func overSkipTables(key []byte, skippedTables []*table.Table) (newSkippedTables
 	return skippedTables[i:], i > 0
 }
 
+// pinnedReadTss returns the read timestamps in ascending order for which compactions must keep the
+// newest visible version, they are the snapshots older than minReadTs followed by minReadTs.
+func (lc *levelsController) pinnedReadTss(minReadTs uint64) []uint64 {
+	readTss := lc.kv.manifest.snapshotReadTss()
+	i := sort.Search(len(readTss), func(i int) bool { return readTss[i] >= minReadTs })
+	return append(readTss[:i], minReadTs)
+}
+
 // compactBuildTables merge topTables and botTables to form a list of new tables.
+// If start or end is not empty, only the keys in [start, end) are compacted, it is used by sub compactions.
 func (lc *levelsController) compactBuildTables(level int, cd compactDef,
-	limiter *rate.Limiter, splitHints [][]byte) (newTables []*table.Table, err error) {
+	limiter *rate.Limiter, splitHints [][]byte, start, end []byte) (newTables []*table.Table, err error) {
 	topTables := cd.top
 	botTables := cd.bot
 
@@ -364,8 +522,8 @@ func (lc *levelsController) compactBuildTables(level int, cd compactDef,
 	if level == 0 {
 		iters = appendIteratorsReversed(iters, topTables, false)
 	} else {
-		y.Assert(len(topTables) == 1)
-		iters = []y.Iterator{topTables[0].NewIterator(false)}
+		// Manual compactions may pick more than one table, but the key ranges do not overlap.
+		iters = []y.Iterator{table.NewConcatIterator(topTables, false)}
 	}
 
 	// Next level has level>=1 and we can use ConcatIterator as key ranges do not overlap.
@@ -373,28 +531,40 @@ func (lc *levelsController) compactBuildTables(level int, cd compactDef,
 	it := table.NewMergeIterator(iters, false)
 	defer it.Close() // Important to close the iterator to do ref counting.
 
-	it.Rewind()
+	if len(start) > 0 {
+		it.Seek(start)
+	} else {
+		it.Rewind()
+	}
+	inRange := func() bool {
+		return it.Valid() && (len(end) == 0 || y.CompareKeysWithVer(it.Key(), end) < 0)
+	}
 
 	// Pick up the currently pending transactions' min readTs, so we can discard versions below this
 	// readTs. We should never discard any versions starting from above this timestamp, because that
 	// would affect the snapshot view guarantee provided by transactions.
-	minReadTs := lc.kv.orc.readMark.MinReadTS()
+	minReadTs := lc.kv.orc.discardAtOrBelow()
+	pinnedTss := lc.pinnedReadTss(minReadTs)
 
 	var filter CompactionFilter
 	var guards []Guard
 	if lc.kv.opt.CompactionFilterFactory != nil {
-		filter = lc.kv.opt.CompactionFilterFactory(level+1, cd.smallest(), cd.biggest())
+		filter = lc.kv.opt.CompactionFilterFactory(cd.nextLevel.level, cd.smallest(), cd.biggest())
 		guards = filter.Guards()
 	}
 	skippedTbls := cd.skippedTbls
 
+	// The tables of the bottom level are cold.
+	dir := lc.kv.dataPath(lc.kv.pickDataPath(cd.nextLevel.level == len(lc.levels)-1))
+
 	var lastKey, skipKey []byte
+	var lastStripe int
 	var builder *table.Builder
 	var bytesRead, bytesWrite, numRead, numWrite int
-	for it.Valid() {
+	for inRange() {
 		timeStart := time.Now()
 		fileID := lc.reserveFileID()
-		fileName := table.NewFilename(fileID, lc.kv.opt.Dir)
+		fileName := table.NewFilename(fileID, dir)
 		var fd *os.File
 		fd, err = directio.OpenFile(fileName, os.O_CREATE|os.O_RDWR, 0666)
 		if err != nil {
@@ -407,7 +577,7 @@ func (lc *levelsController) compactBuildTables(level int, cd compactDef,
 		}
 		lastKey = lastKey[:0]
 		guard := searchGuard(it.Key(), guards)
-		for ; it.Valid(); it.Next() {
+		for ; inRange(); it.Next() {
 			numRead++
 			vs := it.Value()
 			key := it.Key()
@@ -444,6 +614,7 @@ func (lc *levelsController) compactBuildTables(level int, cd compactDef,
 					break
 				}
 				lastKey = y.SafeCopy(lastKey, key)
+				lastStripe = -1
 			}
 
 			version := y.ParseTs(key)
@@ -451,33 +622,43 @@ func (lc *levelsController) compactBuildTables(level int, cd compactDef,
 			// Only consider the versions which are below the minReadTs, otherwise, we might end up discarding the
 			// only valid version for a running transaction.
 			if version <= minReadTs {
-				// key is the latest readable version of this key, so we simply discard all the rest of the versions.
-				skipKey = y.SafeCopy(skipKey, key)
-
-				if isDeleted(vs.Meta) {
-					// If this key range has overlap with lower levels, then keep the deletion
-					// marker with the latest version, discarding the rest. We have set skipKey,
-					// so the following key versions would be skipped. Otherwise discard the deletion marker.
-					if !hasOverlap {
+				// The versions visible to the same pinned snapshot are in the same stripe, only the newest one is kept.
+				if stripe := sort.Search(len(pinnedTss), func(i int) bool { return pinnedTss[i] >= version }); stripe > 0 {
+					if stripe == lastStripe {
+						discardStats.collect(vs)
 						continue
 					}
-				} else if filter != nil {
-					switch filter.Filter(key, vs.Value, vs.UserMeta) {
-					case DecisionMarkTombstone:
-						discardStats.collect(vs)
-						if hasOverlap {
-							// There may have ole versions for this key, so convert to delete tombstone.
-							builder.Add(key, y.ValueStruct{Meta: bitDelete})
+					lastStripe = stripe
+				} else {
+					// key is the latest readable version of this key, so we simply discard all the rest of the versions.
+					skipKey = y.SafeCopy(skipKey, key)
+
+					if isDeleted(vs.Meta) {
+						// If this key range has overlap with lower levels, then keep the deletion
+						// marker with the latest version, discarding the rest. We have set skipKey,
+						// so the following key versions would be skipped. Otherwise discard the deletion marker.
+						if !hasOverlap {
+							continue
+						}
+					} else if filter != nil {
+						switch filter.Filter(key, vs.Value, vs.UserMeta) {
+						case DecisionMarkTombstone:
+							discardStats.collect(vs)
+							if hasOverlap {
+								// There may have ole versions for this key, so convert to delete tombstone.
+								builder.Add(key, y.ValueStruct{Meta: bitDelete})
+							}
+							continue
+						case DecisionDrop:
+							discardStats.collect(vs)
+							continue
+						case DecisionKeep:
 						}
-						continue
-					case DecisionDrop:
-						discardStats.collect(vs)
-						continue
-					case DecisionKeep:
 					}
 				}
 			}
 			builder.Add(key, vs)
+			builder.AddBlobSize(blobValueSize(vs))
 			numWrite++
 			bytesWrite += kvSize
 		}
@@ -493,7 +674,7 @@ func (lc *levelsController) compactBuildTables(level int, cd compactDef,
 			return
 		}
 		var tbl *table.Table
-		tbl, err = table.OpenTable(fd, lc.kv.opt.TableLoadingMode)
+		tbl, err = table.OpenTableWithIndexCache(fd, lc.kv.opt.TableLoadingMode, lc.kv.indexCache)
 		if err != nil {
 			return
 		}
@@ -516,7 +697,7 @@ func (lc *levelsController) compactBuildTables(level int, cd compactDef,
 	// Ensure created files' directory entries are visible.  We don't mind the extra latency
 	// from not doing this ASAP after all file creation has finished because this is a
 	// background operation.
-	err = syncDir(lc.kv.opt.Dir)
+	err = syncDir(dir)
 	if err != nil {
 		log.Error(err)
 		return
@@ -530,10 +711,10 @@ func (lc *levelsController) compactBuildTables(level int, cd compactDef,
 	return
 }
 
-func buildChangeSet(cd *compactDef, newTables []*table.Table) protos.ManifestChangeSet {
+func (lc *levelsController) buildChangeSet(cd *compactDef, newTables []*table.Table) protos.ManifestChangeSet {
 	changes := []*protos.ManifestChange{}
 	for _, table := range newTables {
-		changes = append(changes, makeTableCreateChange(table.ID(), cd.nextLevel.level))
+		changes = append(changes, makeTableCreateChange(table.ID(), cd.nextLevel.level, lc.kv.dataPathID(table.Filename())))
 	}
 	for _, table := range cd.top {
 		changes = append(changes, makeTableDeleteChange(table.ID()))
@@ -557,6 +738,15 @@ type compactDef struct {
 	nextRange keyRange
 
 	thisSize int64
+
+	// force is set for compactions which are not triggered by the size of the level,
+	// they skip the level size check in compactStatus.
+	force bool
+	// pickBy decides which tables are picked by fillTables.
+	pickBy tablePickStrategy
+	// maxSubCompaction is the max number of sub compactions, it is only set by compactRange so the
+	// automatic compactions are not split.
+	maxSubCompaction int
 }
 
 func (cd *compactDef) lockLevels() {
@@ -583,7 +773,6 @@ func (cd *compactDef) biggest() []byte {
 	return cd.thisRange.right
 }
 
-/*
 type rangeWithSize struct {
 	start []byte
 	end   []byte
@@ -624,7 +813,6 @@ func (cd *compactDef) sizeInRange(tbls []*table.Table, level int, start, end []b
 	}
 	return sz
 }
-*/
 
 func (lc *levelsController) fillTablesL0(cd *compactDef) bool {
 	cd.lockLevels()
@@ -697,11 +885,29 @@ func (lc *levelsController) fillTables(cd *compactDef) bool {
 	tbls := make([]*table.Table, len(cd.thisLevel.tables))
 	copy(tbls, cd.thisLevel.tables)
 
-	// Find the biggest table, and compact that first.
-	// TODO: Try other table picking strategies.
-	sort.Slice(tbls, func(i, j int) bool {
-		return tbls[i].Size() > tbls[j].Size()
-	})
+	switch cd.pickBy {
+	case pickByTombstones:
+		// Only the tombstone heavy tables are picked, the heaviest one first.
+		ratio := lc.kv.opt.TombstoneCompactionRatio
+		heavyTbls := tbls[:0]
+		for _, t := range tbls {
+			if tombstoneRatio(t) >= ratio {
+				heavyTbls = append(heavyTbls, t)
+			}
+		}
+		tbls = heavyTbls
+		sort.Slice(tbls, func(i, j int) bool {
+			return tombstoneRatio(tbls[i]) > tombstoneRatio(tbls[j])
+		})
+	case pickByAge:
+		tbls = expiredTables(tbls, lc.kv.opt.PeriodicCompactionSeconds)
+	default:
+		// Find the biggest table, and compact that first.
+		// TODO: Try other table picking strategies.
+		sort.Slice(tbls, func(i, j int) bool {
+			return tbls[i].Size() > tbls[j].Size()
+		})
+	}
 
 	for _, t := range tbls {
 		cd.thisSize = t.Size()
@@ -741,10 +947,75 @@ func (lc *levelsController) fillTables(cd *compactDef) bool {
 	return false
 }
 
-/*
+// expiredTables returns the tables created at least periodSecs seconds ago, the oldest one first.
+func expiredTables(tbls []*table.Table, periodSecs int64) []*table.Table {
+	expired := make([]*table.Table, 0, len(tbls))
+	for _, t := range tbls {
+		if isTableExpired(t, periodSecs) {
+			expired = append(expired, t)
+		}
+	}
+	sort.Slice(expired, func(i, j int) bool {
+		return expired[i].Properties().CreatedAt < expired[j].Properties().CreatedAt
+	})
+	return expired
+}
+
+// fillBottommostTable picks an expired table of the last level to compact it in place, it is used
+// by periodic compactions so that the compaction filter sees every key eventually. cd.thisLevel
+// is the level above the last level, its range is locked but none of its tables is picked.
+func (lc *levelsController) fillBottommostTable(cd *compactDef) bool {
+	cd.lockLevels()
+	defer cd.unlockLevels()
+
+	for _, t := range expiredTables(cd.nextLevel.tables, lc.kv.opt.PeriodicCompactionSeconds) {
+		cd.thisRange = keyRange{left: t.Smallest(), right: t.Biggest()}
+		cd.nextRange = cd.thisRange
+		cd.thisSize = 0
+		cd.top = nil
+		cd.bot = []*table.Table{t}
+		cd.skippedTbls = nil
+		if lc.cstatus.compareAndAdd(thisAndNextLevelRLocked{}, *cd) {
+			return true
+		}
+	}
+	return false
+}
+
+// fillTablesInRange picks all the tables in this level which overlap with kr for a manual compaction.
+func (lc *levelsController) fillTablesInRange(cd *compactDef, kr keyRange) bool {
+	cd.lockLevels()
+	defer cd.unlockLevels()
+
+	left, right := cd.thisLevel.overlappingTables(levelHandlerRLocked{}, kr)
+	if left >= right {
+		return false
+	}
+	cd.top = make([]*table.Table, right-left)
+	copy(cd.top, cd.thisLevel.tables[left:right])
+	for _, t := range cd.top {
+		cd.thisSize += t.Size()
+	}
+	cd.thisRange = getKeyRange(cd.top)
+	if lc.cstatus.overlapsWith(cd.thisLevel.level, cd.thisRange) {
+		return false
+	}
+
+	left, right = cd.nextLevel.overlappingTables(levelHandlerRLocked{}, cd.thisRange)
+	overlappingTables := cd.nextLevel.tables[left:right]
+	lc.fillBottomTables(cd, overlappingTables)
+	if len(overlappingTables) == 0 {
+		cd.nextRange = cd.thisRange
+	} else {
+		cd.nextRange = getKeyRange(overlappingTables)
+	}
+
+	return lc.cstatus.compareAndAdd(thisAndNextLevelRLocked{}, *cd)
+}
+
 // determineSubCompactPlan returns the number of sub compactors and the estimated size of each compaction job.
-func (lc *levelsController) determineSubCompactPlan(bounds []rangeWithSize) (int, int) {
-	n := lc.kv.opt.MaxSubCompaction
+func (lc *levelsController) determineSubCompactPlan(cd compactDef, bounds []rangeWithSize) (int, int) {
+	n := cd.maxSubCompaction
 	if len(bounds) < n {
 		n = len(bounds)
 	}
@@ -769,12 +1040,13 @@ func (lc *levelsController) runSubCompacts(l int, cd compactDef, limiter *rate.L
 	}
 
 	inputBounds := cd.getInputBounds()
-	numSubCompact, avgSize := lc.determineSubCompactPlan(inputBounds)
+	numSubCompact, avgSize := lc.determineSubCompactPlan(cd, inputBounds)
 	if numSubCompact == 1 {
-		return lc.compactBuildTables(l, cd, limiter, nil, nil)
+		return lc.compactBuildTables(l, cd, limiter, nil, nil, nil)
 	}
 
-	results := make([]jobResult, numSubCompact)
+	// The sizes are rounded down, so there may be one more job than planned.
+	results := make([]jobResult, len(inputBounds))
 	var wg sync.WaitGroup
 	var currSize, begin, jobNo int
 
@@ -785,7 +1057,7 @@ func (lc *levelsController) runSubCompacts(l int, cd compactDef, limiter *rate.L
 
 			wg.Add(1)
 			go func(job int) {
-				newTables, err := lc.compactBuildTables(l, cd, limiter, start, end)
+				newTables, err := lc.compactBuildTables(l, cd, limiter, nil, start, end)
 				results[job].tbls = newTables
 				results[job].err = err
 				wg.Done()
@@ -800,13 +1072,21 @@ func (lc *levelsController) runSubCompacts(l int, cd compactDef, limiter *rate.L
 	log.Infof("Started %d SubCompaction Jobs", jobNo)
 	wg.Wait()
 
+	results = results[:jobNo]
 	var numTables int
+	var err error
 	for _, result := range results {
-		if result.err != nil {
-			return nil, result.err
+		if result.err != nil && err == nil {
+			err = result.err
 		}
 		numTables += len(result.tbls)
 	}
+	if err != nil {
+		for _, result := range results {
+			forceDecrRefs(result.tbls)
+		}
+		return nil, err
+	}
 
 	newTables := make([]*table.Table, 0, numTables)
 	for _, result := range results {
@@ -817,19 +1097,31 @@ func (lc *levelsController) runSubCompacts(l int, cd compactDef, limiter *rate.L
 }
 
 func (lc *levelsController) shouldStartSubCompaction(cd compactDef) bool {
-	if lc.kv.opt.MaxSubCompaction <= 1 || len(cd.bot) == 0 {
+	return cd.maxSubCompaction > 1 && len(cd.bot) != 0
+}
+
+// canMoveDown returns true if the top tables can be moved to the next level without rewriting.
+// Forced compactions into the last level always rewrite the tables, so that the compaction
+// filter and the deleted keys are processed. Tables moving to the last level are rewritten unless
+// they are already on the cold data path.
+func (lc *levelsController) canMoveDown(cd compactDef) bool {
+	if cd.thisLevel.level == 0 || len(cd.bot) != 0 || len(cd.skippedTbls) != 0 {
 		return false
 	}
-	if cd.thisLevel.level == 0 {
+	if cd.nextLevel.level < len(lc.levels)-1 {
 		return true
 	}
-	if cd.thisLevel.level == 1 {
-		// Only speed up large L1 compaction.
-		return len(cd.bot)+len(cd.top) >= 10
+	if cd.force {
+		return false
+	}
+	cold := lc.kv.pickDataPath(true)
+	for _, t := range cd.top {
+		if lc.kv.dataPathID(t.Filename()) != cold {
+			return false
+		}
 	}
-	return false
+	return true
 }
-*/
 
 func (lc *levelsController) runCompactDef(l int, cd compactDef, limiter *rate.Limiter) error {
 	timeStart := time.Now()
@@ -839,20 +1131,25 @@ func (lc *levelsController) runCompactDef(l int, cd compactDef, limiter *rate.Li
 
 	var newTables []*table.Table
 	var changeSet protos.ManifestChangeSet
-	if l > 0 && len(cd.bot) == 0 && len(cd.skippedTbls) == 0 {
+	if lc.canMoveDown(cd) {
 		// skip level 0, since it may has many table overlap with each other
 		newTables = cd.top
-		changeSet = protos.ManifestChangeSet{Changes: []*protos.ManifestChange{
-			makeTableMoveDownChange(newTables[0].ID(), cd.nextLevel.level),
-		}}
+		changeSet = protos.ManifestChangeSet{Changes: make([]*protos.ManifestChange, 0, len(newTables))}
+		for _, t := range newTables {
+			changeSet.Changes = append(changeSet.Changes, makeTableMoveDownChange(t.ID(), cd.nextLevel.level))
+		}
 	} else {
 		var err error
-		newTables, err = lc.compactBuildTables(l, cd, limiter, nil)
+		if lc.shouldStartSubCompaction(cd) {
+			newTables, err = lc.runSubCompacts(l, cd, limiter)
+		} else {
+			newTables, err = lc.compactBuildTables(l, cd, limiter, nil, nil, nil)
+		}
 		defer forceDecrRefs(newTables)
 		if err != nil {
 			return err
 		}
-		changeSet = buildChangeSet(&cd, newTables)
+		changeSet = lc.buildChangeSet(&cd, newTables)
 	}
 
 	// We write to the manifest _before_ we delete files (and after we created files)
@@ -873,7 +1170,7 @@ func (lc *levelsController) runCompactDef(l int, cd compactDef, limiter *rate.Li
 	// However, the tables are added only to the end, so it is ok to just delete the first table.
 
 	log.Infof("LOG Compact %d->%d, del %d tables, add %d tables, took %v\n",
-		l, l+1, len(cd.top)+len(cd.bot), len(newTables), time.Since(timeStart))
+		l, cd.nextLevel.level, len(cd.top)+len(cd.bot), len(newTables), time.Since(timeStart))
 	return nil
 }
 
@@ -882,25 +1179,24 @@ func (lc *levelsController) doCompact(p compactionPriority) (bool, error) {
 	l := p.level
 	y.Assert(l+1 < lc.kv.opt.TableBuilderOptions.MaxLevels) // Sanity check.
 
+	nextLevel := l + 1
+	if l == 0 {
+		nextLevel = lc.getBaseLevel()
+	}
 	cd := compactDef{
 		thisLevel: lc.levels[l],
-		nextLevel: lc.levels[l+1],
+		nextLevel: lc.levels[nextLevel],
+		force:     p.pickBy != pickBySize,
+		pickBy:    p.pickBy,
 	}
 
 	log.Infof("Got compaction priority: %+v", p)
 
 	// While picking tables to be compacted, both levels' tables are expected to
 	// remain unchanged.
-	if l == 0 {
-		if !lc.fillTablesL0(&cd) {
-			log.Infof("fillTables failed for level: %d\n", l)
-			return false, nil
-		}
-	} else {
-		if !lc.fillTables(&cd) {
-			log.Infof("fillTables failed for level: %d\n", l)
-			return false, nil
-		}
+	if !lc.picker.fillTables(&cd) {
+		log.Infof("fillTables failed for level: %d\n", l)
+		return false, nil
 	}
 	defer lc.cstatus.delete(cd) // Remove the ranges from compaction status.
 
@@ -915,13 +1211,107 @@ func (lc *levelsController) doCompact(p compactionPriority) (bool, error) {
 	return true, nil
 }
 
+// compactRangeWaitTimeout is how long compactRange waits for the tables kept by other compactions.
+const compactRangeWaitTimeout = time.Minute
+
+// compactRange compacts all the tables overlapping with [start, end] down to the last level.
+// A nil end means the range is unbounded on the right. onLevelDone is called after the tables of
+// a level are compacted into the next level if it is not nil, the levels without tables in range
+// are skipped. It gives up if the DB is closed, or if the tables in range are kept by other
+// compactions for compactRangeWaitTimeout.
+func (lc *levelsController) compactRange(start, end []byte, maxSubCompaction int, onLevelDone func(level int)) error {
+	if maxSubCompaction <= 0 {
+		maxSubCompaction = lc.kv.opt.MaxSubCompaction
+	}
+	kr := keyRange{left: y.KeyWithTs(start, math.MaxUint64)}
+	if end != nil {
+		kr.right = y.KeyWithTs(end, 0)
+	} else {
+		kr.right = lc.biggestKey()
+		if kr.right == nil {
+			return nil
+		}
+	}
+
+	for l := 0; l < len(lc.levels)-1; l++ {
+		waitStart := time.Now()
+		var compacted bool
+		for lc.levels[l].hasTablesInRange(kr) {
+			select {
+			case <-lc.kv.closers.compactors.HasBeenClosed():
+				return ErrCompactionStopped
+			default:
+			}
+			nextLevel := l + 1
+			if l == 0 {
+				nextLevel = lc.getBaseLevel()
+			}
+			cd := compactDef{
+				thisLevel:        lc.levels[l],
+				nextLevel:        lc.levels[nextLevel],
+				force:            true,
+				maxSubCompaction: maxSubCompaction,
+			}
+			var ok bool
+			if l == 0 {
+				ok = lc.fillTablesL0(&cd)
+			} else {
+				ok = lc.fillTablesInRange(&cd, kr)
+			}
+			if !ok {
+				// The tables are being compacted by the compaction workers, wait for them.
+				if time.Since(waitStart) > compactRangeWaitTimeout {
+					return ErrCompactionBusy
+				}
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+
+			log.Infof("Running manual compaction: %d", l)
+			err := lc.runCompactDef(l, cd, lc.kv.limiter)
+			lc.cstatus.delete(cd)
+			if err != nil {
+				log.Infof("\tLOG Compact FAILED with error: %+v: %+v", err, cd)
+				return err
+			}
+			compacted = true
+			if l == 0 {
+				// All the tables of level 0 are compacted at once, the new ones are left to the next
+				// compaction.
+				break
+			}
+			// fillTablesInRange may pick only some of the tables in range.
+			waitStart = time.Now()
+		}
+		if compacted && onLevelDone != nil {
+			onLevelDone(l)
+		}
+	}
+	return nil
+}
+
+// biggestKey returns the biggest key of all the tables, or nil if there is no table.
+func (lc *levelsController) biggestKey() []byte {
+	var biggest []byte
+	for _, l := range lc.levels {
+		l.RLock()
+		for _, t := range l.tables {
+			if biggest == nil || y.CompareKeysWithVer(t.Biggest(), biggest) > 0 {
+				biggest = t.Biggest()
+			}
+		}
+		l.RUnlock()
+	}
+	return biggest
+}
+
 func (lc *levelsController) addLevel0Table(t *table.Table, head *protos.HeadInfo) error {
 	// We update the manifest _before_ the table becomes part of a levelHandler, because at that
 	// point it could get used in some compaction.  This ensures the manifest file gets updated in
 	// the proper order. (That means this update happens before that of some compaction which
 	// deletes the table.)
 	err := lc.kv.manifest.addChanges([]*protos.ManifestChange{
-		makeTableCreateChange(t.ID(), 0),
+		makeTableCreateChange(t.ID(), 0, lc.kv.dataPathID(t.Filename())),
 	}, head)
 	if err != nil {
 		return err
@@ -946,12 +1336,12 @@ func (lc *levelsController) addLevel0Table(t *table.Table, head *protos.HeadInfo
 			// not having finished -- we wait for them to finish.  Also, it's crucial this behavior
 			// replicates pickCompactLevels' behavior in computing compactability in order to
 			// guarantee progress.
-			if !lc.isL0Compactable() && !lc.levels[1].isCompactable(0) {
+			if lc.picker.canUnstall() {
 				break
 			}
 			time.Sleep(10 * time.Millisecond)
 			if i%100 == 0 {
-				prios := lc.pickCompactLevels()
+				prios := lc.picker.pickCompactLevels()
 				log.Warnf("Waiting to add level 0 table. Compaction priorities: %+v\n", prios)
 				i = 0
 			}
@@ -1020,19 +1410,38 @@ type TableInfo struct {
 	Level int
 	Left  []byte
 	Right []byte
+	Size  int64
+
+	// The following are recorded when the table is built, see table.Properties.
+	NumEntries     uint64
+	NumDeletes     uint64
+	MinVersion     uint64
+	MaxVersion     uint64
+	CreatedAt      time.Time
+	UserProperties map[string][]byte
 }
 
 func (lc *levelsController) getTableInfo() (result []TableInfo) {
 	for _, l := range lc.levels {
+		l.RLock()
 		for _, t := range l.tables {
+			props := t.Properties()
 			info := TableInfo{
-				ID:    t.ID(),
-				Level: l.level,
-				Left:  t.Smallest(),
-				Right: t.Biggest(),
+				ID:             t.ID(),
+				Level:          l.level,
+				Left:           t.Smallest(),
+				Right:          t.Biggest(),
+				Size:           t.Size(),
+				NumEntries:     props.NumEntries,
+				NumDeletes:     props.NumDeletes,
+				MinVersion:     props.MinVersion,
+				MaxVersion:     props.MaxVersion,
+				CreatedAt:      time.Unix(props.CreatedAt, 0),
+				UserProperties: props.UserProperties,
 			}
 			result = append(result, info)
 		}
+		l.RUnlock()
 	}
 	sort.Slice(result, func(i, j int) bool {
 		if result[i].Level != result[j].Level {
@@ -1042,3 +1451,138 @@ func (lc *levelsController) getTableInfo() (result []TableInfo) {
 	})
 	return
 }
+
+// RangeEstimate is the approximate size and number of entries of a key range.
+type RangeEstimate struct {
+	// SSTSize is the size of the data in SST files.
+	SSTSize int64
+	// BlobSize is the size of the values stored in blob files.
+	BlobSize int64
+	// MemTableSize is the size of the keys and values in the memtables which fall in the range.
+	MemTableSize int64
+	// NumEntries is the number of entries in SST files, every version of a key is counted.
+	NumEntries int64
+}
+
+// estimateRange adds the approximate size and number of entries of the tables in [start, end)
+// to est, a nil end means the range is unbounded on the right.
+func (lc *levelsController) estimateRange(start, end []byte, est *RangeEstimate) {
+	for _, l := range lc.levels {
+		l.RLock()
+		tables := l.tables
+		if l.level > 0 {
+			left := sort.Search(len(tables), func(i int) bool {
+				return y.CompareKeysWithVer(start, tables[i].Biggest()) <= 0
+			})
+			tables = tables[left:]
+		}
+		for _, t := range tables {
+			if end != nil && y.CompareKeysWithVer(t.Smallest(), end) >= 0 {
+				if l.level > 0 {
+					break
+				}
+				continue
+			}
+			if y.CompareKeysWithVer(t.Biggest(), start) < 0 {
+				continue
+			}
+			size := t.ApproximateSizeInRange(start, end)
+			est.SSTSize += int64(size)
+			est.NumEntries += int64(t.ApproximateNumEntriesInRange(start, end))
+			if dataSize := t.ApproximateSizeInRange(nil, nil); dataSize > 0 {
+				est.BlobSize += int64(t.Properties().BlobSize * uint64(size) / uint64(dataSize))
+			}
+		}
+		l.RUnlock()
+	}
+}
+
+// KeyRange is a range of keys with version, both Left and Right are nil if it covers all the keys.
+type KeyRange struct {
+	Left  []byte
+	Right []byte
+}
+
+// LevelStat is the statistics of a level.
+type LevelStat struct {
+	Level     int
+	NumTables int
+	Size      int64
+	// TargetSize is the max total size of the level before it needs compaction, it is 0 for level 0.
+	TargetSize int64
+	// Score is the size of the level not being compacted divided by its target size, or the number
+	// of tables divided by NumLevelZeroTables for level 0. The level needs compaction if it's at
+	// least 1. It is 0 for the last level.
+	Score float64
+	// PendingCompactionBytes is the estimated size of the tables need to be compacted.
+	PendingCompactionBytes int64
+
+	// Compacting are the key ranges of the level under compaction, CompactingBytes is the size of
+	// the tables of the level being compacted to the next level.
+	Compacting      []KeyRange
+	CompactingBytes int64
+
+	// CompactionStats is the cumulative stats of the compactions into this level since the DB is
+	// opened, the stats of level 0 are from the memtable flushes.
+	CompactionStats y.CompactionStats
+	// WriteAmp is the bytes written to this level divided by the bytes written to level 0.
+	// The sum of all the levels is the write amplification of the LSM tree.
+	WriteAmp float64
+}
+
+func (lc *levelsController) getLevelStats() []LevelStat {
+	lc.updateLevelTargets()
+	stats := make([]LevelStat, len(lc.levels))
+	for i, l := range lc.levels {
+		l.RLock()
+		stats[i] = LevelStat{
+			Level:           i,
+			NumTables:       len(l.tables),
+			Size:            l.totalSize,
+			TargetSize:      l.maxTotalSize,
+			CompactionStats: l.metrics.TotalCompactionStats(),
+		}
+		l.RUnlock()
+		if i == 0 {
+			if lc.isL0Compactable() {
+				stats[i].PendingCompactionBytes = stats[i].Size
+			}
+		} else if stats[i].Size > stats[i].TargetSize {
+			stats[i].PendingCompactionBytes = stats[i].Size - stats[i].TargetSize
+		}
+	}
+
+	lc.cstatus.RLock()
+	for i, cs := range lc.cstatus.levels {
+		for _, r := range cs.ranges {
+			var kr KeyRange
+			if !r.inf {
+				kr = KeyRange{Left: r.left, Right: r.right}
+			}
+			stats[i].Compacting = append(stats[i].Compacting, kr)
+		}
+		stats[i].CompactingBytes = cs.deltaSize
+	}
+	lc.cstatus.RUnlock()
+
+	// The scores are computed like the leveled picker does, but for every level above the last one.
+	for i := range stats[:len(stats)-1] {
+		stat := &stats[i]
+		if i == 0 {
+			stat.Score = float64(stat.NumTables) / float64(lc.kv.opt.NumLevelZeroTables)
+			continue
+		}
+		// The levels above the base level have zero target size.
+		target := stat.TargetSize
+		if target == 0 {
+			target = 1
+		}
+		stat.Score = float64(stat.Size-stat.CompactingBytes) / float64(target)
+	}
+	if flushed := stats[0].CompactionStats.BytesWrite; flushed > 0 {
+		for i := range stats {
+			stats[i].WriteAmp = float64(stats[i].CompactionStats.BytesWrite) / float64(flushed)
+		}
+	}
+	return stats
+}
@@ -16,6 +16,8 @@
 
 package badger
 
+import "sync/atomic"
+
 // ManagedDB allows end users to manage the transactions themselves. Transaction
 // start and commit timestamps are set by end-user.
 //
@@ -54,11 +56,33 @@ func (db *ManagedDB) NewTransaction(update bool) {
 // This is only useful for databases built on top of Badger (like Dgraph), and
 // can be ignored by most users.
 func (db *ManagedDB) NewTransactionAt(readTs uint64, update bool) *Txn {
-	txn := db.DB.NewTransaction(update)
+	txn := db.DB.newTransaction(update)
+	txn.wmNode = db.orc.readMark.BeginAt(readTs)
 	txn.readTs = readTs
 	return txn
 }
 
+// SetDiscardTs sets the GC safe point. Compactions discard the versions which are older than the
+// newest version at or below ts, unless a transaction or a snapshot with an older readTs is using
+// them. The transactions should not be created at a readTs below ts afterwards. The GC safe point
+// is not persisted, it should be set again after the DB is reopened.
+//
+// This is only useful for databases built on top of Badger (like Dgraph), and
+// can be ignored by most users.
+func (db *ManagedDB) SetDiscardTs(ts uint64) {
+	atomic.StoreUint64(&db.orc.discardTs, ts)
+}
+
+// CreateSnapshotAt follows the same logic as DB.CreateSnapshot(), but pins the
+// provided read timestamp. It returns ErrInvalidRequest if the versions at readTs may have been
+// discarded.
+func (db *ManagedDB) CreateSnapshotAt(name string, readTs uint64) error {
+	if readTs < db.orc.discardAtOrBelow() {
+		return ErrInvalidRequest
+	}
+	return db.DB.createSnapshot(name, readTs)
+}
+
 // CommitAt commits the transaction, following the same logic as Commit(), but
 // at the given commit timestamp. This will panic if not used with ManagedDB.
 //
@@ -25,6 +25,7 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"sync"
 
 	"github.com/coocood/badger/protos"
@@ -50,13 +51,17 @@ type Manifest struct {
 	Deletions int
 
 	Head *protos.HeadInfo
+
+	// Snapshots maps the name of a snapshot to its pinned read timestamp.
+	Snapshots map[string]uint64
 }
 
 func createManifest() Manifest {
 	levels := make([]levelManifest, 0)
 	return Manifest{
-		Levels: levels,
-		Tables: make(map[uint64]tableManifest),
+		Levels:    levels,
+		Tables:    make(map[uint64]tableManifest),
+		Snapshots: make(map[string]uint64),
 	}
 }
 
@@ -70,6 +75,8 @@ type levelManifest struct {
 // in the LSM tree.
 type tableManifest struct {
 	Level uint8
+	// PathID is the index of the data path that holds the table file.
+	PathID uint32
 }
 
 // manifestFile holds the file pointer (and other info) about the manifest file, which is a log
@@ -85,6 +92,9 @@ type manifestFile struct {
 
 	// Used to track the current state of the manifest, used when rewriting.
 	manifest Manifest
+
+	// Serializes the creations and releases of snapshots.
+	snapshotLock sync.Mutex
 }
 
 const (
@@ -100,13 +110,23 @@ const (
 func (m *Manifest) asChanges() []*protos.ManifestChange {
 	changes := make([]*protos.ManifestChange, 0, len(m.Tables))
 	for id, tm := range m.Tables {
-		changes = append(changes, makeTableCreateChange(id, int(tm.Level)))
+		changes = append(changes, makeTableCreateChange(id, int(tm.Level), tm.PathID))
+	}
+	return changes
+}
+
+// asSnapshotChanges returns a sequence of snapshot changes that could be used to recreate the
+// snapshots of the Manifest.
+func (m *Manifest) asSnapshotChanges() []*protos.SnapshotChange {
+	changes := make([]*protos.SnapshotChange, 0, len(m.Snapshots))
+	for name, readTs := range m.Snapshots {
+		changes = append(changes, makeSnapshotCreateChange(name, readTs))
 	}
 	return changes
 }
 
 func (m *Manifest) clone() Manifest {
-	changeSet := protos.ManifestChangeSet{Changes: m.asChanges()}
+	changeSet := protos.ManifestChangeSet{Changes: m.asChanges(), Snapshots: m.asSnapshotChanges()}
 	ret := createManifest()
 	y.Check(applyChangeSet(&ret, &changeSet))
 	return ret
@@ -183,7 +203,55 @@ func (mf *manifestFile) close() error {
 // this depends on the filesystem -- some might append garbage data if a system crash happens at
 // the wrong time.)
 func (mf *manifestFile) addChanges(changesParam []*protos.ManifestChange, head *protos.HeadInfo) error {
-	changes := protos.ManifestChangeSet{Changes: changesParam, Head: head}
+	return mf.addChangeSet(&protos.ManifestChangeSet{Changes: changesParam, Head: head})
+}
+
+// addSnapshotChange writes a snapshot change to the file.
+func (mf *manifestFile) addSnapshotChange(change *protos.SnapshotChange) error {
+	return mf.addChangeSet(&protos.ManifestChangeSet{Snapshots: []*protos.SnapshotChange{change}})
+}
+
+// createSnapshot persists a snapshot pinned at readTs.
+func (mf *manifestFile) createSnapshot(name string, readTs uint64) error {
+	mf.snapshotLock.Lock()
+	defer mf.snapshotLock.Unlock()
+	if _, ok := mf.getSnapshot(name); ok {
+		return ErrSnapshotExists
+	}
+	return mf.addSnapshotChange(makeSnapshotCreateChange(name, readTs))
+}
+
+// releaseSnapshot removes a snapshot from the file.
+func (mf *manifestFile) releaseSnapshot(name string) error {
+	mf.snapshotLock.Lock()
+	defer mf.snapshotLock.Unlock()
+	if _, ok := mf.getSnapshot(name); !ok {
+		return ErrSnapshotNotFound
+	}
+	return mf.addSnapshotChange(makeSnapshotReleaseChange(name))
+}
+
+// getSnapshot returns the read timestamp of the snapshot.
+func (mf *manifestFile) getSnapshot(name string) (readTs uint64, ok bool) {
+	mf.appendLock.Lock()
+	readTs, ok = mf.manifest.Snapshots[name]
+	mf.appendLock.Unlock()
+	return
+}
+
+// snapshotReadTss returns the read timestamps of all the snapshots in ascending order.
+func (mf *manifestFile) snapshotReadTss() []uint64 {
+	mf.appendLock.Lock()
+	readTss := make([]uint64, 0, len(mf.manifest.Snapshots))
+	for _, readTs := range mf.manifest.Snapshots {
+		readTss = append(readTss, readTs)
+	}
+	mf.appendLock.Unlock()
+	sort.Slice(readTss, func(i, j int) bool { return readTss[i] < readTss[j] })
+	return readTss
+}
+
+func (mf *manifestFile) addChangeSet(changes *protos.ManifestChangeSet) error {
 	buf, err := changes.Marshal()
 	if err != nil {
 		return err
@@ -191,7 +259,7 @@ func (mf *manifestFile) addChanges(changesParam []*protos.ManifestChange, head *
 
 	// Maybe we could use O_APPEND instead (on certain file systems)
 	mf.appendLock.Lock()
-	if err := applyChangeSet(&mf.manifest, &changes); err != nil {
+	if err := applyChangeSet(&mf.manifest, changes); err != nil {
 		mf.appendLock.Unlock()
 		return err
 	}
@@ -237,7 +305,7 @@ func helpRewrite(dir string, m *Manifest) (*os.File, int, error) {
 
 	netCreations := len(m.Tables)
 	changes := m.asChanges()
-	set := protos.ManifestChangeSet{Changes: changes, Head: m.Head}
+	set := protos.ManifestChangeSet{Changes: changes, Head: m.Head, Snapshots: m.asSnapshotChanges()}
 
 	changeBuf, err := set.Marshal()
 	if err != nil {
@@ -380,9 +448,10 @@ func ReplayManifestFile(fp *os.File) (ret Manifest, truncOffset int64, err error
 	return build, offset, err
 }
 
-func addNewToManifest(build *Manifest, tc *protos.ManifestChange) {
+func addNewToManifest(build *Manifest, tc *protos.ManifestChange, pathID uint32) {
 	build.Tables[tc.Id] = tableManifest{
-		Level: uint8(tc.Level),
+		Level:  uint8(tc.Level),
+		PathID: pathID,
 	}
 	for len(build.Levels) <= int(tc.Level) {
 		build.Levels = append(build.Levels, levelManifest{make(map[uint64]struct{})})
@@ -397,7 +466,7 @@ func applyManifestChange(build *Manifest, tc *protos.ManifestChange) error {
 		if _, ok := build.Tables[tc.Id]; ok {
 			return fmt.Errorf("MANIFEST invalid, table %d exists", tc.Id)
 		}
-		addNewToManifest(build, tc)
+		addNewToManifest(build, tc, tc.PathID)
 	case protos.ManifestChange_DELETE:
 		tm, ok := build.Tables[tc.Id]
 		if !ok {
@@ -414,7 +483,7 @@ func applyManifestChange(build *Manifest, tc *protos.ManifestChange) error {
 		delete(build.Levels[tm.Level].Tables, tc.Id)
 		delete(build.Tables, tc.Id)
 		build.Deletions++
-		addNewToManifest(build, tc)
+		addNewToManifest(build, tc, tm.PathID)
 	default:
 		return fmt.Errorf("MANIFEST file has invalid manifestChange op")
 	}
@@ -432,14 +501,22 @@ func applyChangeSet(build *Manifest, changeSet *protos.ManifestChangeSet) error
 	if changeSet.Head != nil {
 		build.Head = changeSet.Head
 	}
+	for _, sc := range changeSet.Snapshots {
+		if sc.Released {
+			delete(build.Snapshots, sc.Name)
+		} else {
+			build.Snapshots[sc.Name] = sc.ReadTs
+		}
+	}
 	return nil
 }
 
-func makeTableCreateChange(id uint64, level int) *protos.ManifestChange {
+func makeTableCreateChange(id uint64, level int, pathID uint32) *protos.ManifestChange {
 	return &protos.ManifestChange{
-		Id:    id,
-		Op:    protos.ManifestChange_CREATE,
-		Level: uint32(level),
+		Id:     id,
+		Op:     protos.ManifestChange_CREATE,
+		Level:  uint32(level),
+		PathID: pathID,
 	}
 }
 
@@ -457,3 +534,17 @@ func makeTableMoveDownChange(id uint64, moveToLevel int) *protos.ManifestChange
 		Level: uint32(moveToLevel),
 	}
 }
+
+func makeSnapshotCreateChange(name string, readTs uint64) *protos.SnapshotChange {
+	return &protos.SnapshotChange{
+		Name:   name,
+		ReadTs: readTs,
+	}
+}
+
+func makeSnapshotReleaseChange(name string) *protos.SnapshotChange {
+	return &protos.SnapshotChange{
+		Name:     name,
+		Released: true,
+	}
+}
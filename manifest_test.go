@@ -222,14 +222,14 @@ func TestManifestRewrite(t *testing.T) {
 		LogOffset: 1,
 	}
 	err = mf.addChanges([]*protos.ManifestChange{
-		makeTableCreateChange(0, 0),
+		makeTableCreateChange(0, 0, 0),
 	}, head)
 	require.NoError(t, err)
 	require.NotNil(t, mf.manifest.Head)
 
 	for i := uint64(0); i < uint64(deletionsThreshold*3); i++ {
 		ch := []*protos.ManifestChange{
-			makeTableCreateChange(i+1, 0),
+			makeTableCreateChange(i+1, 0, 0),
 			makeTableDeleteChange(i),
 		}
 		// Only add head for some change set to make sure head is not overwritten to nil.
@@ -23,6 +23,16 @@ import (
 // NOTE: Keep the comments in the following to 75 chars width, so they
 // format nicely in godoc.
 
+// DataPath is a directory to store the SST and blob files in.
+//
+// The L0 and upper level tables, and the blob files written with them, are placed on the first
+// path below its TargetSize, 0 means no limit. The bottom level tables and the blob files written by
+// GC are placed on the last path.
+type DataPath struct {
+	Path       string
+	TargetSize int64
+}
+
 // Options are params for creating DB object.
 //
 // This package provides DefaultOptions which contains options that should
@@ -36,11 +46,15 @@ type Options struct {
 	// Directory to store the value log in. Can be the same as Dir. Should
 	// exist and be writable.
 	ValueDir string
+	// Directories to store the SST and blob files in, ordered from the fastest storage to the
+	// slowest. The index of a path is the ID recorded for its files, so new paths must be added at
+	// the end. It defaults to Dir.
+	DataPaths []DataPath
 
 	// 2. Frequently modified flags
 	// -----------------------------
 	// Sync all writes to disk. Setting this to true would slow down data
-	// loading significantly.
+	// loading significantly. Txn.SetSync overrides it for a transaction.
 	SyncWrites bool
 
 	// How should LSM tree be accessed.
@@ -49,6 +63,15 @@ type Options struct {
 	// How should value log be accessed.
 	ValueLogLoadingMode options.FileLoadingMode
 
+	// The max total size of the index and bloom filter partitions kept in memory for the tables
+	// built with TableBuilderOptions.IndexPartitionSize and opened in FileIO mode. The least
+	// recently used partitions are evicted beyond it. Set 0 for no limit.
+	IndexCacheSize int64
+
+	// Limits the total memory of the memtables, share it to give several DB instances a memory
+	// budget. Set nil for no limit other than MaxTableSize and NumMemtables.
+	WriteBufferManager *WriteBufferManager
+
 	// 3. Flags that user might want to review
 	// ----------------------------------------
 	// The following affect all levels of LSM tree.
@@ -56,8 +79,15 @@ type Options struct {
 	// If value size >= this threshold, only store value offsets in tree.
 	// If set to 0, all values are stored in SST.
 	ValueThreshold int
+	// If true, the values larger than ValueThreshold are appended to blob files when they are
+	// written to the value log instead of when the memtable is flushed, the value log and memtable
+	// only keep the blob pointers.
+	SeparateValuesOnWrite bool
 	// Maximum number of tables to keep in memory, before stalling.
 	NumMemtables int
+	// Number of goroutines inserting the entries of a write batch into the memtable concurrently,
+	// set 1 or 0 to insert them serially.
+	MemTableInsertConcurrency int
 	// The following affect how we handle LSM tree L0.
 	// Maximum number of Level 0 tables before we start compacting.
 	NumLevelZeroTables int
@@ -79,12 +109,41 @@ type Options struct {
 	// Max number of value log files to keep before safely remove.
 	ValueLogMaxNumFiles int
 
+	// Max number of removable value log files to keep for reuse instead of preallocating new
+	// ones, set 0 to disable. The records of the reused files are salted with the file id.
+	ValueLogNumRecycledFiles int
+
 	// Number of compaction workers to run concurrently.
 	NumCompactors int
 
-	// Max number of sub compaction, set 1 or 0 to disable sub compaction.
+	// Max number of sub compaction of CompactRange and Flatten, set 1 or 0 to disable sub compaction.
+	// The automatic compactions are not split.
 	MaxSubCompaction int
 
+	// How should the tables be picked for compaction.
+	CompactionStyle options.CompactionStyle
+
+	// Used by TieredCompaction, a level is merged into the next level only if the size of the
+	// next level is at most TieredSizeRatio times its size, otherwise the next level is pushed
+	// down first. A value not greater than 0 means the default.
+	TieredSizeRatio float64
+
+	// Used by LeveledCompaction, a table is compacted into the next level if the ratio of its
+	// deletion tombstones to all its entries reaches TombstoneCompactionRatio, even if the level
+	// is under its target size. Set 0 to disable it.
+	TombstoneCompactionRatio float64
+
+	// Used by LeveledCompaction, the tables created at least PeriodicCompactionSeconds ago are
+	// compacted into the next level, the ones in the last level are compacted in place. It makes
+	// sure that every key is seen by the CompactionFilter periodically. Set 0 to disable it.
+	PeriodicCompactionSeconds int64
+
+	// Used by LeveledCompaction, if LevelCompactionDynamicLevelBytes is true, the target size of
+	// the last level is its actual size and the target size of each upper level is
+	// LevelSizeMultiplier times smaller. The upper levels whose target size would be under
+	// LevelOneSize are skipped, level 0 is compacted into the first level that is not skipped.
+	LevelCompactionDynamicLevelBytes bool
+
 	// Transaction start and commit timestamps are manaVgedTxns by end-user. This
 	// is a private option used by ManagedDB.
 	managedTxns bool
@@ -105,6 +164,9 @@ type Options struct {
 	// Truncate value log to delete corrupt data, if any. Would not truncate if ReadOnly is set.
 	Truncate bool
 
+	// RecoveryMode decides how the corrupted records are handled when the value log is replayed.
+	RecoveryMode options.RecoveryMode
+
 	TableBuilderOptions options.TableBuilderOptions
 
 	ValueLogWriteOptions options.ValueLogWriterOptions
@@ -112,6 +174,12 @@ type Options struct {
 	CompactionFilterFactory func(targetLevel int, smallest, biggest []byte) CompactionFilter
 }
 
+// CompactRangeOptions are params for DB.CompactRange.
+type CompactRangeOptions struct {
+	// MaxSubCompaction overrides Options.MaxSubCompaction for this compaction if it is greater than 0.
+	MaxSubCompaction int
+}
+
 // CompactionFilter is an interface that user can implement to remove certain keys.
 type CompactionFilter interface {
 	// Filter is the method the compaction process invokes for kv that is being compacted. The returned decision
@@ -156,6 +224,8 @@ var DefaultOptions = Options{
 	MaxTableSize:            64 << 20,
 	NumCompactors:           3,
 	MaxSubCompaction:        3,
+	CompactionStyle:         options.LeveledCompaction,
+	TieredSizeRatio:         2,
 	NumLevelZeroTables:      5,
 	NumLevelZeroTablesStall: 10,
 	NumMemtables:            5,
@@ -187,7 +257,7 @@ var LSMOnlyOptions = Options{}
 func init() {
 	LSMOnlyOptions = DefaultOptions
 
-	LSMOnlyOptions.ValueThreshold = 65500      // Max value length which fits in uint16.
+	LSMOnlyOptions.ValueThreshold = 65500      // Larger values still go to blob files.
 	LSMOnlyOptions.ValueLogFileSize = 64 << 20 // Allow easy space reclamation.
 	LSMOnlyOptions.ValueLogLoadingMode = options.FileIO
 }
@@ -16,6 +16,8 @@
 
 package options
 
+import "time"
+
 // FileLoadingMode specifies how data in LSM table files and value log files should
 // be loaded.
 type FileLoadingMode int
@@ -29,6 +31,34 @@ const (
 	MemoryMap
 )
 
+// CompactionStyle specifies how the LSM tree is compacted.
+type CompactionStyle int
+
+const (
+	// LeveledCompaction keeps the size of each level under a target size which grows exponentially
+	// by the level number.
+	LeveledCompaction CompactionStyle = iota
+	// TieredCompaction (a.k.a. universal compaction) treats each level as a sorted run, and only
+	// merges a sorted run into the next one if they have similar sizes. It has lower write
+	// amplification but higher space amplification than LeveledCompaction.
+	TieredCompaction
+)
+
+// FilterType specifies the filter of the keys in a table.
+type FilterType int
+
+const (
+	// BBloomFilter is a standard bloom filter whose size is rounded up to a power of two.
+	BBloomFilter FilterType = iota
+	// BlockedBloomFilter puts all the probes of a key into a 64 bytes block, so a lookup only
+	// touches one cache line. It takes about 10% more memory than a standard bloom filter of the
+	// same false positive rate.
+	BlockedBloomFilter
+	// RibbonFilter takes about 30% less memory than a standard bloom filter of the same false
+	// positive rate, but it is slower to build and to look up.
+	RibbonFilter
+)
+
 type TableBuilderOptions struct {
 	EnableHashIndex     bool
 	HashUtilRatio       float32
@@ -37,8 +67,65 @@ type TableBuilderOptions struct {
 	MaxLevels           int
 	LevelSizeMultiplier int
 	LogicalBloomFPR     float64
+	FilterType          FilterType
+
+	// IndexPartitionSize is the approximate size in bytes of an index partition and a bloom filter
+	// partition. Only the top-level index of a table with partitions stays in memory, the
+	// partitions are read on demand. The hash index is not built for these tables. Set 0 to
+	// disable partitioning.
+	IndexPartitionSize int
+
+	// TablePropertiesCollectorFactory creates a collector for every table to build if it is not nil.
+	TablePropertiesCollectorFactory func() TablePropertiesCollector
 }
 
+// TablePropertiesCollector collects user-defined properties of a table while it is being built.
+type TablePropertiesCollector interface {
+	// Add is called for every entry added to the table in order. The key has the version suffix
+	// unless the table is built by an external table builder, the value is the one stored in the
+	// table, it is a pointer for the values stored in blob files.
+	Add(key, value, userMeta []byte, deleted bool)
+	// Finish returns the properties to store in the table. The names with prefix "badger." are
+	// reserved.
+	Finish() map[string][]byte
+}
+
+// CompressionType specifies how the value log records are compressed.
+type CompressionType int
+
+const (
+	// NoCompression writes the value log records uncompressed.
+	NoCompression CompressionType = iota
+	// Snappy compresses the records of a write request into one record with Snappy.
+	Snappy
+)
+
+// RecoveryMode specifies how the value log is replayed when it has corrupted records.
+type RecoveryMode int
+
+const (
+	// TolerateCorruptedTail drops the corrupted records at the end of the last value log file,
+	// which are left by a torn write, and fails on corruption anywhere else.
+	TolerateCorruptedTail RecoveryMode = iota
+	// AbsoluteConsistency fails on any corrupted record, including a torn write. A txn missing its
+	// end at the end of the last file is not a corruption, it's dropped.
+	AbsoluteConsistency
+	// SkipCorruptedRecords skips the corrupted records and the transactions they break, and
+	// replays the valid records after them.
+	SkipCorruptedRecords
+)
+
 type ValueLogWriterOptions struct {
 	WriteBufferSize int
+	// Compression is the compression of the value log records, the records written with any
+	// compression type can be replayed.
+	Compression CompressionType
+
+	// GroupCommitDelay is the max time to wait for more requests to join a write batch after the
+	// first one arrives, so they share the value log write and sync. 0 disables the wait.
+	GroupCommitDelay time.Duration
+	// GroupCommitMaxBytes and GroupCommitMaxEntries limit the size of a write batch, the batch is
+	// written as soon as it reaches either of them. 0 means no limit.
+	GroupCommitMaxBytes   int
+	GroupCommitMaxEntries int
 }
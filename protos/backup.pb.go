@@ -13,6 +13,7 @@
 		ManifestChangeSet
 		HeadInfo
 		ManifestChange
+		SnapshotChange
 */
 package protos
 
@@ -42,8 +42,9 @@ func (ManifestChange_Operation) EnumDescriptor() ([]byte, []int) {
 
 type ManifestChangeSet struct {
 	// A set of changes that are applied atomically.
-	Changes []*ManifestChange `protobuf:"bytes,1,rep,name=changes" json:"changes,omitempty"`
-	Head    *HeadInfo         `protobuf:"bytes,2,opt,name=head" json:"head,omitempty"`
+	Changes   []*ManifestChange `protobuf:"bytes,1,rep,name=changes" json:"changes,omitempty"`
+	Head      *HeadInfo         `protobuf:"bytes,2,opt,name=head" json:"head,omitempty"`
+	Snapshots []*SnapshotChange `protobuf:"bytes,3,rep,name=snapshots" json:"snapshots,omitempty"`
 }
 
 func (m *ManifestChangeSet) Reset()                    { *m = ManifestChangeSet{} }
@@ -65,6 +66,13 @@ func (m *ManifestChangeSet) GetHead() *HeadInfo {
 	return nil
 }
 
+func (m *ManifestChangeSet) GetSnapshots() []*SnapshotChange {
+	if m != nil {
+		return m.Snapshots
+	}
+	return nil
+}
+
 type HeadInfo struct {
 	Version   uint64 `protobuf:"varint,1,opt,name=version,proto3" json:"version,omitempty"`
 	LogID     uint32 `protobuf:"varint,2,opt,name=logID,proto3" json:"logID,omitempty"`
@@ -98,9 +106,10 @@ func (m *HeadInfo) GetLogOffset() uint32 {
 }
 
 type ManifestChange struct {
-	Id    uint64                   `protobuf:"varint,1,opt,name=Id,proto3" json:"Id,omitempty"`
-	Op    ManifestChange_Operation `protobuf:"varint,2,opt,name=Op,proto3,enum=protos.ManifestChange_Operation" json:"Op,omitempty"`
-	Level uint32                   `protobuf:"varint,3,opt,name=Level,proto3" json:"Level,omitempty"`
+	Id     uint64                   `protobuf:"varint,1,opt,name=Id,proto3" json:"Id,omitempty"`
+	Op     ManifestChange_Operation `protobuf:"varint,2,opt,name=Op,proto3,enum=protos.ManifestChange_Operation" json:"Op,omitempty"`
+	Level  uint32                   `protobuf:"varint,3,opt,name=Level,proto3" json:"Level,omitempty"`
+	PathID uint32                   `protobuf:"varint,4,opt,name=PathID,proto3" json:"PathID,omitempty"`
 }
 
 func (m *ManifestChange) Reset()                    { *m = ManifestChange{} }
@@ -129,10 +138,50 @@ func (m *ManifestChange) GetLevel() uint32 {
 	return 0
 }
 
+func (m *ManifestChange) GetPathID() uint32 {
+	if m != nil {
+		return m.PathID
+	}
+	return 0
+}
+
+type SnapshotChange struct {
+	Name     string `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	ReadTs   uint64 `protobuf:"varint,2,opt,name=readTs,proto3" json:"readTs,omitempty"`
+	Released bool   `protobuf:"varint,3,opt,name=released,proto3" json:"released,omitempty"`
+}
+
+func (m *SnapshotChange) Reset()                    { *m = SnapshotChange{} }
+func (m *SnapshotChange) String() string            { return proto.CompactTextString(m) }
+func (*SnapshotChange) ProtoMessage()               {}
+func (*SnapshotChange) Descriptor() ([]byte, []int) { return fileDescriptorManifest, []int{3} }
+
+func (m *SnapshotChange) GetName() string {
+	if m != nil {
+		return m.Name
+	}
+	return ""
+}
+
+func (m *SnapshotChange) GetReadTs() uint64 {
+	if m != nil {
+		return m.ReadTs
+	}
+	return 0
+}
+
+func (m *SnapshotChange) GetReleased() bool {
+	if m != nil {
+		return m.Released
+	}
+	return false
+}
+
 func init() {
 	proto.RegisterType((*ManifestChangeSet)(nil), "protos.ManifestChangeSet")
 	proto.RegisterType((*HeadInfo)(nil), "protos.HeadInfo")
 	proto.RegisterType((*ManifestChange)(nil), "protos.ManifestChange")
+	proto.RegisterType((*SnapshotChange)(nil), "protos.SnapshotChange")
 	proto.RegisterEnum("protos.ManifestChange_Operation", ManifestChange_Operation_name, ManifestChange_Operation_value)
 }
 func (m *ManifestChangeSet) Marshal() (dAtA []byte, err error) {
@@ -172,6 +221,18 @@ func (m *ManifestChangeSet) MarshalTo(dAtA []byte) (int, error) {
 		}
 		i += n1
 	}
+	if len(m.Snapshots) > 0 {
+		for _, msg := range m.Snapshots {
+			dAtA[i] = 0x1a
+			i++
+			i = encodeVarintManifest(dAtA, i, uint64(msg.Size()))
+			n, err := msg.MarshalTo(dAtA[i:])
+			if err != nil {
+				return 0, err
+			}
+			i += n
+		}
+	}
 	return i, nil
 }
 
@@ -238,6 +299,50 @@ func (m *ManifestChange) MarshalTo(dAtA []byte) (int, error) {
 		i++
 		i = encodeVarintManifest(dAtA, i, uint64(m.Level))
 	}
+	if m.PathID != 0 {
+		dAtA[i] = 0x20
+		i++
+		i = encodeVarintManifest(dAtA, i, uint64(m.PathID))
+	}
+	return i, nil
+}
+
+func (m *SnapshotChange) Marshal() (dAtA []byte, err error) {
+	size := m.Size()
+	dAtA = make([]byte, size)
+	n, err := m.MarshalTo(dAtA)
+	if err != nil {
+		return nil, err
+	}
+	return dAtA[:n], nil
+}
+
+func (m *SnapshotChange) MarshalTo(dAtA []byte) (int, error) {
+	var i int
+	_ = i
+	var l int
+	_ = l
+	if len(m.Name) > 0 {
+		dAtA[i] = 0xa
+		i++
+		i = encodeVarintManifest(dAtA, i, uint64(len(m.Name)))
+		i += copy(dAtA[i:], m.Name)
+	}
+	if m.ReadTs != 0 {
+		dAtA[i] = 0x10
+		i++
+		i = encodeVarintManifest(dAtA, i, uint64(m.ReadTs))
+	}
+	if m.Released {
+		dAtA[i] = 0x18
+		i++
+		if m.Released {
+			dAtA[i] = 1
+		} else {
+			dAtA[i] = 0
+		}
+		i++
+	}
 	return i, nil
 }
 
@@ -263,6 +368,12 @@ func (m *ManifestChangeSet) Size() (n int) {
 		l = m.Head.Size()
 		n += 1 + l + sovManifest(uint64(l))
 	}
+	if len(m.Snapshots) > 0 {
+		for _, e := range m.Snapshots {
+			l = e.Size()
+			n += 1 + l + sovManifest(uint64(l))
+		}
+	}
 	return n
 }
 
@@ -293,6 +404,25 @@ func (m *ManifestChange) Size() (n int) {
 	if m.Level != 0 {
 		n += 1 + sovManifest(uint64(m.Level))
 	}
+	if m.PathID != 0 {
+		n += 1 + sovManifest(uint64(m.PathID))
+	}
+	return n
+}
+
+func (m *SnapshotChange) Size() (n int) {
+	var l int
+	_ = l
+	l = len(m.Name)
+	if l > 0 {
+		n += 1 + l + sovManifest(uint64(l))
+	}
+	if m.ReadTs != 0 {
+		n += 1 + sovManifest(uint64(m.ReadTs))
+	}
+	if m.Released {
+		n += 2
+	}
 	return n
 }
 
@@ -402,6 +532,37 @@ func (m *ManifestChangeSet) Unmarshal(dAtA []byte) error {
 				return err
 			}
 			iNdEx = postIndex
+		case 3:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Snapshots", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowManifest
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthManifest
+			}
+			postIndex := iNdEx + msglen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Snapshots = append(m.Snapshots, &SnapshotChange{})
+			if err := m.Snapshots[len(m.Snapshots)-1].Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
 		default:
 			iNdEx = preIndex
 			skippy, err := skipManifest(dAtA[iNdEx:])
@@ -616,6 +777,143 @@ func (m *ManifestChange) Unmarshal(dAtA []byte) error {
 					break
 				}
 			}
+		case 4:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field PathID", wireType)
+			}
+			m.PathID = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowManifest
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.PathID |= (uint32(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		default:
+			iNdEx = preIndex
+			skippy, err := skipManifest(dAtA[iNdEx:])
+			if err != nil {
+				return err
+			}
+			if skippy < 0 {
+				return ErrInvalidLengthManifest
+			}
+			if (iNdEx + skippy) > l {
+				return io.ErrUnexpectedEOF
+			}
+			iNdEx += skippy
+		}
+	}
+
+	if iNdEx > l {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+func (m *SnapshotChange) Unmarshal(dAtA []byte) error {
+	l := len(dAtA)
+	iNdEx := 0
+	for iNdEx < l {
+		preIndex := iNdEx
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if shift >= 64 {
+				return ErrIntOverflowManifest
+			}
+			if iNdEx >= l {
+				return io.ErrUnexpectedEOF
+			}
+			b := dAtA[iNdEx]
+			iNdEx++
+			wire |= (uint64(b) & 0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		fieldNum := int32(wire >> 3)
+		wireType := int(wire & 0x7)
+		if wireType == 4 {
+			return fmt.Errorf("proto: SnapshotChange: wiretype end group for non-group")
+		}
+		if fieldNum <= 0 {
+			return fmt.Errorf("proto: SnapshotChange: illegal tag %d (wire type %d)", fieldNum, wire)
+		}
+		switch fieldNum {
+		case 1:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Name", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowManifest
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthManifest
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Name = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
+		case 2:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field ReadTs", wireType)
+			}
+			m.ReadTs = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowManifest
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.ReadTs |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 3:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Released", wireType)
+			}
+			var v int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowManifest
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				v |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.Released = bool(v != 0)
 		default:
 			iNdEx = preIndex
 			skippy, err := skipManifest(dAtA[iNdEx:])
@@ -745,24 +1043,29 @@ var (
 func init() { proto.RegisterFile("manifest.proto", fileDescriptorManifest) }
 
 var fileDescriptorManifest = []byte{
-	// 297 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xe2, 0xe2, 0xcb, 0x4d, 0xcc, 0xcb,
-	0x4c, 0x4b, 0x2d, 0x2e, 0xd1, 0x2b, 0x28, 0xca, 0x2f, 0xc9, 0x17, 0x62, 0x03, 0x53, 0xc5, 0x4a,
-	0xd9, 0x5c, 0x82, 0xbe, 0x50, 0x19, 0xe7, 0x8c, 0xc4, 0xbc, 0xf4, 0xd4, 0xe0, 0xd4, 0x12, 0x21,
-	0x03, 0x2e, 0xf6, 0x64, 0x30, 0xa7, 0x58, 0x82, 0x51, 0x81, 0x59, 0x83, 0xdb, 0x48, 0x0c, 0xa2,
-	0xab, 0x58, 0x0f, 0x55, 0x6d, 0x10, 0x4c, 0x99, 0x90, 0x0a, 0x17, 0x4b, 0x46, 0x6a, 0x62, 0x8a,
-	0x04, 0x93, 0x02, 0xa3, 0x06, 0xb7, 0x91, 0x00, 0x4c, 0xb9, 0x47, 0x6a, 0x62, 0x8a, 0x67, 0x5e,
-	0x5a, 0x7e, 0x10, 0x58, 0x56, 0x29, 0x82, 0x8b, 0x03, 0x26, 0x22, 0x24, 0xc1, 0xc5, 0x5e, 0x96,
-	0x5a, 0x54, 0x9c, 0x99, 0x9f, 0x27, 0xc1, 0xa8, 0xc0, 0xa8, 0xc1, 0x12, 0x04, 0xe3, 0x0a, 0x89,
-	0x70, 0xb1, 0xe6, 0xe4, 0xa7, 0x7b, 0xba, 0x80, 0x0d, 0xe3, 0x0d, 0x82, 0x70, 0x84, 0x64, 0xb8,
-	0x38, 0x73, 0xf2, 0xd3, 0xfd, 0xd3, 0xd2, 0x8a, 0x53, 0x4b, 0x24, 0x98, 0xc1, 0x32, 0x08, 0x01,
-	0xa5, 0x39, 0x8c, 0x5c, 0x7c, 0xa8, 0x6e, 0x13, 0xe2, 0xe3, 0x62, 0xf2, 0x4c, 0x81, 0x9a, 0xcd,
-	0xe4, 0x99, 0x22, 0x64, 0xc0, 0xc5, 0xe4, 0x5f, 0x00, 0x36, 0x93, 0xcf, 0x48, 0x01, 0xbb, 0x7f,
-	0xf4, 0xfc, 0x0b, 0x52, 0x8b, 0x12, 0x4b, 0x32, 0xf3, 0xf3, 0x82, 0x98, 0xfc, 0x0b, 0x40, 0x0e,
-	0xf1, 0x49, 0x2d, 0x4b, 0xcd, 0x81, 0x5a, 0x07, 0xe1, 0x28, 0x19, 0x71, 0x71, 0xc2, 0x95, 0x09,
-	0x71, 0x71, 0xb1, 0x39, 0x07, 0xb9, 0x3a, 0x86, 0xb8, 0x0a, 0x30, 0x80, 0xd8, 0x2e, 0xae, 0x3e,
-	0xae, 0x21, 0xae, 0x02, 0x8c, 0x42, 0xbc, 0x5c, 0x9c, 0xbe, 0xfe, 0x61, 0xae, 0xf1, 0x2e, 0xfe,
-	0xe1, 0x7e, 0x02, 0x4c, 0x4e, 0x02, 0x27, 0x1e, 0xc9, 0x31, 0x5e, 0x78, 0x24, 0xc7, 0xf8, 0xe0,
-	0x91, 0x1c, 0xe3, 0x8c, 0xc7, 0x72, 0x0c, 0x49, 0x90, 0xf0, 0x37, 0x06, 0x04, 0x00, 0x00, 0xff,
-	0xff, 0x3a, 0x13, 0x93, 0x83, 0x98, 0x01, 0x00, 0x00,
+	// 371 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x6c, 0x52, 0xd1, 0x6a, 0xa3, 0x40,
+	0x14, 0xcd, 0x18, 0x37, 0x89, 0x37, 0x44, 0xdc, 0x61, 0x09, 0xb2, 0x2c, 0x22, 0xb2, 0x0f, 0x79,
+	0x0a, 0xc1, 0xdd, 0x1f, 0xd8, 0x8d, 0x42, 0x85, 0xa4, 0x96, 0x49, 0x68, 0xf3, 0x56, 0xa6, 0x75,
+	0x8c, 0x01, 0xe3, 0x88, 0x23, 0xf9, 0x96, 0xbe, 0xf6, 0x1f, 0xfa, 0x11, 0x7d, 0xec, 0x27, 0x94,
+	0xf4, 0x47, 0x4a, 0x46, 0x4d, 0x10, 0xfa, 0xe4, 0x3d, 0xf7, 0x9c, 0x7b, 0xee, 0xf1, 0x32, 0xa0,
+	0xef, 0x69, 0xb6, 0x8b, 0x99, 0x28, 0xa7, 0x79, 0xc1, 0x4b, 0x8e, 0x7b, 0xf2, 0x23, 0x9c, 0x67,
+	0x04, 0xdf, 0x97, 0x35, 0x35, 0x4f, 0x68, 0xb6, 0x65, 0x2b, 0x56, 0xe2, 0x19, 0xf4, 0x1f, 0x25,
+	0x10, 0x26, 0xb2, 0xbb, 0x93, 0xa1, 0x3b, 0xae, 0xc6, 0xc4, 0xb4, 0xad, 0x25, 0x8d, 0x0c, 0xff,
+	0x06, 0x35, 0x61, 0x34, 0x32, 0x15, 0x1b, 0x4d, 0x86, 0xae, 0xd1, 0xc8, 0xaf, 0x18, 0x8d, 0x82,
+	0x2c, 0xe6, 0x44, 0xb2, 0xf8, 0x2f, 0x68, 0x22, 0xa3, 0xb9, 0x48, 0x78, 0x29, 0xcc, 0x6e, 0xdb,
+	0x79, 0x55, 0x13, 0xb5, 0xf3, 0x45, 0xe8, 0x6c, 0x60, 0xd0, 0xf8, 0x60, 0x13, 0xfa, 0x07, 0x56,
+	0x88, 0x1d, 0xcf, 0x4c, 0x64, 0xa3, 0x89, 0x4a, 0x1a, 0x88, 0x7f, 0xc0, 0xb7, 0x94, 0x6f, 0x03,
+	0x4f, 0x46, 0x18, 0x91, 0x0a, 0xe0, 0x5f, 0xa0, 0xa5, 0x7c, 0x1b, 0xc6, 0xb1, 0x60, 0xa5, 0xd9,
+	0x95, 0xcc, 0xa5, 0xe1, 0xbc, 0x20, 0xd0, 0xdb, 0x7f, 0x84, 0x75, 0x50, 0x82, 0xa8, 0xf6, 0x56,
+	0x82, 0x08, 0xcf, 0x40, 0x09, 0x73, 0xe9, 0xa9, 0xbb, 0xf6, 0xd7, 0x57, 0x98, 0x86, 0x39, 0x2b,
+	0x68, 0xb9, 0xe3, 0x19, 0x51, 0xc2, 0xfc, 0x14, 0x64, 0xc1, 0x0e, 0x2c, 0xad, 0xd7, 0x55, 0x00,
+	0x8f, 0xa1, 0x77, 0x43, 0xcb, 0x24, 0xf0, 0x4c, 0x55, 0xb6, 0x6b, 0xe4, 0xb8, 0xa0, 0x9d, 0xc7,
+	0x31, 0x40, 0x6f, 0x4e, 0xfc, 0x7f, 0x6b, 0xdf, 0xe8, 0x9c, 0x6a, 0xcf, 0x5f, 0xf8, 0x6b, 0xdf,
+	0x40, 0x78, 0x04, 0xda, 0x32, 0xbc, 0xf5, 0xef, 0xbd, 0xf0, 0xee, 0xda, 0x50, 0x9c, 0x0d, 0xe8,
+	0xed, 0x6b, 0x61, 0x0c, 0x6a, 0x46, 0xf7, 0x4c, 0xe6, 0xd6, 0x88, 0xac, 0x4f, 0x1b, 0x0b, 0x46,
+	0xa3, 0xb5, 0x90, 0xe9, 0x55, 0x52, 0x23, 0xfc, 0x13, 0x06, 0x05, 0x4b, 0x19, 0x15, 0x2c, 0x92,
+	0x11, 0x07, 0xe4, 0x8c, 0xff, 0x1b, 0xaf, 0x47, 0x0b, 0xbd, 0x1d, 0x2d, 0xf4, 0x7e, 0xb4, 0xd0,
+	0xd3, 0x87, 0xd5, 0x79, 0xa8, 0x1e, 0xca, 0x9f, 0xcf, 0x01, 0x00, 0x82, 0x0d, 0x89, 0x0b, 0x41,
+	0x02, 0x00, 0x00,
 }
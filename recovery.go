@@ -0,0 +1,195 @@
+/*
+ * Copyright 2026 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"math"
+
+	"github.com/coocood/badger/options"
+	"github.com/coocood/badger/y"
+	"github.com/pingcap/errors"
+)
+
+// CorruptedRange is a range of a value log file that was skipped while replaying the value log.
+type CorruptedRange struct {
+	Fid    uint32
+	Offset uint32
+	Len    uint32
+}
+
+// RecoveryReport describes the corrupted records handled while replaying the value log on Open.
+type RecoveryReport struct {
+	// SkippedRanges are the corrupted ranges skipped in the SkipCorruptedRecords mode.
+	SkippedRanges []CorruptedRange
+	// LostTxns are the commit timestamps of the transactions dropped because of the corruption.
+	// The transactions entirely inside a corrupted range can't be listed.
+	LostTxns []uint64
+	// TruncatedBytes is the number of bytes dropped from the tail of the value log, they are
+	// truncated if Truncate is set, otherwise overwritten by the new writes.
+	TruncatedBytes int64
+}
+
+func (r *RecoveryReport) empty() bool {
+	return len(r.SkippedRanges) == 0 && len(r.LostTxns) == 0 && r.TruncatedBytes == 0
+}
+
+// logRecovery handles the corrupted records of a log file being replayed according to the
+// recovery mode.
+type logRecovery struct {
+	mode     options.RecoveryMode
+	truncate bool
+	isLast   bool
+	report   *RecoveryReport
+}
+
+func (rec *logRecovery) lostTxn(ts uint64) {
+	for _, lost := range rec.report.LostTxns {
+		if lost == ts {
+			return
+		}
+	}
+	rec.report.LostTxns = append(rec.report.LostTxns, ts)
+}
+
+// skip returns the offset of the first valid record after the corrupted record at offset, or false
+// if the corruption is at the tail of the file.
+func (rec *logRecovery) skip(vlog *valueLog, lf *logFile, offset uint32, salted bool) (uint32, bool, error) {
+	if rec.mode == options.AbsoluteConsistency {
+		return 0, false, errors.Wrapf(ErrValueLogCorrupted, "%q at offset %d", lf.path, offset)
+	}
+	// A corrupted record in the middle is followed by a valid one within the max record size, the
+	// records after a longer corrupted range are only searched for in the SkipCorruptedRecords mode.
+	limit := int64(math.MaxInt64)
+	if rec.mode != options.SkipCorruptedRecords {
+		limit = int64(offset) + vlog.maxRecordSize()
+	}
+	next, ok, err := vlog.findNextRecord(lf, offset+1, limit, salted)
+	if err != nil || !ok {
+		return 0, false, err
+	}
+	if rec.mode != options.SkipCorruptedRecords {
+		return 0, false, errors.Wrapf(ErrValueLogCorrupted,
+			"%q at offset %d, valid records follow at offset %d", lf.path, offset, next)
+	}
+	rec.report.SkippedRanges = append(rec.report.SkippedRanges,
+		CorruptedRange{Fid: lf.fid, Offset: offset, Len: next - offset})
+	return next, true, nil
+}
+
+// dropTail drops the records from validEnd to end, which are the corrupted tail of the file. torn
+// is set if the records are intact but the last txn misses its end, which is not a corruption.
+// The tail of the last file is truncated if Truncate is set, otherwise it's overwritten by the new
+// writes.
+func (rec *logRecovery) dropTail(lf *logFile, validEnd, end uint32, torn bool) error {
+	if end <= validEnd {
+		return nil
+	}
+	if rec.mode == options.AbsoluteConsistency && !(torn && rec.isLast) {
+		return errors.Wrapf(ErrValueLogCorrupted, "%q has a torn write at offset %d", lf.path, validEnd)
+	}
+	if !rec.isLast {
+		if rec.mode != options.SkipCorruptedRecords {
+			return errors.Wrapf(ErrValueLogCorrupted,
+				"%q is not the last value log file but has a corrupted tail at offset %d", lf.path, validEnd)
+		}
+		rec.report.SkippedRanges = append(rec.report.SkippedRanges,
+			CorruptedRange{Fid: lf.fid, Offset: validEnd, Len: end - validEnd})
+		return nil
+	}
+	rec.report.TruncatedBytes += int64(end - validEnd)
+	if !rec.truncate {
+		return nil
+	}
+	if err := lf.fd.Truncate(int64(validEnd)); err != nil {
+		return errors.Wrapf(err, "Unable to truncate value log file %q", lf.path)
+	}
+	return nil
+}
+
+// metaRecordMask has the meta bits a record can have.
+const metaRecordMask = bitDelete | bitValuePointer | bitSalted | bitCompressed | bitTxn | bitFinTxn
+
+// maxRecordSize returns the max size of a record, the entries of a txn are limited by maxBatchSize.
+func (vlog *valueLog) maxRecordSize() int64 {
+	return headerBufSize + saltSize + vlog.opt.maxBatchSize + 4
+}
+
+// findNextRecord returns the offset of the first valid record of lf in [offset, limit), or false if
+// there's none. The records bigger than maxRecordSize are taken as garbage, so the checksum read of
+// each candidate is bounded.
+func (vlog *valueLog) findNextRecord(lf *logFile, offset uint32, limit int64, salted bool) (uint32, bool, error) {
+	fi, err := lf.fd.Stat()
+	if err != nil {
+		return 0, false, errors.Wrapf(err, "Unable to stat value log file %q", lf.path)
+	}
+	size := fi.Size()
+	maxRecordSize := vlog.maxRecordSize()
+	buf := make([]byte, 1<<20)
+	var bufStart, bufEnd int64
+	read := &safeRead{fid: lf.fid}
+	for off := int64(offset); off < limit && off+headerBufSize <= size; off++ {
+		if off+headerBufSize > bufEnd {
+			n, err := lf.fd.ReadAt(buf, off)
+			if err != nil && err != io.EOF {
+				return 0, false, errors.Wrapf(err, "Unable to read value log file %q", lf.path)
+			}
+			bufStart, bufEnd = off, off+int64(n)
+		}
+		hbuf := buf[off-bufStart : off-bufStart+headerBufSize]
+		if !isEncodedHeader(hbuf) {
+			continue
+		}
+		var h header
+		h.Decode(hbuf)
+		if h.meta&^metaRecordMask != 0 || h.klen > maxKeySize || (salted && h.meta&bitSalted == 0) {
+			continue
+		}
+		n := int64(headerBufSize) + int64(h.umlen) + int64(h.klen) + int64(h.vlen) + 4
+		if h.meta&bitSalted > 0 {
+			n += saltSize
+		}
+		if n > maxRecordSize || off+n > size {
+			continue
+		}
+		// Check the checksum before reading the entry, the lengths may be garbage.
+		hash := crc32.New(y.CastagnoliCrcTable)
+		if _, err = io.Copy(hash, io.NewSectionReader(lf.fd, off, n-4)); err != nil {
+			return 0, false, errors.Wrapf(err, "Unable to read value log file %q", lf.path)
+		}
+		var crcBuf [4]byte
+		if _, err = lf.fd.ReadAt(crcBuf[:], off+n-4); err != nil {
+			return 0, false, errors.Wrapf(err, "Unable to read value log file %q", lf.path)
+		}
+		if binary.BigEndian.Uint32(crcBuf[:]) != hash.Sum32() {
+			continue
+		}
+		read.salted = salted
+		e, err := read.readEntry(io.NewSectionReader(lf.fd, off, n))
+		if err != nil {
+			// The record is left by the previous incarnation of a recycled file.
+			continue
+		}
+		if e.meta&bitValuePointer > 0 && !vlog.kv.blobManger.hasValue(e.Value) {
+			continue
+		}
+		return uint32(off), true, nil
+	}
+	return 0, false, nil
+}
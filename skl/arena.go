@@ -17,6 +17,7 @@
 package skl
 
 import (
+	"math"
 	"sync/atomic"
 	"unsafe"
 
@@ -33,19 +34,36 @@ const (
 	nodeAlign = int(unsafe.Sizeof(uint64(0))) - 1
 )
 
-// Arena should be lock-free.
+// arenaChunkShift is the log2 of the max size of the chunks the arena grows by.
+const arenaChunkShift = 20
+
+// Arena should be lock-free. It allocates the memory in chunks as it grows, up to the capacity
+// it is created with. The offsets are contiguous across the chunks, an allocation never spans two
+// chunks unless it is larger than a chunk.
 type Arena struct {
-	n   uint32
-	buf []byte
+	n          uint32
+	chunkShift uint32
+	capacity   uint32
+	chunks     []unsafe.Pointer // *[]byte
 }
 
-// newArena returns a new arena.
+// newArena returns a new arena with the capacity of n bytes.
 func newArena(n int64) *Arena {
+	if n > math.MaxUint32 {
+		n = math.MaxUint32
+	}
+	var shift uint32
+	for shift < arenaChunkShift && int64(1)<<shift < n {
+		shift++
+	}
+	chunkSize := int64(1) << shift
 	// Don't store data at position 0 in order to reserve offset=0 as a kind
 	// of nil pointer.
 	out := &Arena{
-		n:   1,
-		buf: make([]byte, n),
+		n:          1,
+		chunkShift: shift,
+		capacity:   uint32(n),
+		chunks:     make([]unsafe.Pointer, (n+chunkSize-1)/chunkSize),
 	}
 	return out
 }
@@ -56,6 +74,66 @@ func (s *Arena) size() int64 {
 
 func (s *Arena) reset() {
 	atomic.StoreUint32(&s.n, 0)
+	s.chunks = nil
+}
+
+func (s *Arena) chunkSize() uint64 {
+	return 1 << s.chunkShift
+}
+
+// alloc allocates l bytes and returns the offset. The chunk of the allocation has room for fit
+// bytes at the offset, fit is larger than l for the nodes with truncated towers.
+func (s *Arena) alloc(l, fit uint32) uint32 {
+	if l == 0 {
+		return atomic.LoadUint32(&s.n)
+	}
+	chunkSize := s.chunkSize()
+	for {
+		n := atomic.LoadUint32(&s.n)
+		start, end := uint64(n), uint64(n)+uint64(l)
+		if start>>s.chunkShift != (start+uint64(fit)-1)>>s.chunkShift {
+			// Skip the rest of the chunk.
+			start = (start + chunkSize - 1) &^ (chunkSize - 1)
+			end = start + uint64(l)
+		}
+		if uint64(l) > chunkSize {
+			// Nothing else is allocated in the chunks of a large allocation, so they share a buffer.
+			end = (end + chunkSize - 1) &^ (chunkSize - 1)
+		}
+		y.AssertTruef(end <= uint64(s.capacity), "arena is full, capacity %d, size %d, alloc %d",
+			s.capacity, n, l)
+		if atomic.CompareAndSwapUint32(&s.n, n, uint32(end)) {
+			s.allocChunks(start, uint64(l))
+			return uint32(start)
+		}
+	}
+}
+
+// allocChunks allocates the missing chunks of the allocation at offset.
+func (s *Arena) allocChunks(offset, l uint64) {
+	first, last := offset>>s.chunkShift, (offset+l-1)>>s.chunkShift
+	if first == last {
+		if atomic.LoadPointer(&s.chunks[first]) == nil {
+			buf := make([]byte, s.chunkSize())
+			atomic.CompareAndSwapPointer(&s.chunks[first], nil, unsafe.Pointer(&buf))
+		}
+		return
+	}
+	buf := make([]byte, (last-first+1)<<s.chunkShift)
+	for i := first; i <= last; i++ {
+		chunk := buf[(i-first)<<s.chunkShift:]
+		atomic.StorePointer(&s.chunks[i], unsafe.Pointer(&chunk))
+	}
+}
+
+// slice returns size bytes at offset.
+func (s *Arena) slice(offset, size uint32) []byte {
+	if size == 0 {
+		return nil
+	}
+	chunk := *(*[]byte)(atomic.LoadPointer(&s.chunks[offset>>s.chunkShift]))
+	off := offset & (1<<s.chunkShift - 1)
+	return chunk[off : off+size]
 }
 
 // putNode allocates a node in the arena. The node is aligned on a pointer-sized
@@ -67,11 +145,10 @@ func (s *Arena) putNode(height int) uint32 {
 
 	// Pad the allocation with enough bytes to ensure pointer alignment.
 	l := uint32(MaxNodeSize - unusedSize + nodeAlign)
-	n := atomic.AddUint32(&s.n, l)
-	y.Assert(int(n) <= len(s.buf))
+	n := s.alloc(l, uint32(MaxNodeSize+nodeAlign))
 
 	// Return the aligned offset.
-	m := (n - l + uint32(nodeAlign)) & ^uint32(nodeAlign)
+	m := (n + uint32(nodeAlign)) & ^uint32(nodeAlign)
 	return m
 }
 
@@ -80,20 +157,16 @@ func (s *Arena) putNode(height int) uint32 {
 // size of val. We could also store this size inside arena but the encoding and
 // decoding will incur some overhead.
 func (s *Arena) putVal(v y.ValueStruct) uint32 {
-	l := uint32(v.EncodedSize())
-	n := atomic.AddUint32(&s.n, l)
-	y.Assert(int(n) <= len(s.buf))
-	m := n - l
-	v.Encode(s.buf[m:])
+	l := v.EncodedSize()
+	m := s.alloc(l, l)
+	v.Encode(s.slice(m, l))
 	return m
 }
 
 func (s *Arena) putKey(key []byte) uint32 {
 	l := uint32(len(key))
-	n := atomic.AddUint32(&s.n, l)
-	y.Assert(int(n) <= len(s.buf))
-	m := n - l
-	y.Assert(len(key) == copy(s.buf[m:n], key))
+	m := s.alloc(l, l)
+	y.Assert(len(key) == copy(s.slice(m, l), key))
 	return m
 }
 
@@ -104,31 +177,21 @@ func (s *Arena) getNode(offset uint32) *node {
 		return nil
 	}
 
-	return (*node)(unsafe.Pointer(&s.buf[offset]))
+	return (*node)(unsafe.Pointer(&s.slice(offset, 1)[0]))
 }
 
 // getKey returns byte slice at offset.
 func (s *Arena) getKey(offset uint32, size uint16) []byte {
-	return s.buf[offset : offset+uint32(size)]
+	return s.slice(offset, uint32(size))
 }
 
 // getVal returns byte slice at offset. The given size should be just the value
 // size and should NOT include the meta bytes.
-func (s *Arena) getVal(offset uint32, size uint16) (ret y.ValueStruct) {
-	ret.Decode(s.buf[offset : offset+uint32(size)])
+func (s *Arena) getVal(offset uint32, size uint32) (ret y.ValueStruct) {
+	ret.Decode(s.slice(offset, size))
 	return
 }
 
-func (s *Arena) fillVal(vs *y.ValueStruct, offset uint32, size uint16) {
-	vs.Decode(s.buf[offset : offset+uint32(size)])
-}
-
-// getNodeOffset returns the offset of node in the arena. If the node pointer is
-// nil, then the zero offset is returned.
-func (s *Arena) getNodeOffset(nd *node) uint32 {
-	if nd == nil {
-		return 0
-	}
-
-	return uint32(uintptr(unsafe.Pointer(nd)) - uintptr(unsafe.Pointer(&s.buf[0])))
+func (s *Arena) fillVal(vs *y.ValueStruct, offset uint32, size uint32) {
+	vs.Decode(s.slice(offset, size))
 }
@@ -56,7 +56,7 @@ type node struct {
 	// Multiple parts of the value are encoded as a single uint64 so that it
 	// can be atomically loaded and stored:
 	//   value offset: uint32 (bits 0-31)
-	//   value size  : uint16 (bits 32-47)
+	//   value size  : uint32 (bits 32-63)
 	value uint64
 
 	// A byte slice is 24 bytes. We are trying to save space here.
@@ -105,7 +105,7 @@ func (s *Skiplist) DecrRef() {
 
 func (s *Skiplist) valid() bool { return s.arena != nil }
 
-func newNode(arena *Arena, key []byte, v y.ValueStruct, height int) *node {
+func newNode(arena *Arena, key []byte, v y.ValueStruct, height int) (*node, uint32) {
 	// The base level is already allocated in the node struct.
 	offset := arena.putNode(height)
 	node := arena.getNode(offset)
@@ -113,21 +113,21 @@ func newNode(arena *Arena, key []byte, v y.ValueStruct, height int) *node {
 	node.keySize = uint16(len(key))
 	node.height = uint16(height)
 	node.value = encodeValue(arena.putVal(v), v.EncodedSize())
-	return node
+	return node, offset
 }
 
-func encodeValue(valOffset uint32, valSize uint16) uint64 {
+func encodeValue(valOffset uint32, valSize uint32) uint64 {
 	return uint64(valSize)<<32 | uint64(valOffset)
 }
 
-func decodeValue(value uint64) (valOffset uint32, valSize uint16) {
-	return uint32(value), uint16(value >> 32)
+func decodeValue(value uint64) (valOffset uint32, valSize uint32) {
+	return uint32(value), uint32(value >> 32)
 }
 
 // NewSkiplist makes a new empty skiplist, with a given arena size
 func NewSkiplist(arenaSize int64) *Skiplist {
 	arena := newArena(arenaSize)
-	head := newNode(arena, nil, y.ValueStruct{}, maxHeight)
+	head, _ := newNode(arena, nil, y.ValueStruct{}, maxHeight)
 	return &Skiplist{
 		height: 1,
 		head:   head,
@@ -136,7 +136,7 @@ func NewSkiplist(arenaSize int64) *Skiplist {
 	}
 }
 
-func (n *node) getValueOffset() (uint32, uint16) {
+func (n *node) getValueOffset() (uint32, uint32) {
 	value := atomic.LoadUint64(&n.value)
 	return decodeValue(value)
 }
@@ -347,8 +347,8 @@ func (s *Skiplist) PutWithHint(key []byte, v y.ValueStruct, hint *Hint) {
 				for bad == hint.prev[recomputeHeight] {
 					recomputeHeight++
 				}
-			} else if hint.next[recomputeHeight] != nil && y.CompareKeysWithVer(key, hint.next[recomputeHeight].key(s.arena)) > 0 {
-				// Key is after splice.
+			} else if hint.next[recomputeHeight] != nil && y.CompareKeysWithVer(key, hint.next[recomputeHeight].key(s.arena)) >= 0 {
+				// Key is after splice or equal to the next node, which is updated in place.
 				bad := hint.next[recomputeHeight]
 				for bad == hint.next[recomputeHeight] {
 					recomputeHeight++
@@ -376,15 +376,16 @@ func (s *Skiplist) PutWithHint(key []byte, v y.ValueStruct, hint *Hint) {
 	}
 
 	// We do need to create a new node.
-	x := newNode(s.arena, key, v, height)
+	x, xOffset := newNode(s.arena, key, v, height)
 
 	// We always insert from the base level and up. After you add a node in base level, we cannot
 	// create a node in the level above because it would have discovered the node in the base level.
 	for i := 0; i < height; i++ {
 		for {
-			nextOffset := s.arena.getNodeOffset(hint.next[i])
+			// The arena can't map a node back to its offset, so the offset of next is loaded from prev.
+			nextOffset := hint.prev[i].getNextOffset(i)
 			x.tower[i] = nextOffset
-			if hint.prev[i].casNextOffset(i, nextOffset, s.arena.getNodeOffset(x)) {
+			if s.arena.getNode(nextOffset) == hint.next[i] && hint.prev[i].casNextOffset(i, nextOffset, xOffset) {
 				// Managed to insert x between prev[i] and next[i]. Go to the next level.
 				break
 			}
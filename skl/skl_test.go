@@ -390,6 +390,60 @@ func TestPutWithHint(t *testing.T) {
 	require.True(t, cntGot == cnt)
 }
 
+func TestPutWithHintOverwrite(t *testing.T) {
+	l := NewSkiplist(arenaSize)
+	key := func(i int) []byte { return y.KeyWithTs([]byte(fmt.Sprintf("%05d", i)), 0) }
+	sp := new(Hint)
+	for i := 0; i < 2000; i++ {
+		l.PutWithHint(key(i), y.ValueStruct{Value: []byte("old")}, sp)
+	}
+	sp = new(Hint)
+	for i := 1000; i < 3000; i++ {
+		l.PutWithHint(key(i), y.ValueStruct{Value: []byte("new")}, sp)
+	}
+	it := l.NewIterator()
+	cnt := 0
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		require.EqualValues(t, key(cnt), it.Key())
+		if cnt < 1000 {
+			require.EqualValues(t, "old", it.Value().Value)
+		} else {
+			require.EqualValues(t, "new", it.Value().Value)
+		}
+		cnt++
+	}
+	require.Equal(t, 3000, cnt)
+}
+
+func TestArenaGrow(t *testing.T) {
+	l := NewSkiplist(16 << 20)
+	allocated := func() (n int) {
+		for _, c := range l.arena.chunks {
+			if c != nil {
+				n++
+			}
+		}
+		return
+	}
+	require.Equal(t, 1, allocated())
+	key := func(i int) []byte { return y.KeyWithTs([]byte(fmt.Sprintf("%05d", i)), 0) }
+	val := func(i int) []byte {
+		if i == 1500 {
+			// The large value spans several chunks.
+			return make([]byte, 3<<20)
+		}
+		return newValue(i)
+	}
+	for i := 0; i < 3000; i++ {
+		l.Put(key(i), y.ValueStruct{Value: val(i)})
+	}
+	require.True(t, allocated() > 4)
+	require.True(t, allocated() < len(l.arena.chunks))
+	for i := 0; i < 3000; i++ {
+		require.EqualValues(t, val(i), l.Get(key(i)).Value)
+	}
+}
+
 func randomKey() []byte {
 	b := make([]byte, 8)
 	key := rand.Uint32()
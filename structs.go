@@ -22,6 +22,11 @@ type header struct {
 const (
 	headerBufSize       = 10
 	metaNotEntryEncoded = 0
+
+	// saltSize is the size of the salt written after the header of a salted record.
+	saltSize = 4
+	// noSalt is passed to encodeEntry to write an unsalted record.
+	noSalt = ^uint32(0)
 )
 
 func (h header) Encode(out []byte) {
@@ -63,14 +68,18 @@ func (e *Entry) estimateSize() int {
 	return len(e.Key) + len(e.Value) + len(e.UserMeta) + 2 // Meta, UserMeta
 }
 
-// Encodes e to buf. Returns number of bytes written.
-func encodeEntry(e *Entry, buf *bytes.Buffer) (int, error) {
+// Encodes e to buf with the salt of the log file, noSalt writes an unsalted record. Returns number
+// of bytes written.
+func encodeEntry(e *Entry, buf *bytes.Buffer, salt uint32) (int, error) {
 	h := header{
 		klen:  uint32(len(e.Key)),
 		vlen:  uint32(len(e.Value)),
 		meta:  e.meta,
 		umlen: byte(len(e.UserMeta)),
 	}
+	if salt != noSalt {
+		h.meta |= bitSalted
+	}
 
 	var headerEnc [headerBufSize]byte
 	h.Encode(headerEnc[:])
@@ -79,6 +88,15 @@ func encodeEntry(e *Entry, buf *bytes.Buffer) (int, error) {
 
 	buf.Write(headerEnc[:])
 	hash.Write(headerEnc[:])
+	n := len(headerEnc)
+
+	if salt != noSalt {
+		var saltBuf [saltSize]byte
+		binary.BigEndian.PutUint32(saltBuf[:], salt)
+		buf.Write(saltBuf[:])
+		hash.Write(saltBuf[:])
+		n += len(saltBuf)
+	}
 
 	buf.Write(e.UserMeta)
 	hash.Write(e.UserMeta)
@@ -93,7 +111,7 @@ func encodeEntry(e *Entry, buf *bytes.Buffer) (int, error) {
 	binary.BigEndian.PutUint32(crcBuf[:], hash.Sum32())
 	buf.Write(crcBuf[:])
 
-	return len(headerEnc) + len(e.UserMeta) + len(e.Key) + len(e.Value) + len(crcBuf), nil
+	return n + len(e.UserMeta) + len(e.Key) + len(e.Value) + len(crcBuf), nil
 }
 
 func (e Entry) print(prefix string) {
@@ -21,13 +21,15 @@ import (
 	"math"
 	"os"
 	"reflect"
+	"strings"
+	"time"
 	"unsafe"
 
 	"github.com/coocood/badger/fileutil"
 	"github.com/coocood/badger/options"
 	"github.com/coocood/badger/y"
-	"github.com/coocood/bbloom"
 	"github.com/dgryski/go-farm"
+	"github.com/pingcap/errors"
 	"golang.org/x/time/rate"
 )
 
@@ -76,6 +78,9 @@ type Builder struct {
 	bloomFpr    float64
 	isExternal  bool
 	opt         options.TableBuilderOptions
+
+	props     Properties
+	collector options.TablePropertiesCollector
 }
 
 // NewTableBuilder makes a new TableBuilder.
@@ -92,6 +97,8 @@ func NewTableBuilder(f *os.File, limiter *rate.Limiter, level int, opt options.T
 		hashEntries: make([]hashEntry, 0, 4*1024),
 		bloomFpr:    fprBase / levelFactor,
 		opt:         opt,
+		props:       Properties{MinVersion: math.MaxUint64},
+		collector:   newPropertiesCollector(opt),
 	}
 }
 
@@ -104,7 +111,16 @@ func NewExternalTableBuilder(f *os.File, limiter *rate.Limiter, opt options.Tabl
 		bloomFpr:    opt.LogicalBloomFPR,
 		isExternal:  true,
 		opt:         opt,
+		props:       Properties{MinVersion: math.MaxUint64},
+		collector:   newPropertiesCollector(opt),
+	}
+}
+
+func newPropertiesCollector(opt options.TableBuilderOptions) options.TablePropertiesCollector {
+	if opt.TablePropertiesCollectorFactory == nil {
+		return nil
 	}
+	return opt.TablePropertiesCollectorFactory()
 }
 
 // Reset this builder with new file.
@@ -124,6 +140,8 @@ func (b *Builder) resetBuffers() {
 	b.blockEndOffsets = b.blockEndOffsets[:0]
 	b.entryEndOffsets = b.entryEndOffsets[:0]
 	b.hashEntries = b.hashEntries[:0]
+	b.props = Properties{MinVersion: math.MaxUint64}
+	b.collector = newPropertiesCollector(b.opt)
 }
 
 // Close closes the TableBuilder.
@@ -150,9 +168,26 @@ func (b *Builder) addHelper(key []byte, v y.ValueStruct) {
 			keyNoTs = y.ParseKey(key)
 		}
 		keyHash := farm.Fingerprint64(keyNoTs)
-		// It is impossible that a single table contains 16 million keys.
-		y.Assert(len(b.baseKeysEndOffs) < maxBlockCnt)
-		b.hashEntries = append(b.hashEntries, hashEntry{keyHash, uint16(len(b.baseKeysEndOffs)), uint8(b.counter)})
+		y.Assert(b.counter <= math.MaxUint16)
+		b.hashEntries = append(b.hashEntries, hashEntry{keyHash, uint32(len(b.baseKeysEndOffs)), uint16(b.counter)})
+	}
+	b.props.NumEntries++
+	deleted := v.Meta&y.BitDelete > 0
+	if deleted {
+		b.props.NumDeletes++
+	}
+	if b.collector != nil {
+		b.collector.Add(key, v.Value, v.UserMeta, deleted)
+	}
+	if !b.isExternal {
+		// The versions of external tables are determined by the global ts.
+		version := y.ParseTs(key)
+		if version < b.props.MinVersion {
+			b.props.MinVersion = version
+		}
+		if version > b.props.MaxVersion {
+			b.props.MaxVersion = version
+		}
 	}
 
 	// diffKey stores the difference of key with blockBaseKey.
@@ -211,6 +246,11 @@ func (b *Builder) Add(key []byte, value y.ValueStruct) error {
 	return nil // Currently, there is no meaningful error.
 }
 
+// AddBlobSize records the size of a value which is stored in a blob file.
+func (b *Builder) AddBlobSize(size int) {
+	b.props.BlobSize += uint64(size)
+}
+
 // ReachedCapacity returns true if we... roughly (?) reached capacity?
 func (b *Builder) ReachedCapacity(capacity int64) bool {
 	estimateSz := b.writtenLen + len(b.buf) +
@@ -224,7 +264,7 @@ func (b *Builder) ReachedCapacity(capacity int64) bool {
 func (b *Builder) EstimateSize() int {
 	size := b.writtenLen + len(b.buf) + 4*len(b.blockEndOffsets) + len(b.baseKeysBuf) + 4*len(b.baseKeysEndOffs)
 	if b.opt.EnableHashIndex {
-		size += 3 * int(float32(len(b.hashEntries))/b.opt.HashUtilRatio)
+		size += slotSize * int(float32(len(b.hashEntries))/b.opt.HashUtilRatio)
 	}
 	return size
 }
@@ -232,25 +272,40 @@ func (b *Builder) EstimateSize() int {
 // Finish finishes the table by appending the index.
 func (b *Builder) Finish() error {
 	b.finishBlock() // This will never start a new block.
-	b.buf = append(b.buf, u32SliceToBytes(b.blockEndOffsets)...)
-	b.buf = append(b.buf, b.baseKeysBuf...)
-	b.buf = append(b.buf, u32SliceToBytes(b.baseKeysEndOffs)...)
-	b.buf = append(b.buf, u32ToBytes(uint32(len(b.baseKeysEndOffs)))...)
-
-	// Write bloom filter.
-	bloomFilter := bbloom.New(float64(len(b.hashEntries)), b.bloomFpr)
-	for _, he := range b.hashEntries {
-		bloomFilter.Add(he.hash)
+	if b.opt.IndexPartitionSize > 0 {
+		b.buf = b.appendPartitions(b.buf)
+		// The hash index is not built for the tables with partitions.
+		b.buf = append(b.buf, u32ToBytes(0)...)
+	} else {
+		b.buf = appendBlockIndex(b.buf, b.blockEndOffsets, b.baseKeysBuf, b.baseKeysEndOffs)
+
+		// Write bloom filter.
+		bfData := buildFilter(b.opt.FilterType, b.hashEntries, b.bloomFpr)
+		b.buf = append(b.buf, bfData...)
+		b.buf = append(b.buf, u32ToBytes(uint32(len(bfData)))...)
+
+		if b.opt.EnableHashIndex {
+			b.buf = buildHashIndex(b.buf, b.hashEntries, b.opt.HashUtilRatio)
+		} else {
+			b.buf = append(b.buf, u32ToBytes(0)...)
+		}
 	}
-	bfData := bloomFilter.BinaryMarshal()
-	b.buf = append(b.buf, bfData...)
-	b.buf = append(b.buf, u32ToBytes(uint32(len(bfData)))...)
 
-	if b.opt.EnableHashIndex {
-		b.buf = buildHashIndex(b.buf, b.hashEntries, b.opt.HashUtilRatio)
-	} else {
-		b.buf = append(b.buf, u32ToBytes(0)...)
+	b.props.CreatedAt = time.Now().Unix()
+	if b.collector != nil {
+		b.props.UserProperties = b.collector.Finish()
+		for name := range b.props.UserProperties {
+			if strings.HasPrefix(name, propPrefix) {
+				return errors.Errorf("table property name %s has reserved prefix %s", name, propPrefix)
+			}
+		}
 	}
+	propsOff := len(b.buf)
+	b.buf = b.props.encode(b.buf)
+	b.buf = append(b.buf, u32ToBytes(uint32(len(b.buf)-propsOff))...)
+	b.buf = append(b.buf, u32ToBytes(uint32(b.opt.FilterType))...)
+	b.buf = append(b.buf, u32ToBytes(formatVersion)...)
+	b.buf = append(b.buf, u32ToBytes(footerMagic)...)
 	if err := b.w.Append(b.buf); err != nil {
 		return err
 	}
@@ -0,0 +1,297 @@
+/*
+ * Copyright 2026 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package table
+
+import (
+	"encoding/binary"
+	"math"
+	"math/bits"
+
+	"github.com/coocood/badger/options"
+	"github.com/coocood/bbloom"
+)
+
+// filter tells whether a key hash may have been added to a table.
+type filter interface {
+	// mayContain returns false if the key hash is definitely not in the table.
+	mayContain(keyHash uint64) bool
+}
+
+// buildFilter builds the filter of the key hashes and returns its serialized data.
+func buildFilter(filterType options.FilterType, entries []hashEntry, fpr float64) []byte {
+	switch filterType {
+	case options.BlockedBloomFilter:
+		return buildBlockedBloom(entries, fpr)
+	case options.RibbonFilter:
+		return buildRibbon(entries, fpr)
+	default:
+		bf := bbloom.New(math.Max(float64(len(entries)), 1), fpr)
+		for _, he := range entries {
+			bf.Add(he.hash)
+		}
+		return bf.BinaryMarshal()
+	}
+}
+
+func decodeFilter(filterType options.FilterType, data []byte) filter {
+	switch filterType {
+	case options.BlockedBloomFilter:
+		return decodeBlockedBloom(data)
+	case options.RibbonFilter:
+		return decodeRibbon(data)
+	default:
+		bf := new(bbloomFilter)
+		bf.BinaryUnmarshal(data)
+		return bf
+	}
+}
+
+type bbloomFilter struct {
+	bbloom.Bloom
+}
+
+func (bf *bbloomFilter) mayContain(keyHash uint64) bool {
+	return bf.Has(keyHash)
+}
+
+// blockedBloom is a bloom filter made of 512-bit blocks, all the probes of a key are in the same
+// block, so a lookup touches a single cache line. Its layout is
+// | blocks (64 bytes each) | num probes (4 bytes) |.
+type blockedBloom struct {
+	data      []byte
+	numBlocks uint32
+	numProbes uint32
+}
+
+const blockedBloomBlockSize = 64
+
+func buildBlockedBloom(entries []hashEntry, fpr float64) []byte {
+	// The keys are not evenly distributed among the blocks, it needs a few more bits than a
+	// standard bloom filter to reach the false positive rate.
+	bitsPerKey := -math.Log(fpr) / (math.Ln2 * math.Ln2) * 1.1
+	numProbes := uint32(math.Round(bitsPerKey * math.Ln2))
+	if numProbes < 1 {
+		numProbes = 1
+	} else if numProbes > 16 {
+		numProbes = 16
+	}
+	numKeys := 0
+	for i, he := range entries {
+		// The versions of a key are adjacent.
+		if i == 0 || he.hash != entries[i-1].hash {
+			numKeys++
+		}
+	}
+	numBlocks := uint32(math.Ceil(float64(numKeys) * bitsPerKey / (blockedBloomBlockSize * 8)))
+	if numBlocks == 0 {
+		numBlocks = 1
+	}
+	bf := &blockedBloom{
+		data:      make([]byte, numBlocks*blockedBloomBlockSize+4),
+		numBlocks: numBlocks,
+		numProbes: numProbes,
+	}
+	for _, he := range entries {
+		block, h := bf.locate(he.hash)
+		for i := uint32(0); i < numProbes; i++ {
+			bit := h >> 23 // The top 9 bits locate a bit in the 512-bit block.
+			block[bit/8] |= 1 << (bit % 8)
+			h *= 0x9E3779B9
+		}
+	}
+	binary.LittleEndian.PutUint32(bf.data[numBlocks*blockedBloomBlockSize:], numProbes)
+	return bf.data
+}
+
+func decodeBlockedBloom(data []byte) *blockedBloom {
+	pos := len(data) - 4
+	return &blockedBloom{
+		data:      data[:pos],
+		numBlocks: uint32(pos / blockedBloomBlockSize),
+		numProbes: binary.LittleEndian.Uint32(data[pos:]),
+	}
+}
+
+// locate returns the block of the key hash and the seed of its probes.
+func (bf *blockedBloom) locate(keyHash uint64) ([]byte, uint32) {
+	idx := uint32(uint64(uint32(keyHash>>32)) * uint64(bf.numBlocks) >> 32)
+	off := idx * blockedBloomBlockSize
+	return bf.data[off : off+blockedBloomBlockSize], uint32(keyHash)
+}
+
+func (bf *blockedBloom) mayContain(keyHash uint64) bool {
+	block, h := bf.locate(keyHash)
+	for i := uint32(0); i < bf.numProbes; i++ {
+		bit := h >> 23
+		if block[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+		h *= 0x9E3779B9
+	}
+	return true
+}
+
+// ribbon is a Standard Ribbon filter (https://arxiv.org/abs/2103.02515) with 64-bit coefficients.
+// A key hash is mapped to a start slot, a 64-bit coefficient row starting from the slot and a
+// fingerprint of numBits bits. The filter is a solution of the linear system over GF(2) which
+// makes the product of every key's row and the solution equal to its fingerprint, so the false
+// positive rate is 2^-numBits and it takes about 1.1 * numBits bits per key. Its layout is
+// | solution columns (numBits * numWords * 8 bytes) | num slots (4 bytes) | num bits (4 bytes) | seed (4 bytes) |.
+type ribbon struct {
+	data     []byte
+	numSlots uint32
+	numWords uint32
+	numBits  uint32
+	seed     uint32
+}
+
+const ribbonWidth = 64
+
+func buildRibbon(entries []hashEntry, fpr float64) []byte {
+	numBits := uint32(math.Ceil(-math.Log2(fpr)))
+	if numBits < 1 {
+		numBits = 1
+	} else if numBits > 32 {
+		numBits = 32
+	}
+	hashes := make([]uint64, 0, len(entries))
+	for i, he := range entries {
+		// The versions of a key are adjacent.
+		if i == 0 || he.hash != entries[i-1].hash {
+			hashes = append(hashes, he.hash)
+		}
+	}
+	numSlots := uint32(len(hashes)+len(hashes)/8) + ribbonWidth
+	for attempt := uint32(0); ; attempt++ {
+		r := &ribbon{numSlots: numSlots, numBits: numBits, seed: attempt}
+		if data, ok := r.build(hashes); ok {
+			return data
+		}
+		if attempt%4 == 3 {
+			// It's unlikely to succeed with more seeds, add more slots.
+			numSlots += uint32(len(hashes)/16) + 1
+		}
+	}
+}
+
+func (r *ribbon) build(hashes []uint64) ([]byte, bool) {
+	coeffs := make([]uint64, r.numSlots)
+	results := make([]uint32, r.numSlots)
+	for _, hash := range hashes {
+		start, coeff, result := r.hash(hash)
+		for {
+			if coeffs[start] == 0 {
+				coeffs[start], results[start] = coeff, result
+				break
+			}
+			coeff ^= coeffs[start]
+			result ^= results[start]
+			if coeff == 0 {
+				if result != 0 {
+					return nil, false
+				}
+				// The same hash has been added.
+				break
+			}
+			tz := uint32(bits.TrailingZeros64(coeff))
+			start += tz
+			coeff >>= tz
+		}
+	}
+
+	// Back substitution from the last slot, the window of a slot only covers the slots after it.
+	r.numWords = (r.numSlots+ribbonWidth-1)/ribbonWidth + 1
+	columns := make([]uint64, r.numBits*r.numWords)
+	for i := int(r.numSlots) - 1; i >= 0; i-- {
+		coeff, result := coeffs[i], results[i]
+		if coeff == 0 {
+			continue
+		}
+		for j := uint32(0); j < r.numBits; j++ {
+			col := columns[j*r.numWords : (j+1)*r.numWords]
+			bit := (result>>j)&1 ^ uint32(bits.OnesCount64(window(col, uint32(i))&coeff)&1)
+			col[i/ribbonWidth] |= uint64(bit) << (uint32(i) % ribbonWidth)
+		}
+	}
+
+	data := make([]byte, len(columns)*8+12)
+	for i, w := range columns {
+		binary.LittleEndian.PutUint64(data[i*8:], w)
+	}
+	pos := len(columns) * 8
+	binary.LittleEndian.PutUint32(data[pos:], r.numSlots)
+	binary.LittleEndian.PutUint32(data[pos+4:], r.numBits)
+	binary.LittleEndian.PutUint32(data[pos+8:], r.seed)
+	return data, true
+}
+
+func decodeRibbon(data []byte) *ribbon {
+	pos := len(data) - 12
+	r := &ribbon{
+		data:     data[:pos],
+		numSlots: binary.LittleEndian.Uint32(data[pos:]),
+		numBits:  binary.LittleEndian.Uint32(data[pos+4:]),
+		seed:     binary.LittleEndian.Uint32(data[pos+8:]),
+	}
+	r.numWords = (r.numSlots+ribbonWidth-1)/ribbonWidth + 1
+	return r
+}
+
+// hash returns the start slot, the coefficient row and the fingerprint of the key hash.
+func (r *ribbon) hash(keyHash uint64) (uint32, uint64, uint32) {
+	h := mix64(keyHash ^ uint64(r.seed)*0x9E3779B97F4A7C15)
+	start := uint32(uint64(uint32(h>>32)) * uint64(r.numSlots-ribbonWidth+1) >> 32)
+	// The lowest bit is the leading position of the row.
+	coeff := mix64(h) | 1
+	result := uint32(h) & (1<<r.numBits - 1)
+	return start, coeff, result
+}
+
+func (r *ribbon) mayContain(keyHash uint64) bool {
+	start, coeff, result := r.hash(keyHash)
+	word, off := start/ribbonWidth, start%ribbonWidth
+	for j := uint32(0); j < r.numBits; j++ {
+		pos := (j*r.numWords + word) * 8
+		w := binary.LittleEndian.Uint64(r.data[pos:]) >> off
+		if off > 0 {
+			w |= binary.LittleEndian.Uint64(r.data[pos+8:]) << (ribbonWidth - off)
+		}
+		if uint32(bits.OnesCount64(w&coeff)&1) != (result>>j)&1 {
+			return false
+		}
+	}
+	return true
+}
+
+// window returns the 64 bits of the column starting from the slot.
+func window(col []uint64, slot uint32) uint64 {
+	word, off := slot/ribbonWidth, slot%ribbonWidth
+	w := col[word] >> off
+	if off > 0 {
+		w |= col[word+1] << (ribbonWidth - off)
+	}
+	return w
+}
+
+// mix64 is the finalizer of SplitMix64.
+func mix64(z uint64) uint64 {
+	z ^= z >> 30
+	z *= 0xbf58476d1ce4e5b9
+	z ^= z >> 27
+	z *= 0x94d049bb133111eb
+	return z ^ z>>31
+}
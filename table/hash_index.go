@@ -2,22 +2,41 @@ package table
 
 import (
 	"encoding/binary"
+	"math"
 )
 
+// Since hashIndexVersion, the hash index is a linear probing hash table of
+// | block index (4 bytes) | entry offset (2 bytes) | fingerprint (2 bytes) | slots followed by the
+// number of slots (4 bytes). A slot locates the first entry of a key, a lookup probes the slots from
+// keyHash % numSlots until an empty slot and verifies the keys whose fingerprint matches, so a
+// collision costs another probe instead of a seek.
+//
+// The legacy hash index of the earlier versions has | block index (2 bytes) | offset (1 byte) |
+// buckets, a bucket falls back to seek once two keys of different blocks collide in it.
 const (
-	resultNoEntry  = 65535
-	resultFallback = 65534
-	maxBlockCnt    = 65533
+	hashIndexVersion uint32 = 2
+
+	slotSize  = 8
+	emptySlot = math.MaxUint32
+
+	legacyBucketSize = 3
+	resultNoEntry    = 65535
+	resultFallback   = 65534
 )
 
 type hashEntry struct {
 	hash uint64
 
 	// blockIdx is the index of block which contains this key.
-	blockIdx uint16
+	blockIdx uint32
 
 	// offset is the index of this key in block.
-	offset uint8
+	offset uint16
+}
+
+// fingerprint takes the high bits of the key hash, the low bits decide the slot.
+func fingerprint(keyHash uint64) uint16 {
+	return uint16(keyHash >> 48)
 }
 
 func buildHashIndex(buf []byte, hashEntries []hashEntry, hashUtilRatio float32) []byte {
@@ -25,26 +44,36 @@ func buildHashIndex(buf []byte, hashEntries []hashEntry, hashUtilRatio float32)
 		return append(buf, u32ToBytes(0)...)
 	}
 
-	numBuckets := uint32(float32(len(hashEntries)) / hashUtilRatio)
+	numSlots := uint32(float32(len(hashEntries)) / hashUtilRatio)
+	if numSlots <= uint32(len(hashEntries)) {
+		// There must be an empty slot to stop the probing.
+		numSlots = uint32(len(hashEntries)) + 1
+	}
 	bufLen := len(buf)
-	buf = append(buf, make([]byte, numBuckets*3+4)...)
-	buckets := buf[bufLen:]
-	for i := 0; i < int(numBuckets); i++ {
-		binary.LittleEndian.PutUint16(buckets[i*3:], resultNoEntry)
+	buf = append(buf, make([]byte, numSlots*slotSize+4)...)
+	slots := buf[bufLen:]
+	for i := uint32(0); i < numSlots; i++ {
+		binary.LittleEndian.PutUint32(slots[i*slotSize:], emptySlot)
 	}
 
-	for _, h := range hashEntries {
-		idx := h.hash % uint64(numBuckets)
-		bucket := buckets[idx*3 : (idx+1)*3]
-		blkIdx := binary.LittleEndian.Uint16(bucket[:2])
-		if blkIdx == resultNoEntry {
-			binary.LittleEndian.PutUint16(bucket[:2], h.blockIdx)
-			bucket[2] = h.offset
-		} else if blkIdx != h.blockIdx {
-			binary.LittleEndian.PutUint16(bucket[:2], resultFallback)
+	for i, h := range hashEntries {
+		// The versions of a key are adjacent, only the first one is indexed.
+		if i > 0 && h.hash == hashEntries[i-1].hash {
+			continue
+		}
+		idx := h.hash % uint64(numSlots)
+		for binary.LittleEndian.Uint32(slots[idx*slotSize:]) != emptySlot {
+			idx++
+			if idx == uint64(numSlots) {
+				idx = 0
+			}
 		}
+		slot := slots[idx*slotSize : (idx+1)*slotSize]
+		binary.LittleEndian.PutUint32(slot, h.blockIdx)
+		binary.LittleEndian.PutUint16(slot[4:], h.offset)
+		binary.LittleEndian.PutUint16(slot[6:], fingerprint(h.hash))
 	}
-	copy(buckets[numBuckets*3:], u32ToBytes(numBuckets))
+	copy(slots[numSlots*slotSize:], u32ToBytes(numSlots))
 
 	return buf
 }
@@ -52,19 +81,28 @@ func buildHashIndex(buf []byte, hashEntries []hashEntry, hashUtilRatio float32)
 type hashIndex struct {
 	buckets    []byte
 	numBuckets int
+	legacy     bool
 }
 
-func (i *hashIndex) readIndex(buf []byte, numBucket int) {
+func (i *hashIndex) readIndex(buf []byte, numBucket int, legacy bool) {
 	i.buckets = buf
 	i.numBuckets = numBucket
+	i.legacy = legacy
 }
 
-func (i *hashIndex) lookup(keyHash uint64) (uint32, uint8) {
+// lookupLegacy looks up the legacy hash index.
+func (i *hashIndex) lookupLegacy(keyHash uint64) (uint32, uint8) {
 	if i.buckets == nil {
 		return resultFallback, 0
 	}
 	idx := keyHash % uint64(i.numBuckets)
-	buf := i.buckets[idx*3:]
+	buf := i.buckets[idx*legacyBucketSize:]
 	blkIdx := binary.LittleEndian.Uint16(buf)
 	return uint32(blkIdx), uint8(buf[2])
 }
+
+// slot returns the content of the slot at idx.
+func (i *hashIndex) slot(idx int) (blkIdx uint32, offset uint16, fp uint16) {
+	buf := i.buckets[idx*slotSize : (idx+1)*slotSize]
+	return binary.LittleEndian.Uint32(buf), binary.LittleEndian.Uint16(buf[4:]), binary.LittleEndian.Uint16(buf[6:])
+}
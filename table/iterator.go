@@ -175,7 +175,7 @@ func (itr *Iterator) Valid() bool {
 }
 
 func (itr *Iterator) seekToFirst() {
-	numBlocks := len(itr.t.blockEndOffsets)
+	numBlocks := itr.t.numBlocks()
 	if numBlocks == 0 {
 		itr.err = io.EOF
 		return
@@ -192,7 +192,7 @@ func (itr *Iterator) seekToFirst() {
 }
 
 func (itr *Iterator) seekToLast() {
-	numBlocks := len(itr.t.blockEndOffsets)
+	numBlocks := itr.t.numBlocks()
 	if numBlocks == 0 {
 		itr.err = io.EOF
 		return
@@ -229,31 +229,53 @@ func (itr *Iterator) seekFromOffset(blockIdx int, offset int, key []byte) {
 	}
 	itr.bi.setBlock(block)
 	itr.bi.setIdx(offset)
-	if y.CompareKeysWithVer(itr.bi.key, key) >= 0 {
+	itr.err = itr.bi.Error()
+	if itr.err != nil || y.CompareKeysWithVer(itr.bi.key, key) >= 0 {
 		return
 	}
 	itr.bi.seek(key)
+	if itr.bi.Error() == io.EOF {
+		// The versions of the key continue in the next blocks.
+		itr.seekFrom(key)
+		return
+	}
+	itr.err = itr.bi.Error()
 }
 
+// seekBlock returns the index of the first block whose base key is greater than the key.
 func (itr *Iterator) seekBlock(key []byte) int {
-	return sort.Search(len(itr.t.blockEndOffsets), func(idx int) bool {
-		baseKeyStartOff := 0
-		if idx > 0 {
-			baseKeyStartOff = int(itr.t.baseKeysEndOffs[idx-1])
-		}
-		baseKeyEndOff := itr.t.baseKeysEndOffs[idx]
-		baseKey := itr.t.baseKeys[baseKeyStartOff:baseKeyEndOff]
-		if itr.bi.globalTs != maxGlobalTs {
-			cmp := bytes.Compare(baseKey, y.ParseKey(key))
-			if cmp != 0 {
-				return cmp > 0
-			}
-			return bytes.Compare(itr.bi.globalTs[:], key[len(key)-8:]) > 0
-		}
-		return y.CompareKeysWithVer(baseKey, key) > 0
+	t := itr.t
+	if !t.isPartitioned() {
+		return sort.Search(t.index.numBlocks(), func(idx int) bool {
+			return itr.greaterThan(t.index.baseKey(idx), key)
+		})
+	}
+	p := sort.Search(len(t.top.indexPartitions), func(i int) bool {
+		return itr.greaterThan(getKey(t.top.firstKeys, t.top.firstKeysEndOff, i), key)
+	})
+	if p == 0 {
+		return 0
+	}
+	// The first key of partition p-1 is not greater than the key, so the block is in the partition
+	// or it is the first block of partition p.
+	index := t.indexPartition(p - 1)
+	return int(t.top.indexPartitions[p-1].firstBlock) + sort.Search(index.numBlocks(), func(idx int) bool {
+		return itr.greaterThan(index.baseKey(idx), key)
 	})
 }
 
+// greaterThan returns true if the base key of a block is greater than the key.
+func (itr *Iterator) greaterThan(baseKey, key []byte) bool {
+	if itr.bi.globalTs != maxGlobalTs {
+		cmp := bytes.Compare(baseKey, y.ParseKey(key))
+		if cmp != 0 {
+			return cmp > 0
+		}
+		return bytes.Compare(itr.bi.globalTs[:], key[len(key)-8:]) > 0
+	}
+	return y.CompareKeysWithVer(baseKey, key) > 0
+}
+
 // seekFrom brings us to a key that is >= input key.
 func (itr *Iterator) seekFrom(key []byte) {
 	itr.err = nil
@@ -276,8 +298,8 @@ func (itr *Iterator) seekFrom(key []byte) {
 	itr.seekHelper(idx-1, key)
 	if itr.err == io.EOF {
 		// Case 1. Need to visit block[idx].
-		if idx == len(itr.t.blockEndOffsets) {
-			// If idx == len(itr.t.blockEndOffsets), then input key is greater than ANY element of table.
+		if idx == itr.t.numBlocks() {
+			// If idx == itr.t.numBlocks(), then input key is greater than ANY element of table.
 			// There's nothing we can do. Valid() should return false as we seek to end of table.
 			return
 		}
@@ -304,7 +326,7 @@ func (itr *Iterator) seekForPrev(key []byte) {
 func (itr *Iterator) next() {
 	itr.err = nil
 
-	if itr.bpos >= len(itr.t.blockEndOffsets) {
+	if itr.bpos >= itr.t.numBlocks() {
 		itr.err = io.EOF
 		return
 	}
@@ -3,11 +3,13 @@ package table
 import (
 	"bytes"
 	"sort"
+	"sync"
 	"sync/atomic"
 	"unsafe"
 
 	"github.com/coocood/badger/skl"
 	"github.com/coocood/badger/y"
+	"github.com/dgryski/go-farm"
 )
 
 type Entry struct {
@@ -87,12 +89,22 @@ func (mt *MemTable) PutToPendingList(entries []Entry) {
 
 // MergeListToSkl merge all entries in pending list to SkipList.
 func (mt *MemTable) MergeListToSkl() {
+	mt.MergeListToSklConcurrently(1)
+}
+
+// MergeListToSklConcurrently merge all entries in pending list to SkipList with up to concurrency
+// goroutines. The entries are partitioned by key, so the writes of the same key keep their order.
+func (mt *MemTable) MergeListToSklConcurrently(concurrency int) {
 	head := (*listNode)(atomic.LoadPointer(&mt.pendingList))
 	if head == nil {
 		return
 	}
 
-	head.mergeToSkl(mt.skl)
+	if concurrency > 1 {
+		head.mergeToSklConcurrently(mt.skl, concurrency)
+	} else {
+		head.mergeToSkl(mt.skl)
+	}
 	// No new node inserted, just update head of list.
 	if atomic.CompareAndSwapPointer(&mt.pendingList, unsafe.Pointer(head), nil) {
 		return
@@ -154,6 +166,48 @@ func (n *listNode) mergeToSkl(skl *skl.Skiplist) {
 	n.putToSkl(skl, n.entries)
 }
 
+// minConcurrentMergeEntries is the min number of entries a goroutine merges, smaller merges are
+// not worth the goroutines.
+const minConcurrentMergeEntries = 256
+
+func (n *listNode) mergeToSklConcurrently(s *skl.Skiplist, concurrency int) {
+	var nodes []*listNode
+	var count int
+	for curr := n; curr != nil; curr = (*listNode)(atomic.LoadPointer(&curr.next)) {
+		nodes = append(nodes, curr)
+		count += len(curr.entries)
+	}
+	if concurrency > count/minConcurrentMergeEntries {
+		concurrency = count / minConcurrentMergeEntries
+	}
+	if concurrency <= 1 {
+		n.mergeToSkl(s)
+		return
+	}
+	parts := make([][]Entry, concurrency)
+	for i := range parts {
+		parts[i] = make([]Entry, 0, count/concurrency*5/4)
+	}
+	// The older nodes are at the tail of the list.
+	for i := len(nodes) - 1; i >= 0; i-- {
+		for _, e := range nodes[i].entries {
+			idx := farm.Fingerprint32(e.Key) % uint32(concurrency)
+			parts[idx] = append(parts[idx], e)
+		}
+	}
+	var wg sync.WaitGroup
+	for _, part := range parts[1:] {
+		wg.Add(1)
+		go func(entries []Entry) {
+			n.putToSkl(s, entries)
+			wg.Done()
+		}(part)
+	}
+	n.putToSkl(s, parts[0])
+	wg.Wait()
+	atomic.StorePointer(&n.next, nil)
+}
+
 func (n *listNode) get(key []byte) (y.ValueStruct, bool) {
 	i := sort.Search(len(n.entries), func(i int) bool {
 		return y.CompareKeysWithVer(n.entries[i].Key, key) >= 0
@@ -0,0 +1,81 @@
+package table
+
+import (
+	"fmt"
+	"runtime"
+	"testing"
+
+	"github.com/coocood/badger/y"
+	"github.com/stretchr/testify/require"
+)
+
+func memTableTestEntries(start, n int, ts uint64, val string) []Entry {
+	entries := make([]Entry, 0, n)
+	for i := start; i < start+n; i++ {
+		entries = append(entries, Entry{
+			Key:   y.KeyWithTs([]byte(fmt.Sprintf("key%08d", i)), ts),
+			Value: y.ValueStruct{Value: []byte(val)},
+		})
+	}
+	return entries
+}
+
+func TestMergeListToSklConcurrently(t *testing.T) {
+	const n = 10000
+	mt := NewMemTable(64 << 20)
+	defer mt.DecrRef()
+	mt.PutToPendingList(memTableTestEntries(0, n, 1, "old"))
+	// The newer node overwrites half of the entries of the older one.
+	mt.PutToPendingList(memTableTestEntries(n/2, n, 1, "new"))
+	mt.PutToPendingList(memTableTestEntries(0, n, 2, "v2"))
+	mt.MergeListToSklConcurrently(4)
+	require.Equal(t, "old", string(mt.skl.Get(y.KeyWithTs([]byte("key00000000"), 1)).Value))
+	require.True(t, mt.pendingList == nil)
+
+	for i := 0; i < n+n/2; i++ {
+		key := []byte(fmt.Sprintf("key%08d", i))
+		val := "old"
+		if i >= n/2 {
+			val = "new"
+		}
+		require.Equal(t, val, string(mt.Get(y.KeyWithTs(key, 1)).Value), "%s", key)
+		if i < n {
+			require.Equal(t, "v2", string(mt.Get(y.KeyWithTs(key, 2)).Value))
+		}
+	}
+	var count int
+	it := mt.NewIterator(false)
+	for it.Rewind(); it.Valid(); it.Next() {
+		count++
+	}
+	require.Equal(t, n+n/2+n, count)
+}
+
+func BenchmarkMergeListToSkl(b *testing.B) {
+	const batchSize, numBatches = 1000, 100
+	batches := make([][]Entry, numBatches)
+	for i := range batches {
+		// The batches of the concurrent transactions interleave.
+		batches[i] = make([]Entry, 0, batchSize)
+		for j := 0; j < batchSize; j++ {
+			key := y.KeyWithTs([]byte(fmt.Sprintf("key%08d", j*numBatches+i)), 1)
+			batches[i] = append(batches[i], Entry{Key: key, Value: y.ValueStruct{Value: make([]byte, 16)}})
+		}
+	}
+	concurrencies := []int{1, 2, 4}
+	if n := runtime.GOMAXPROCS(0); n > 4 {
+		concurrencies = append(concurrencies, n)
+	}
+	for _, concurrency := range concurrencies {
+		b.Run(fmt.Sprintf("concurrency=%d", concurrency), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				mt := NewMemTable(64 << 20)
+				for _, batch := range batches {
+					mt.PutToPendingList(batch)
+				}
+				mt.MergeListToSklConcurrently(concurrency)
+				mt.DecrRef()
+			}
+		})
+	}
+}
@@ -0,0 +1,349 @@
+/*
+ * Copyright 2026 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package table
+
+import (
+	"container/list"
+	"math"
+	"sort"
+	"sync"
+)
+
+// A table built with TableBuilderOptions.IndexPartitionSize has the layout
+// | data blocks | index partitions | bloom filter partitions | top-level index | top-level index len (4 bytes) | 0 (4 bytes) | properties | ... |
+// The 0 is the number of hash index buckets, the hash index is not built for these tables.
+//
+// An index partition covers a range of adjacent blocks, it has the same layout as the index of a
+// table without partitions: | block end offsets | base keys | base key end offsets | num blocks |.
+// Each key hash is mapped to one of the bloom filter partitions.
+//
+// The top-level index is
+// | first keys | index partition handles | first key end offsets | bloom filter partition handles | num blocks | num index partitions | num bloom filter partitions |
+// Only the top-level index stays in memory, the partitions are read on demand.
+
+// blockIndex has the end offsets and the base keys of a range of blocks.
+type blockIndex struct {
+	endOffsets      []uint32
+	baseKeys        []byte
+	baseKeysEndOffs []uint32
+}
+
+func (idx *blockIndex) numBlocks() int {
+	return len(idx.endOffsets)
+}
+
+func (idx *blockIndex) baseKey(i int) []byte {
+	return getKey(idx.baseKeys, idx.baseKeysEndOffs, i)
+}
+
+func getKey(keys []byte, endOffs []uint32, i int) []byte {
+	var start uint32
+	if i > 0 {
+		start = endOffs[i-1]
+	}
+	return keys[start:endOffs[i]]
+}
+
+func appendBlockIndex(buf []byte, endOffsets []uint32, baseKeys []byte, baseKeysEndOffs []uint32) []byte {
+	buf = append(buf, u32SliceToBytes(endOffsets)...)
+	buf = append(buf, baseKeys...)
+	buf = append(buf, u32SliceToBytes(baseKeysEndOffs)...)
+	return append(buf, u32ToBytes(uint32(len(endOffsets)))...)
+}
+
+func decodeBlockIndex(data []byte) *blockIndex {
+	pos := len(data) - 4
+	numBlocks := int(bytesToU32(data[pos:]))
+	idx := new(blockIndex)
+	pos -= 4 * numBlocks
+	idx.baseKeysEndOffs = bytesToU32Slice(data[pos : pos+4*numBlocks])
+	baseKeysEnd := pos
+	pos -= int(idx.baseKeysEndOffs[numBlocks-1])
+	idx.baseKeys = data[pos:baseKeysEnd]
+	idx.endOffsets = bytesToU32Slice(data[pos-4*numBlocks : pos])
+	return idx
+}
+
+type partitionHandle struct {
+	offset uint32
+	length uint32
+}
+
+type indexPartitionHandle struct {
+	partitionHandle
+	firstBlock uint32
+	// dataOffset is the offset of the first block.
+	dataOffset uint32
+}
+
+// topIndex is the top-level index of a table with partitions.
+type topIndex struct {
+	numBlocks       int
+	indexPartitions []indexPartitionHandle
+	firstKeys       []byte
+	firstKeysEndOff []uint32
+	bloomPartitions []partitionHandle
+}
+
+func (top *topIndex) encode(buf []byte) []byte {
+	buf = append(buf, top.firstKeys...)
+	handles := make([]uint32, 0, 4*len(top.indexPartitions))
+	for _, h := range top.indexPartitions {
+		handles = append(handles, h.firstBlock, h.dataOffset, h.offset, h.length)
+	}
+	buf = append(buf, u32SliceToBytes(handles)...)
+	buf = append(buf, u32SliceToBytes(top.firstKeysEndOff)...)
+	handles = handles[:0]
+	for _, h := range top.bloomPartitions {
+		handles = append(handles, h.offset, h.length)
+	}
+	buf = append(buf, u32SliceToBytes(handles)...)
+	buf = append(buf, u32ToBytes(uint32(top.numBlocks))...)
+	buf = append(buf, u32ToBytes(uint32(len(top.indexPartitions)))...)
+	return append(buf, u32ToBytes(uint32(len(top.bloomPartitions)))...)
+}
+
+func (top *topIndex) decode(data []byte) {
+	pos := len(data) - 12
+	top.numBlocks = int(bytesToU32(data[pos:]))
+	numIndexPartitions := int(bytesToU32(data[pos+4:]))
+	numBloomPartitions := int(bytesToU32(data[pos+8:]))
+
+	pos -= 8 * numBloomPartitions
+	handles := bytesToU32Slice(data[pos : pos+8*numBloomPartitions])
+	top.bloomPartitions = make([]partitionHandle, numBloomPartitions)
+	for i := range top.bloomPartitions {
+		top.bloomPartitions[i] = partitionHandle{offset: handles[2*i], length: handles[2*i+1]}
+	}
+
+	pos -= 4 * numIndexPartitions
+	top.firstKeysEndOff = bytesToU32Slice(data[pos : pos+4*numIndexPartitions])
+	pos -= 16 * numIndexPartitions
+	handles = bytesToU32Slice(data[pos : pos+16*numIndexPartitions])
+	top.indexPartitions = make([]indexPartitionHandle, numIndexPartitions)
+	for i := range top.indexPartitions {
+		h := handles[4*i : 4*i+4]
+		top.indexPartitions[i] = indexPartitionHandle{
+			firstBlock:      h[0],
+			dataOffset:      h[1],
+			partitionHandle: partitionHandle{offset: h[2], length: h[3]},
+		}
+	}
+	top.firstKeys = data[:pos]
+}
+
+// indexPartitionOf returns the index partition which contains the block.
+func (top *topIndex) indexPartitionOf(blockIdx int) int {
+	return sort.Search(len(top.indexPartitions), func(i int) bool {
+		return int(top.indexPartitions[i].firstBlock) > blockIdx
+	}) - 1
+}
+
+// bloomPartitionOf maps the key hash to a bloom filter partition. The hash is mixed because
+// the filters use its high bits and low bits as the locations.
+func bloomPartitionOf(keyHash uint64, numPartitions int) int {
+	return int((keyHash * 0x9E3779B97F4A7C15 >> 32) * uint64(numPartitions) >> 32)
+}
+
+// numBloomPartitions estimates the number of bloom filter partitions of the partition size.
+func numBloomPartitions(numKeys int, fpr float64, partitionSize int) int {
+	bytes := -float64(numKeys) * math.Log(fpr) / (math.Ln2 * math.Ln2) / 8
+	n := int(math.Ceil(bytes / float64(partitionSize)))
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
+
+func (b *Builder) appendPartitions(buf []byte) []byte {
+	var top topIndex
+	top.numBlocks = len(b.blockEndOffsets)
+	for start := 0; start < top.numBlocks; {
+		h := indexPartitionHandle{
+			firstBlock:      uint32(start),
+			partitionHandle: partitionHandle{offset: uint32(b.writtenLen + len(buf))},
+		}
+		if start > 0 {
+			h.dataOffset = b.blockEndOffsets[start-1]
+		}
+		var baseKeysStart uint32
+		if start > 0 {
+			baseKeysStart = b.baseKeysEndOffs[start-1]
+		}
+		end, size := start, 0
+		var baseKeysEndOffs []uint32
+		for end < top.numBlocks && (end == start || size < b.opt.IndexPartitionSize) {
+			baseKeysEndOffs = append(baseKeysEndOffs, b.baseKeysEndOffs[end]-baseKeysStart)
+			size += 8 + len(getKey(b.baseKeysBuf, b.baseKeysEndOffs, end))
+			end++
+		}
+		baseKeys := b.baseKeysBuf[baseKeysStart:b.baseKeysEndOffs[end-1]]
+		buf = appendBlockIndex(buf, b.blockEndOffsets[start:end], baseKeys, baseKeysEndOffs)
+		h.length = uint32(b.writtenLen+len(buf)) - h.offset
+		top.indexPartitions = append(top.indexPartitions, h)
+		top.firstKeys = append(top.firstKeys, getKey(b.baseKeysBuf, b.baseKeysEndOffs, start)...)
+		top.firstKeysEndOff = append(top.firstKeysEndOff, uint32(len(top.firstKeys)))
+		start = end
+	}
+
+	numParts := numBloomPartitions(len(b.hashEntries), b.bloomFpr, b.opt.IndexPartitionSize)
+	partEntries := make([][]hashEntry, numParts)
+	for _, he := range b.hashEntries {
+		i := bloomPartitionOf(he.hash, numParts)
+		partEntries[i] = append(partEntries[i], he)
+	}
+	for _, entries := range partEntries {
+		h := partitionHandle{offset: uint32(b.writtenLen + len(buf))}
+		buf = append(buf, buildFilter(b.opt.FilterType, entries, b.bloomFpr)...)
+		h.length = uint32(b.writtenLen+len(buf)) - h.offset
+		top.bloomPartitions = append(top.bloomPartitions, h)
+	}
+
+	b.props.NumIndexPartitions = uint64(len(top.indexPartitions))
+	topOff := len(buf)
+	buf = top.encode(buf)
+	return append(buf, u32ToBytes(uint32(len(buf)-topOff))...)
+}
+
+// IndexCache keeps the index and bloom filter partitions read from the tables opened in FileIO
+// mode, it evicts the least recently used partitions when their total size exceeds the capacity.
+// It is safe for concurrent use. A nil IndexCache caches nothing.
+type IndexCache struct {
+	mu       sync.Mutex
+	capacity int64
+	size     int64
+	lru      *list.List
+	items    map[partitionKey]*list.Element
+}
+
+type partitionKey struct {
+	tableID uint64
+	bloom   bool
+	idx     int
+}
+
+type cachedPartition struct {
+	key   partitionKey
+	value interface{}
+	size  int64
+}
+
+// NewIndexCache returns an IndexCache of the capacity in bytes, 0 means unlimited.
+func NewIndexCache(capacity int64) *IndexCache {
+	return &IndexCache{
+		capacity: capacity,
+		lru:      list.New(),
+		items:    make(map[partitionKey]*list.Element),
+	}
+}
+
+// Size returns the total size of the cached partitions.
+func (c *IndexCache) Size() int64 {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size
+}
+
+func (c *IndexCache) get(key partitionKey) (interface{}, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*cachedPartition).value, true
+}
+
+func (c *IndexCache) put(key partitionKey, value interface{}, size int64) {
+	if c == nil || (c.capacity > 0 && size > c.capacity) {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.items[key]; ok {
+		return
+	}
+	c.items[key] = c.lru.PushFront(&cachedPartition{key: key, value: value, size: size})
+	c.size += size
+	for c.capacity > 0 && c.size > c.capacity {
+		c.removeElement(c.lru.Back())
+	}
+}
+
+// removeTable removes the partitions of the table.
+func (c *IndexCache) removeTable(tableID uint64, top *topIndex) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i := range top.indexPartitions {
+		if e, ok := c.items[partitionKey{tableID: tableID, idx: i}]; ok {
+			c.removeElement(e)
+		}
+	}
+	for i := range top.bloomPartitions {
+		if e, ok := c.items[partitionKey{tableID: tableID, bloom: true, idx: i}]; ok {
+			c.removeElement(e)
+		}
+	}
+}
+
+func (c *IndexCache) removeElement(e *list.Element) {
+	p := c.lru.Remove(e).(*cachedPartition)
+	delete(c.items, p.key)
+	c.size -= p.size
+}
+
+func (t *Table) isPartitioned() bool {
+	return t.props.NumIndexPartitions > 0
+}
+
+// indexPartition reads the index partition, the tables which are memory mapped or loaded to RAM
+// decode it from the memory without caching.
+func (t *Table) indexPartition(i int) *blockIndex {
+	key := partitionKey{tableID: t.id, idx: i}
+	if v, ok := t.indexCache.get(key); ok {
+		return v.(*blockIndex)
+	}
+	h := t.top.indexPartitions[i]
+	idx := decodeBlockIndex(t.readNoFail(int(h.offset), int(h.length)))
+	if len(t.mmap) == 0 {
+		t.indexCache.put(key, idx, int64(h.length))
+	}
+	return idx
+}
+
+func (t *Table) bloomPartition(i int) filter {
+	key := partitionKey{tableID: t.id, bloom: true, idx: i}
+	if v, ok := t.indexCache.get(key); ok {
+		return v.(filter)
+	}
+	h := t.top.bloomPartitions[i]
+	bf := decodeFilter(t.filterType, t.readNoFail(int(h.offset), int(h.length)))
+	if len(t.mmap) == 0 {
+		t.indexCache.put(key, bf, int64(h.length))
+	}
+	return bf
+}
@@ -0,0 +1,171 @@
+/*
+ * Copyright 2026 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package table
+
+import (
+	"encoding/binary"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/pingcap/errors"
+)
+
+// The footer of a table with properties is
+// | ... | hash index | properties | properties len (4 bytes) | filter type (4 bytes) | format version (4 bytes) | magic (4 bytes) | global ts (8 bytes) |
+// The filter type is written since version 3, the filter of the earlier versions is bbloom.
+// Tables written before the properties were introduced end with the hash index and the global ts.
+// The magic can not be confused with the number of hash buckets of those tables, because the
+// number of buckets is always less than a third of the table size.
+const (
+	footerMagic uint32 = 0xBADC0FFE
+	// Version 1 added the properties, version 2 changed the hash index, see hashIndexVersion,
+	// version 3 added the filter type.
+	formatVersion     uint32 = 3
+	filterTypeVersion uint32 = 3
+)
+
+// The names of the built-in properties have the prefix, the other properties are user properties.
+const propPrefix = "badger."
+
+const (
+	propNumEntries = "badger.num_entries"
+	propNumDeletes = "badger.num_deletes"
+	propMinVersion = "badger.min_version"
+	propMaxVersion = "badger.max_version"
+	propCreatedAt  = "badger.created_at"
+	propBlobSize   = "badger.blob_size"
+
+	propIndexPartitions = "badger.index_partitions"
+)
+
+// Properties are the statistics of a table recorded by the Builder.
+type Properties struct {
+	// NumEntries is the number of entries including all the versions.
+	NumEntries uint64
+	// NumDeletes is the number of the deletion tombstones.
+	NumDeletes uint64
+	// MinVersion and MaxVersion are the version range of the entries.
+	MinVersion uint64
+	MaxVersion uint64
+	// CreatedAt is the unix time in seconds when the table was built.
+	CreatedAt int64
+	// BlobSize is the total size of the values stored in blob files referenced by the table.
+	BlobSize uint64
+	// NumIndexPartitions is the number of index partitions, it is 0 if the index is not partitioned.
+	NumIndexPartitions uint64
+	// UserProperties are collected by the TablePropertiesCollector.
+	UserProperties map[string][]byte
+}
+
+// unknownProperties is used for the tables which don't have properties.
+var unknownProperties = Properties{MinVersion: 0, MaxVersion: math.MaxUint64}
+
+func (p *Properties) encode(buf []byte) []byte {
+	props := map[string]uint64{
+		propNumEntries: p.NumEntries,
+		propNumDeletes: p.NumDeletes,
+		propMinVersion: p.MinVersion,
+		propMaxVersion: p.MaxVersion,
+		propCreatedAt:  uint64(p.CreatedAt),
+		propBlobSize:   p.BlobSize,
+
+		propIndexPartitions: p.NumIndexPartitions,
+	}
+	names := make([]string, 0, len(props))
+	for name := range props {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var u64Buf [8]byte
+	for _, name := range names {
+		binary.LittleEndian.PutUint64(u64Buf[:], props[name])
+		buf = appendProperty(buf, name, u64Buf[:])
+	}
+	names = names[:0]
+	for name := range p.UserProperties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		buf = appendProperty(buf, name, p.UserProperties[name])
+	}
+	return buf
+}
+
+// appendProperty appends a property in the format of
+// | name len (2 bytes) | name | value len (4 bytes) | value |.
+func appendProperty(buf []byte, name string, val []byte) []byte {
+	var lenBuf [4]byte
+	binary.LittleEndian.PutUint16(lenBuf[:], uint16(len(name)))
+	buf = append(buf, lenBuf[:2]...)
+	buf = append(buf, name...)
+	binary.LittleEndian.PutUint32(lenBuf[:], uint32(len(val)))
+	buf = append(buf, lenBuf[:]...)
+	return append(buf, val...)
+}
+
+func (p *Properties) decode(data []byte) error {
+	*p = unknownProperties
+	for len(data) > 0 {
+		if len(data) < 2 {
+			return errors.New("table properties corrupted")
+		}
+		nameLen := int(binary.LittleEndian.Uint16(data))
+		data = data[2:]
+		if len(data) < nameLen+4 {
+			return errors.New("table properties corrupted")
+		}
+		name := string(data[:nameLen])
+		data = data[nameLen:]
+		valLen := int(binary.LittleEndian.Uint32(data))
+		data = data[4:]
+		if len(data) < valLen {
+			return errors.New("table properties corrupted")
+		}
+		val := data[:valLen]
+		data = data[valLen:]
+		if !strings.HasPrefix(name, propPrefix) {
+			if p.UserProperties == nil {
+				p.UserProperties = make(map[string][]byte)
+			}
+			p.UserProperties[name] = append([]byte(nil), val...)
+			continue
+		}
+		if valLen != 8 {
+			// Unknown properties written by newer versions are ignored.
+			continue
+		}
+		switch v := binary.LittleEndian.Uint64(val); name {
+		case propNumEntries:
+			p.NumEntries = v
+		case propNumDeletes:
+			p.NumDeletes = v
+		case propMinVersion:
+			p.MinVersion = v
+		case propMaxVersion:
+			p.MaxVersion = v
+		case propCreatedAt:
+			p.CreatedAt = int64(v)
+		case propBlobSize:
+			p.BlobSize = v
+		case propIndexPartitions:
+			p.NumIndexPartitions = v
+		}
+	}
+	return nil
+}
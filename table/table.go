@@ -31,7 +31,6 @@ import (
 	"github.com/coocood/badger/fileutil"
 	"github.com/coocood/badger/options"
 	"github.com/coocood/badger/y"
-	"github.com/coocood/bbloom"
 	"github.com/pingcap/errors"
 )
 
@@ -44,10 +43,11 @@ type Table struct {
 	fd        *os.File // Own fd.
 	tableSize int      // Initialized in OpenTable, using fd.Stat().
 
-	globalTs        uint64
-	blockEndOffsets []uint32
-	baseKeys        []byte
-	baseKeysEndOffs []uint32
+	globalTs uint64
+	index    blockIndex
+	// top is the top-level index of the tables with partitioned index and bloom filter.
+	top        topIndex
+	indexCache *IndexCache
 
 	ref int32 // For file garbage collection.  Atomic.
 
@@ -58,8 +58,11 @@ type Table struct {
 	smallest, biggest []byte // Smallest and largest keys.
 	id                uint64 // file id, part of filename
 
-	bf   bbloom.Bloom
-	hIdx hashIndex
+	bf         filter
+	filterType options.FilterType
+	filterSize int
+	hIdx       hashIndex
+	props      Properties
 }
 
 // IncrRef increments the refcount (having to do with whether the file should be deleted)
@@ -78,6 +81,9 @@ func (t *Table) DecrRef() error {
 		if t.loadingMode == options.MemoryMap {
 			y.Munmap(t.mmap)
 		}
+		if t.isPartitioned() {
+			t.indexCache.removeTable(t.id, &t.top)
+		}
 		if err := t.fd.Truncate(0); err != nil {
 			// This is very important to let the FS know that the file is deleted.
 			return err
@@ -103,6 +109,12 @@ type block struct {
 // -- consider t.Close() instead).  The fd has to writeable because we call Truncate on it before
 // deleting.
 func OpenTable(fd *os.File, loadingMode options.FileLoadingMode) (*Table, error) {
+	return OpenTableWithIndexCache(fd, loadingMode, nil)
+}
+
+// OpenTableWithIndexCache opens the table like OpenTable, the index and bloom filter partitions
+// read from the table are kept in the cache.
+func OpenTableWithIndexCache(fd *os.File, loadingMode options.FileLoadingMode, cache *IndexCache) (*Table, error) {
 	fileInfo, err := fd.Stat()
 	if err != nil {
 		// It's OK to ignore fd.Close() errs in this function because we have only read
@@ -122,6 +134,7 @@ func OpenTable(fd *os.File, loadingMode options.FileLoadingMode) (*Table, error)
 		ref:         1, // Caller is given one reference.
 		id:          id,
 		loadingMode: loadingMode,
+		indexCache:  cache,
 	}
 
 	t.tableSize = int(fileInfo.Size())
@@ -141,6 +154,10 @@ func OpenTable(fd *os.File, loadingMode options.FileLoadingMode) (*Table, error)
 	}
 
 	t.readIndex()
+	if t.props.CreatedAt == 0 {
+		// The tables built before properties were introduced.
+		t.props.CreatedAt = fileInfo.ModTime().Unix()
+	}
 
 	it := t.NewIterator(false)
 	defer it.Close()
@@ -170,11 +187,43 @@ func (t *Table) Close() error {
 }
 
 // PointGet try to lookup a key and its value by table's hash index.
-// If it find an hash collision the last return value will be false,
-// which means caller should fallback to seek search. Otherwise it value will be true.
+// If the table has no hash index or its legacy hash index finds a collision, the last return value
+// will be false, which means caller should fallback to seek search. Otherwise it value will be true.
 // If the hash index does not contain such an element the returned key will be nil.
 func (t *Table) PointGet(key []byte, keyHash uint64) ([]byte, y.ValueStruct, bool) {
-	blkIdx, offset := t.hIdx.lookup(keyHash)
+	if t.hIdx.numBuckets == 0 {
+		return nil, y.ValueStruct{}, false
+	}
+	if t.hIdx.legacy {
+		return t.pointGetLegacy(key, keyHash)
+	}
+
+	it := t.NewIteratorNoRef(false)
+	fp := fingerprint(keyHash)
+	idx := int(keyHash % uint64(t.hIdx.numBuckets))
+	for n := 0; n < t.hIdx.numBuckets; n++ {
+		blkIdx, offset, slotFp := t.hIdx.slot(idx)
+		if blkIdx == emptySlot {
+			break
+		}
+		// A slot of another key may lead to the key too, because the seek goes forward from the
+		// slot, so it's enough to check the result.
+		if slotFp == fp {
+			it.seekFromOffset(int(blkIdx), int(offset), key)
+			if it.Valid() && y.SameKey(key, it.Key()) {
+				return it.Key(), it.Value(), true
+			}
+		}
+		idx++
+		if idx == t.hIdx.numBuckets {
+			idx = 0
+		}
+	}
+	return nil, y.ValueStruct{}, true
+}
+
+func (t *Table) pointGetLegacy(key []byte, keyHash uint64) ([]byte, y.ValueStruct, bool) {
+	blkIdx, offset := t.hIdx.lookupLegacy(keyHash)
 	if blkIdx == resultFallback {
 		return nil, y.ValueStruct{}, false
 	}
@@ -217,14 +266,43 @@ func (t *Table) readIndex() {
 	buf := t.readNoFail(readPos, 8)
 	t.globalTs = binary.BigEndian.Uint64(buf)
 
+	t.props = unknownProperties
+	legacyHashIndex := true
+	if readPos >= 4 && bytesToU32(t.readNoFail(readPos-4, 4)) == footerMagic {
+		readPos -= 8
+		version := bytesToU32(t.readNoFail(readPos, 4))
+		legacyHashIndex = version < hashIndexVersion
+		if version >= filterTypeVersion {
+			readPos -= 4
+			t.filterType = options.FilterType(bytesToU32(t.readNoFail(readPos, 4)))
+		}
+		readPos -= 4
+		buf = t.readNoFail(readPos, 4)
+		propsLen := int(bytesToU32(buf))
+		readPos -= propsLen
+		y.Check(t.props.decode(t.readNoFail(readPos, propsLen)))
+	}
+
 	readPos -= 4
 	buf = t.readNoFail(readPos, 4)
 	numBuckets := int(bytesToU32(buf))
+	if t.isPartitioned() {
+		readPos -= 4
+		topLen := int(bytesToU32(t.readNoFail(readPos, 4)))
+		readPos -= topLen
+		// Copy the top-level index, it is the only part of the index which stays in memory.
+		t.top.decode(append([]byte(nil), t.readNoFail(readPos, topLen)...))
+		return
+	}
 	if numBuckets != 0 {
-		hashLen := numBuckets * 3
+		bucketSize := slotSize
+		if legacyHashIndex {
+			bucketSize = legacyBucketSize
+		}
+		hashLen := numBuckets * bucketSize
 		readPos -= hashLen
 		buckets := t.readNoFail(readPos, hashLen)
-		t.hIdx.readIndex(buckets, numBuckets)
+		t.hIdx.readIndex(buckets, numBuckets, legacyHashIndex)
 	}
 
 	// Read bloom filter.
@@ -233,7 +311,8 @@ func (t *Table) readIndex() {
 	bloomLen := int(bytesToU32(buf))
 	readPos -= bloomLen
 	data := t.readNoFail(readPos, bloomLen)
-	t.bf.BinaryUnmarshal(data)
+	t.bf = decodeFilter(t.filterType, data)
+	t.filterSize = bloomLen
 
 	readPos -= 4
 	buf = t.readNoFail(readPos, 4)
@@ -241,27 +320,46 @@ func (t *Table) readIndex() {
 
 	readPos -= 4 * numBlocks
 	buf = t.readNoFail(readPos, 4*numBlocks)
-	t.baseKeysEndOffs = bytesToU32Slice(buf)
+	t.index.baseKeysEndOffs = bytesToU32Slice(buf)
 
-	baseKeyBufLen := int(t.baseKeysEndOffs[numBlocks-1])
+	baseKeyBufLen := int(t.index.baseKeysEndOffs[numBlocks-1])
 	readPos -= baseKeyBufLen
-	t.baseKeys = t.readNoFail(readPos, baseKeyBufLen)
+	t.index.baseKeys = t.readNoFail(readPos, baseKeyBufLen)
 
 	readPos -= 4 * numBlocks
 	buf = t.readNoFail(readPos, 4*numBlocks)
-	t.blockEndOffsets = bytesToU32Slice(buf)
+	t.index.endOffsets = bytesToU32Slice(buf)
+}
+
+func (t *Table) numBlocks() int {
+	if t.isPartitioned() {
+		return t.top.numBlocks
+	}
+	return t.index.numBlocks()
+}
+
+// blockRange returns the start offset and the end offset of the block.
+func (t *Table) blockRange(idx int) (int, int) {
+	index, localIdx := &t.index, idx
+	var startOffset int
+	if t.isPartitioned() {
+		p := t.top.indexPartitionOf(idx)
+		h := t.top.indexPartitions[p]
+		index, localIdx = t.indexPartition(p), idx-int(h.firstBlock)
+		startOffset = int(h.dataOffset)
+	}
+	if localIdx > 0 {
+		startOffset = int(index.endOffsets[localIdx-1])
+	}
+	return startOffset, int(index.endOffsets[localIdx])
 }
 
 func (t *Table) block(idx int) (block, error) {
 	y.Assert(idx >= 0)
-	if idx >= len(t.blockEndOffsets) {
+	if idx >= t.numBlocks() {
 		return block{}, errors.New("block out of index")
 	}
-	var startOffset int
-	if idx > 0 {
-		startOffset = int(t.blockEndOffsets[idx-1])
-	}
-	endOffset := int(t.blockEndOffsets[idx])
+	startOffset, endOffset := t.blockRange(idx)
 	blk := block{
 		offset: startOffset,
 	}
@@ -270,26 +368,68 @@ func (t *Table) block(idx int) (block, error) {
 	return blk, err
 }
 
-/*
+// ApproximateSizeInRange returns the approximate size of the data in [start, end) of the table,
+// it is estimated by the block offsets so it does not read any block. An empty start or end means
+// the range is unbounded on that side.
 func (t *Table) ApproximateSizeInRange(start, end []byte) int {
 	it := t.NewIteratorNoRef(false)
-	startOff, endOff := t.approximateOffset(it, start), t.approximateOffset(it, end)
+	startOff, endOff := 0, t.dataSize()
+	if len(start) > 0 {
+		startOff = t.approximateOffset(it, start)
+	}
+	if len(end) > 0 {
+		endOff = t.approximateOffset(it, end)
+	}
 	return endOff - startOff
 }
 
+// ApproximateNumEntriesInRange returns the approximate number of entries in [start, end) of the table,
+// it assumes the entries are evenly distributed in the data blocks.
+func (t *Table) ApproximateNumEntriesInRange(start, end []byte) int {
+	dataSize := t.dataSize()
+	if dataSize == 0 {
+		return 0
+	}
+	return int(t.props.NumEntries * uint64(t.ApproximateSizeInRange(start, end)) / uint64(dataSize))
+}
+
+// dataSize returns the size of all the data blocks.
+func (t *Table) dataSize() int {
+	if t.isPartitioned() {
+		// The index partitions follow the data blocks.
+		return int(t.top.indexPartitions[0].offset)
+	}
+	if t.index.numBlocks() == 0 {
+		return 0
+	}
+	return int(t.index.endOffsets[t.index.numBlocks()-1])
+}
+
 func (t *Table) approximateOffset(it *Iterator, key []byte) int {
 	if y.CompareKeysWithVer(t.Biggest(), key) < 0 {
-		return int(t.blockEndOffsets[len(t.blockEndOffsets)-1])
+		return t.dataSize()
 	} else if y.CompareKeysWithVer(t.Smallest(), key) > 0 {
 		return 0
 	}
 	blk := it.seekBlock(key)
 	if blk != 0 {
-		return int(t.blockEndOffsets[blk-1])
+		_, end := t.blockRange(blk - 1)
+		return end
 	}
 	return 0
 }
-*/
+
+// Properties returns the properties recorded when the table was built. The version range
+// of the tables which have global ts is the global ts.
+func (t *Table) Properties() Properties {
+	props := t.props
+	if t.HasGlobalTs() {
+		// globalTs is encoded in the same way as the timestamps in keys.
+		version := math.MaxUint64 - t.globalTs
+		props.MinVersion, props.MaxVersion = version, version
+	}
+	return props
+}
 
 // HasGlobalTs returns table does set global ts.
 func (t *Table) HasGlobalTs() bool {
@@ -326,9 +466,27 @@ func (t *Table) Filename() string { return t.fd.Name() }
 // ID is the table's ID number (used to make the file name).
 func (t *Table) ID() uint64 { return t.id }
 
+// FilterSize returns the size of the filter of the table, the partitions of the tables with
+// partitioned index and bloom filter are counted.
+func (t *Table) FilterSize() int {
+	if t.isPartitioned() {
+		var size int
+		for _, h := range t.top.bloomPartitions {
+			size += int(h.length)
+		}
+		return size
+	}
+	return t.filterSize
+}
+
 // DoesNotHave returns true if (but not "only if") the table does not have the key.  It does a
 // bloom filter lookup.
-func (t *Table) DoesNotHave(keyHash uint64) bool { return !t.bf.Has(keyHash) }
+func (t *Table) DoesNotHave(keyHash uint64) bool {
+	if t.isPartitioned() {
+		return !t.bloomPartition(bloomPartitionOf(keyHash, len(t.top.bloomPartitions))).mayContain(keyHash)
+	}
+	return !t.bf.mayContain(keyHash)
+}
 
 // ParseFileID reads the file id out of a filename.
 func ParseFileID(name string) (uint64, bool) {
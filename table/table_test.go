@@ -18,12 +18,14 @@ package table
 
 import (
 	"bytes"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"math"
 	"math/rand"
 	"os"
 	"sort"
+	"strconv"
 	"testing"
 
 	"github.com/coocood/badger/options"
@@ -63,6 +65,10 @@ func buildTestTable(t *testing.T, prefix string, n int) *os.File {
 
 // keyValues is n by 2 where n is number of pairs.
 func buildTable(t *testing.T, keyValues [][]string) *os.File {
+	return buildTableWithOpt(t, keyValues, defaultBuilderOpt)
+}
+
+func buildTableWithOpt(t *testing.T, keyValues [][]string, opt options.TableBuilderOptions) *os.File {
 	// TODO: Add test for file garbage collection here. No files should be left after the tests here.
 
 	filename := fmt.Sprintf("%s%s%x.sst", os.TempDir(), string(os.PathSeparator), rand.Int63())
@@ -72,7 +78,7 @@ func buildTable(t *testing.T, keyValues [][]string) *os.File {
 	} else {
 		y.Check(err)
 	}
-	b := NewTableBuilder(f, rate.NewLimiter(rate.Inf, math.MaxInt32), 0, defaultBuilderOpt)
+	b := NewTableBuilder(f, rate.NewLimiter(rate.Inf, math.MaxInt32), 0, opt)
 
 	sort.Slice(keyValues, func(i, j int) bool {
 		return keyValues[i][0] < keyValues[j][0]
@@ -152,6 +158,150 @@ func TestHashIndexTS(t *testing.T) {
 	require.True(t, bytes.Compare(rk, keys[4]) == 0)
 }
 
+func buildMultiVersionTable(t *testing.T, n int) *Table {
+	filename := fmt.Sprintf("%s%s%x.sst", os.TempDir(), string(os.PathSeparator), rand.Int63())
+	f, err := y.OpenSyncedFile(filename, true)
+	require.NoError(t, err)
+	b := NewTableBuilder(f, nil, 0, defaultBuilderOpt)
+	for i := 0; i < n; i++ {
+		// 3 versions of each key make some keys cross the blocks.
+		for _, ts := range []uint64{9, 6, 3} {
+			k := y.KeyWithTs([]byte(key("key", i)), ts)
+			require.NoError(t, b.Add(k, y.ValueStruct{Value: k, UserMeta: []byte{0}}))
+		}
+	}
+	require.NoError(t, b.Finish())
+	f.Close()
+	f, err = y.OpenSyncedFile(filename, true)
+	require.NoError(t, err)
+	tbl, err := OpenTable(f, options.MemoryMap)
+	require.NoError(t, err)
+	return tbl
+}
+
+func checkPointGet(t *testing.T, tbl *Table, n int, allowFallback bool) {
+	for i := 0; i < n+100; i++ {
+		keyHash := farm.Fingerprint64([]byte(key("key", i)))
+		for _, ts := range []uint64{10, 7, 4, 2} {
+			k := y.KeyWithTs([]byte(key("key", i)), ts)
+			rk, _, ok := tbl.PointGet(k, keyHash)
+			if !ok {
+				require.True(t, allowFallback)
+				continue
+			}
+			if i >= n || ts == 2 {
+				if rk != nil {
+					require.False(t, y.SameKey(k, rk))
+				}
+				continue
+			}
+			require.Equal(t, y.KeyWithTs([]byte(key("key", i)), ts-1), rk)
+		}
+	}
+}
+
+func TestPointGetMultiVersions(t *testing.T) {
+	n := 3000
+	tbl := buildMultiVersionTable(t, n)
+	defer tbl.DecrRef()
+	require.False(t, tbl.hIdx.legacy)
+	checkPointGet(t, tbl, n, false)
+
+	tbl.hIdx = legacyHashIndex(tbl, defaultBuilderOpt.HashUtilRatio)
+	checkPointGet(t, tbl, n, true)
+}
+
+// legacyHashIndex builds the hash index of the format versions before hashIndexVersion for tbl.
+func legacyHashIndex(tbl *Table, hashUtilRatio float32) hashIndex {
+	var entries []hashEntry
+	it := tbl.NewIteratorNoRef(false)
+	for it.Rewind(); it.Valid(); it.Next() {
+		keyHash := farm.Fingerprint64(y.ParseKey(it.Key()))
+		entries = append(entries, hashEntry{keyHash, uint32(it.bpos), uint16(it.bi.idx)})
+	}
+	numBuckets := uint32(float32(len(entries)) / hashUtilRatio)
+	buckets := make([]byte, numBuckets*legacyBucketSize)
+	for i := 0; i < int(numBuckets); i++ {
+		binary.LittleEndian.PutUint16(buckets[i*legacyBucketSize:], resultNoEntry)
+	}
+	for _, h := range entries {
+		idx := h.hash % uint64(numBuckets)
+		bucket := buckets[idx*legacyBucketSize : (idx+1)*legacyBucketSize]
+		blkIdx := binary.LittleEndian.Uint16(bucket[:2])
+		if blkIdx == resultNoEntry {
+			binary.LittleEndian.PutUint16(bucket[:2], uint16(h.blockIdx))
+			bucket[2] = uint8(h.offset)
+		} else if blkIdx != uint16(h.blockIdx) {
+			binary.LittleEndian.PutUint16(bucket[:2], resultFallback)
+		}
+	}
+	var idx hashIndex
+	idx.readIndex(buckets, int(numBuckets), true)
+	return idx
+}
+
+type testPropsCollector struct {
+	numKeys, numDeletes int
+}
+
+func (c *testPropsCollector) Add(key, value, userMeta []byte, deleted bool) {
+	c.numKeys++
+	if deleted {
+		c.numDeletes++
+	}
+}
+
+func (c *testPropsCollector) Finish() map[string][]byte {
+	return map[string][]byte{
+		"test.num_keys":    []byte(strconv.Itoa(c.numKeys)),
+		"test.num_deletes": []byte(strconv.Itoa(c.numDeletes)),
+	}
+}
+
+func TestTableProperties(t *testing.T) {
+	filename := fmt.Sprintf("%s%s%x.sst", os.TempDir(), string(os.PathSeparator), rand.Int63())
+	f, err := y.OpenSyncedFile(filename, true)
+	require.NoError(t, err)
+	opt := defaultBuilderOpt
+	opt.TablePropertiesCollectorFactory = func() options.TablePropertiesCollector {
+		return new(testPropsCollector)
+	}
+	b := NewTableBuilder(f, nil, 0, opt)
+	for i := 0; i < 1000; i++ {
+		k := y.KeyWithTs([]byte(key("key", i)), uint64(i%100+10))
+		var meta byte
+		if i%10 == 0 {
+			meta = y.BitDelete
+		}
+		require.NoError(t, b.Add(k, y.ValueStruct{Value: k, Meta: meta, UserMeta: []byte{0}}))
+	}
+	require.NoError(t, b.Finish())
+	f.Close()
+	f, _ = y.OpenSyncedFile(filename, true)
+	table, err := OpenTable(f, options.MemoryMap)
+	require.NoError(t, err)
+	defer table.DecrRef()
+
+	props := table.Properties()
+	require.Equal(t, uint64(1000), props.NumEntries)
+	require.Equal(t, uint64(100), props.NumDeletes)
+	require.Equal(t, map[string][]byte{
+		"test.num_keys":    []byte("1000"),
+		"test.num_deletes": []byte("100"),
+	}, props.UserProperties)
+	require.Equal(t, uint64(10), props.MinVersion)
+	require.Equal(t, uint64(109), props.MaxVersion)
+	require.True(t, props.CreatedAt > 0)
+
+	it := table.NewIterator(false)
+	defer it.Close()
+	var count int
+	for it.Rewind(); it.Valid(); it.Next() {
+		count++
+	}
+	require.Equal(t, 1000, count)
+}
+
 func TestPointGet(t *testing.T) {
 	f := buildTestTable(t, "key", 8000)
 	table, err := OpenTable(f, options.MemoryMap)
@@ -219,6 +369,10 @@ func TestExternalTable(t *testing.T) {
 	table, err = OpenTable(f, options.MemoryMap)
 	require.NoError(t, err)
 	defer table.DecrRef()
+	props := table.Properties()
+	require.Equal(t, uint64(n), props.NumEntries)
+	require.Equal(t, uint64(10), props.MinVersion)
+	require.Equal(t, uint64(10), props.MaxVersion)
 
 	it := table.NewIterator(false)
 	defer it.Close()
@@ -309,6 +463,113 @@ func TestSeek(t *testing.T) {
 	}
 }
 
+func TestPartitionedTable(t *testing.T) {
+	opt := defaultBuilderOpt
+	opt.IndexPartitionSize = 256
+	f := buildTableWithOpt(t, generateKeyValues("k", 10000), opt)
+	cache := NewIndexCache(4 << 10)
+	table, err := OpenTableWithIndexCache(f, options.FileIO, cache)
+	require.NoError(t, err)
+	defer table.DecrRef()
+	require.True(t, table.Properties().NumIndexPartitions > 1)
+	require.True(t, len(table.top.bloomPartitions) > 1)
+	require.Equal(t, 0, table.hIdx.numBuckets)
+
+	it := table.NewIterator(false)
+	defer it.Close()
+	var count int
+	for it.Rewind(); it.Valid(); it.Next() {
+		require.EqualValues(t, key("k", count), string(y.ParseKey(it.Key())))
+		count++
+	}
+	require.Equal(t, 10000, count)
+
+	rit := table.NewIterator(true)
+	defer rit.Close()
+	for rit.Rewind(); rit.Valid(); rit.Next() {
+		count--
+		require.EqualValues(t, key("k", count), string(y.ParseKey(rit.Key())))
+	}
+	require.Equal(t, 0, count)
+
+	var falsePositives int
+	for i := 0; i < 10000; i++ {
+		k := y.KeyWithTs([]byte(key("k", i)), 0)
+		require.False(t, table.DoesNotHave(farm.Fingerprint64(y.ParseKey(k))))
+		it.Seek(k)
+		require.True(t, it.Valid())
+		require.Equal(t, k, it.Key())
+		if !table.DoesNotHave(farm.Fingerprint64([]byte(key("x", i)))) {
+			falsePositives++
+		}
+	}
+	require.True(t, falsePositives < 100)
+	require.True(t, cache.Size() > 0)
+	require.True(t, cache.Size() <= 4<<10)
+
+	it.Seek(y.KeyWithTs([]byte("z"), 0))
+	require.False(t, it.Valid())
+	it.Seek(y.KeyWithTs([]byte("k1234b"), 0))
+	require.EqualValues(t, "k1235", string(y.ParseKey(it.Key())))
+	require.Equal(t, table.dataSize(), table.ApproximateSizeInRange(nil, nil))
+	require.True(t, table.ApproximateSizeInRange(y.KeyWithTs([]byte("k5000"), 0), nil) < table.dataSize())
+}
+
+func TestFilters(t *testing.T) {
+	const n = 10000
+	entries := make([]hashEntry, 0, 2*n)
+	for i := 0; i < n; i++ {
+		hash := farm.Fingerprint64([]byte(key("key", i)))
+		// The versions of a key have the same hash.
+		entries = append(entries, hashEntry{hash: hash}, hashEntry{hash: hash})
+	}
+	for _, filterType := range []options.FilterType{options.BBloomFilter, options.BlockedBloomFilter, options.RibbonFilter} {
+		for _, fpr := range []float64{0.01, 0.001} {
+			data := buildFilter(filterType, entries, fpr)
+			bf := decodeFilter(filterType, data)
+			for _, he := range entries {
+				require.True(t, bf.mayContain(he.hash))
+			}
+			var falsePositives int
+			for i := 0; i < 100*n; i++ {
+				if bf.mayContain(farm.Fingerprint64([]byte(key("missing", i)))) {
+					falsePositives++
+				}
+			}
+			actual := float64(falsePositives) / (100 * n)
+			t.Logf("filter %d fpr %v: %.2f bits per key, actual fpr %.5f", filterType, fpr, float64(len(data)*8)/n, actual)
+			require.True(t, actual < 2*fpr)
+		}
+	}
+
+	empty := decodeFilter(options.RibbonFilter, buildFilter(options.RibbonFilter, nil, 0.01))
+	require.False(t, empty.mayContain(farm.Fingerprint64([]byte("key"))))
+}
+
+func TestTableFilterType(t *testing.T) {
+	for _, partitionSize := range []int{0, 256} {
+		for _, filterType := range []options.FilterType{options.BlockedBloomFilter, options.RibbonFilter} {
+			opt := defaultBuilderOpt
+			opt.FilterType = filterType
+			opt.IndexPartitionSize = partitionSize
+			f := buildTableWithOpt(t, generateKeyValues("k", 10000), opt)
+			table, err := OpenTable(f, options.MemoryMap)
+			require.NoError(t, err)
+			require.Equal(t, filterType, table.filterType)
+			require.True(t, table.FilterSize() > 0)
+			var falsePositives int
+			for i := 0; i < 10000; i++ {
+				require.False(t, table.DoesNotHave(farm.Fingerprint64([]byte(key("k", i)))))
+				if !table.DoesNotHave(farm.Fingerprint64([]byte(key("x", i)))) {
+					falsePositives++
+				}
+			}
+			require.True(t, falsePositives < 100)
+			table.DecrRef()
+		}
+	}
+}
+
 func TestSeekForPrev(t *testing.T) {
 	f := buildTestTable(t, "k", 10000)
 	table, err := OpenTable(f, options.MemoryMap)
@@ -761,7 +1022,7 @@ func TestMergingIteratorTakeTwo(t *testing.T) {
 
 func BenchmarkRead(b *testing.B) {
 	n := 5 << 20
-	filename := fmt.Sprintf("%s%s%d.sst", os.TempDir(), string(os.PathSeparator), rand.Int63())
+	filename := fmt.Sprintf("%s%s%x.sst", os.TempDir(), string(os.PathSeparator), rand.Int63())
 	f, err := y.OpenSyncedFile(filename, true)
 	y.Check(err)
 	builder := NewTableBuilder(f, nil, 0, defaultBuilderOpt)
@@ -800,7 +1061,7 @@ func BenchmarkBuildTable(b *testing.B) {
 		b.ResetTimer()
 
 		b.Run(fmt.Sprintf("NoHash_%d", n), func(b *testing.B) {
-			filename := fmt.Sprintf("%s%s%d.sst", os.TempDir(), string(os.PathSeparator), rand.Int63())
+			filename := fmt.Sprintf("%s%s%x.sst", os.TempDir(), string(os.PathSeparator), rand.Int63())
 			f, err := y.OpenSyncedFile(filename, false)
 			y.Check(err)
 			opt := defaultBuilderOpt
@@ -817,7 +1078,7 @@ func BenchmarkBuildTable(b *testing.B) {
 		})
 
 		b.Run(fmt.Sprintf("Hash_%d", n), func(b *testing.B) {
-			filename := fmt.Sprintf("%s%s%d.sst", os.TempDir(), string(os.PathSeparator), rand.Int63())
+			filename := fmt.Sprintf("%s%s%x.sst", os.TempDir(), string(os.PathSeparator), rand.Int63())
 			f, err := y.OpenSyncedFile(filename, false)
 			y.Check(err)
 			for bn := 0; bn < b.N; bn++ {
@@ -836,7 +1097,7 @@ func BenchmarkBuildTable(b *testing.B) {
 func BenchmarkPointGet(b *testing.B) {
 	ns := []int{1000, 10000, 100000, 1000000, 5000000, 10000000, 15000000}
 	for _, n := range ns {
-		filename := fmt.Sprintf("%s%s%d.sst", os.TempDir(), string(os.PathSeparator), rand.Int63())
+		filename := fmt.Sprintf("%s%s%x.sst", os.TempDir(), string(os.PathSeparator), rand.Int63())
 		f, err := y.OpenSyncedFile(filename, true)
 		builder := NewTableBuilder(f, nil, 0, defaultBuilderOpt)
 		keys := make([][]byte, n)
@@ -874,11 +1135,12 @@ func BenchmarkPointGet(b *testing.B) {
 			_ = vs
 		})
 
-		b.Run(fmt.Sprintf("Hash_%d", n), func(b *testing.B) {
+		benchHash := func(b *testing.B) {
 			var (
 				resultKey []byte
 				resultVs  y.ValueStruct
 				ok        bool
+				fallbacks int
 			)
 			rand := rand.New(rand.NewSource(0))
 			for bn := 0; bn < b.N; bn++ {
@@ -888,6 +1150,7 @@ func BenchmarkPointGet(b *testing.B) {
 					keyHash := farm.Fingerprint64(y.ParseKey(k))
 					resultKey, resultVs, ok = tbl.PointGet(k, keyHash)
 					if !ok {
+						fallbacks++
 						it := tbl.NewIteratorNoRef(false)
 						it.Seek(k)
 						if !it.Valid() {
@@ -901,7 +1164,12 @@ func BenchmarkPointGet(b *testing.B) {
 				}
 			}
 			_, _ = resultKey, resultVs
-		})
+			b.ReportMetric(float64(fallbacks)/float64(b.N*n), "fallbacks/get")
+		}
+		b.Run(fmt.Sprintf("Hash_%d", n), benchHash)
+
+		tbl.hIdx = legacyHashIndex(tbl, defaultBuilderOpt.HashUtilRatio)
+		b.Run(fmt.Sprintf("LegacyHash_%d", n), benchHash)
 
 		tbl.DecrRef()
 	}
@@ -909,7 +1177,7 @@ func BenchmarkPointGet(b *testing.B) {
 
 func BenchmarkReadAndBuild(b *testing.B) {
 	n := 5 << 20
-	filename := fmt.Sprintf("%s%s%d.sst", os.TempDir(), string(os.PathSeparator), rand.Int63())
+	filename := fmt.Sprintf("%s%s%x.sst", os.TempDir(), string(os.PathSeparator), rand.Int63())
 	f, err := y.OpenSyncedFile(filename, false)
 	builder := NewTableBuilder(f, nil, 0, defaultBuilderOpt)
 	y.Check(err)
@@ -953,7 +1221,7 @@ func BenchmarkReadMerged(b *testing.B) {
 	tableSize := n / m
 	var tables []*Table
 	for i := 0; i < m; i++ {
-		filename := fmt.Sprintf("%s%s%d.sst", os.TempDir(), string(os.PathSeparator), rand.Int63())
+		filename := fmt.Sprintf("%s%s%x.sst", os.TempDir(), string(os.PathSeparator), rand.Int63())
 		f, err := y.OpenSyncedFile(filename, true)
 		y.Check(err)
 		builder := NewTableBuilder(f, nil, 0, defaultBuilderOpt)
@@ -32,6 +32,7 @@ import (
 type oracle struct {
 	// curRead must be at the top for memory alignment. See issue #311.
 	curRead   uint64 // Managed by the mutex.
+	discardTs uint64 // Used by the managed mode, accessed atomically.
 	refCount  int64
 	isManaged bool // Does not change value, so no locking required.
 
@@ -74,6 +75,23 @@ func (o *oracle) readTs() uint64 {
 	return atomic.LoadUint64(&o.curRead)
 }
 
+// discardAtOrBelow returns the timestamp at or below which compactions can discard the old versions.
+func (o *oracle) discardAtOrBelow() uint64 {
+	if !o.isManaged {
+		// The transactions at a snapshot begin below MinReadTS.
+		minReadTs := o.readMark.MinReadTS()
+		if minAliveReadTs := o.readMark.MinAliveReadTS(); minAliveReadTs < minReadTs {
+			return minAliveReadTs
+		}
+		return minReadTs
+	}
+	discardTs := atomic.LoadUint64(&o.discardTs)
+	if minReadTs := o.readMark.MinAliveReadTS(); minReadTs < discardTs {
+		return minReadTs
+	}
+	return discardTs
+}
+
 func (o *oracle) commitTs() uint64 {
 	o.Lock()
 	defer o.Unlock()
@@ -148,6 +166,7 @@ type Txn struct {
 	commitTs uint64
 
 	update bool     // update is used to conditionally keep track of reads.
+	sync   bool     // sync is used to sync the value log before the commit returns.
 	reads  []uint64 // contains fingerprints of keys read.
 	writes []uint64 // contains fingerprints of keys written.
 
@@ -259,6 +278,12 @@ func (txn *Txn) checkSize(e *Entry) error {
 	return nil
 }
 
+// SetSync overrides Options.SyncWrites for the transaction. If sync is true, Commit returns after
+// the writes are synced to disk, otherwise they may be lost if the machine crashes.
+func (txn *Txn) SetSync(sync bool) {
+	txn.sync = sync
+}
+
 // Set adds a key-value pair to the database.
 //
 // It will return ErrReadOnlyTxn if update flag was set to false when creating the
@@ -495,7 +520,7 @@ func (txn *Txn) Commit() error {
 	}
 	entries = append(entries, e)
 
-	req, err := txn.db.sendToWriteCh(entries)
+	req, err := txn.db.sendToWriteCh(entries, txn.sync)
 	state.writeLock.Unlock()
 	if err != nil {
 		return err
@@ -528,20 +553,26 @@ func (txn *Txn) Commit() error {
 //  defer txn.Discard()
 //  // Call various APIs.
 func (db *DB) NewTransaction(update bool) *Txn {
+	txn := db.newTransaction(update)
+	txn.wmNode = db.orc.readMark.Begin(db.orc.readTs())
+	txn.readTs = txn.wmNode.ReadTS
+	return txn
+}
+
+// newTransaction creates a transaction without read timestamp, the caller must set wmNode and readTs.
+func (db *DB) newTransaction(update bool) *Txn {
 	if db.opt.ReadOnly {
 		// DB is read-only, force read-only transaction.
 		update = false
 	}
-	readTS := db.orc.readTs()
 	txn := &Txn{
 		update: update,
+		sync:   db.opt.SyncWrites,
 		db:     db,
 		count:  1,                       // One extra entry for BitFin.
 		size:   int64(len(txnKey) + 10), // Some buffer for the extra entry.
 		refs:   RefMap{},
 	}
-	txn.wmNode = db.orc.readMark.Begin(readTS)
-	txn.readTs = txn.wmNode.ReadTS
 	if update {
 		txn.pendingWrites = make(map[string]*Entry)
 		txn.db.orc.addRef()
@@ -549,6 +580,21 @@ func (db *DB) NewTransaction(update bool) *Txn {
 	return txn
 }
 
+// NewTransactionAtSnapshot creates a read-only transaction which reads at the read timestamp of
+// the snapshot created by CreateSnapshot. It returns ErrSnapshotNotFound if the snapshot doesn't
+// exist.
+func (db *DB) NewTransactionAtSnapshot(name string) (*Txn, error) {
+	readTs, ok := db.manifest.getSnapshot(name)
+	if !ok {
+		return nil, ErrSnapshotNotFound
+	}
+	// The read mark keeps the versions of the snapshot even if it's released before the txn is done.
+	txn := db.newTransaction(false)
+	txn.wmNode = db.orc.readMark.BeginAt(readTs)
+	txn.readTs = readTs
+	return txn, nil
+}
+
 // View executes a function creating and managing a read-only transaction for the user. Error
 // returned by the function is relayed by the View method.
 func (db *DB) View(fn func(txn *Txn) error) error {
@@ -17,8 +17,10 @@
 package badger
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"math/rand"
 	"os"
 	"strconv"
@@ -29,6 +31,8 @@ import (
 
 	"github.com/coocood/badger/options"
 	"github.com/coocood/badger/y"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 
 	"github.com/stretchr/testify/require"
 )
@@ -791,6 +795,62 @@ func TestManagedDB(t *testing.T) {
 	txn.Discard()
 }
 
+func TestManagedDBDiscardTs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	opt := getTestOptions(dir)
+	kv, err := OpenManaged(opt)
+	require.NoError(t, err)
+	defer kv.Close()
+
+	key := []byte("key")
+	write := func(ts uint64) {
+		txn := kv.NewTransactionAt(ts, true)
+		require.NoError(t, txn.Set(key, []byte(fmt.Sprintf("val-%d", ts))))
+		require.NoError(t, txn.CommitAt(ts))
+	}
+	compact := func() {
+		wg, err := kv.flushMemTable()
+		require.NoError(t, err)
+		wg.Wait()
+		require.NoError(t, kv.CompactRange(nil, nil, CompactRangeOptions{}))
+	}
+	versions := func() (vers []uint64) {
+		txn := kv.NewTransactionAt(math.MaxUint64, false)
+		defer txn.Discard()
+		it := txn.NewIterator(IteratorOptions{AllVersions: true})
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			if bytes.Equal(it.Item().Key(), key) {
+				vers = append(vers, it.Item().Version())
+			}
+		}
+		return
+	}
+
+	for _, ts := range []uint64{10, 20, 30} {
+		write(ts)
+	}
+	reader := kv.NewTransactionAt(15, false)
+	kv.SetDiscardTs(25)
+	compact()
+	require.Equal(t, []uint64{30, 20, 10}, versions())
+	item, err := reader.Get(key)
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), item.Version())
+	reader.Discard()
+
+	write(40)
+	compact()
+	require.Equal(t, []uint64{40, 30, 20}, versions())
+
+	// A snapshot can't pin the versions which may have been discarded.
+	require.Equal(t, ErrInvalidRequest, kv.CreateSnapshotAt("old", 20))
+	require.NoError(t, kv.CreateSnapshotAt("new", 25))
+}
+
 func TestArmV7Issue311Fix(t *testing.T) {
 	dir, err := ioutil.TempDir("", "")
 	if err != nil {
@@ -882,3 +942,42 @@ func TestTxnMultiGet(t *testing.T) {
 		txn.Discard()
 	})
 }
+
+func TestTxnSync(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	opts.SyncWrites = false
+	runBadgerTest(t, &opts, func(t *testing.T, db *DB) {
+		numSyncs := func() uint64 {
+			var m dto.Metric
+			require.NoError(t, db.metrics.VlogSyncDuration.(prometheus.Histogram).Write(&m))
+			return m.GetHistogram().GetSampleCount()
+		}
+		commit := func(key string, sync bool) {
+			txn := db.NewTransaction(true)
+			txn.SetSync(sync)
+			require.NoError(t, txn.Set([]byte(key), []byte("value")))
+			require.NoError(t, txn.Commit())
+		}
+		// The value log is synced when the replay is done.
+		base := numSyncs()
+		commit("async", false)
+		require.Equal(t, base, numSyncs())
+		commit("sync", true)
+		require.Equal(t, base+1, numSyncs())
+		txnSet(t, db, []byte("default"), []byte("value"), 0)
+		require.Equal(t, base+1, numSyncs())
+		require.NoError(t, db.Sync())
+		require.Equal(t, base+2, numSyncs())
+
+		require.NoError(t, db.View(func(txn *Txn) error {
+			for _, key := range []string{"async", "sync", "default"} {
+				_, err := txn.Get([]byte(key))
+				require.NoError(t, err)
+			}
+			return nil
+		}))
+	})
+}
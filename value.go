@@ -30,18 +30,23 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/coocood/badger/fileutil"
 	"github.com/coocood/badger/options"
 	"github.com/coocood/badger/y"
+	"github.com/golang/snappy"
+	"github.com/ngaut/log"
 	"github.com/pingcap/errors"
 )
 
 // Values have their first byte being byteData or byteDelete. This helps us distinguish between
 // a key that has never been seen and a key that has been explicitly deleted.
 const (
-	bitDelete       byte = 1 << 0 // Set if the key has been deleted.
-	bitValuePointer byte = 1 << 1 // Set if the value is NOT stored directly next to key.
+	bitDelete       byte = y.BitDelete // Set if the key has been deleted.
+	bitValuePointer byte = 1 << 1      // Set if the value is NOT stored directly next to key.
+	bitSalted       byte = 1 << 4      // Set if the record header is followed by the salt of its file.
+	bitCompressed   byte = 1 << 5      // Set if the record is the compressed entries of a write request.
 
 	// The MSB 2 bits are for transactions.
 	bitTxn    byte = 1 << 6 // Set if the entry is part of a txn.
@@ -56,6 +61,19 @@ type logFile struct {
 	fid         uint32
 	size        uint32
 	loadingMode options.FileLoadingMode
+
+	// salted is set if the records of the file are salted with its fid.
+	salted bool
+}
+
+// isSalted reports whether the first record of the file is salted, which decides for the whole
+// file. The file must not be empty.
+func (lf *logFile) isSalted() (bool, error) {
+	var meta [1]byte
+	if _, err := lf.fd.ReadAt(meta[:], 0); err != nil {
+		return false, errors.Wrapf(err, "Unable to read the first record of %q", lf.path)
+	}
+	return ^meta[0]&bitSalted > 0, nil
 }
 
 // openReadOnly assumes that we have a write lock on logFile.
@@ -104,9 +122,54 @@ type safeRead struct {
 	um []byte
 
 	recordOffset uint32
+
+	// fid is the salt expected in salted records, salted is set once a salted record is read. The
+	// records that don't match are left by the previous incarnation of a recycled file.
+	fid    uint32
+	salted bool
+
+	// raw counts the bytes read of the current record, it tells the end of a corrupted record.
+	raw countingReader
+
+	// batch holds the remaining entries of the compressed record at batchOffset.
+	batch       bytes.Reader
+	batchBuf    []byte
+	batchOffset uint32
 }
 
+// Entry reads the next entry, the entries of a compressed record are returned one by one.
 func (r *safeRead) Entry(reader *bufio.Reader) (*Entry, error) {
+	if r.batch.Len() > 0 {
+		e, err := r.readEntry(&r.batch)
+		if err != nil {
+			// The compressed record has passed the checksum, the entries in it can't be truncated.
+			return nil, errors.Wrapf(err, "Unable to read compressed entries at offset %d", r.batchOffset)
+		}
+		e.offset = r.batchOffset
+		return e, nil
+	}
+	r.raw = countingReader{wrapped: reader}
+	e, err := r.readEntry(&r.raw)
+	if err != nil {
+		return nil, err
+	}
+	e.offset = r.recordOffset
+	r.recordOffset += uint32(r.raw.count)
+	if e.meta&bitCompressed == 0 {
+		return e, nil
+	}
+	if len(e.UserMeta) != 1 || options.CompressionType(e.UserMeta[0]) != options.Snappy {
+		return nil, errors.Errorf("Unknown value log compression %v at offset %d", e.UserMeta, e.offset)
+	}
+	if r.batchBuf, err = snappy.Decode(r.batchBuf[:cap(r.batchBuf)], e.Value); err != nil {
+		return nil, errors.Wrapf(err, "Unable to decompress entries at offset %d", e.offset)
+	}
+	r.batch.Reset(r.batchBuf)
+	r.batchOffset = e.offset
+	return r.Entry(reader)
+}
+
+func (r *safeRead) readEntry(reader io.Reader) (*Entry, error) {
 	var hbuf [headerBufSize]byte
 	var err error
 
@@ -123,6 +186,22 @@ func (r *safeRead) Entry(reader *bufio.Reader) (*Entry, error) {
 
 	var h header
 	h.Decode(hbuf[:])
+	if h.meta&bitSalted > 0 {
+		var saltBuf [saltSize]byte
+		if _, err = io.ReadFull(tee, saltBuf[:]); err != nil {
+			if err == io.EOF {
+				err = errTruncate
+			}
+			return nil, err
+		}
+		if binary.BigEndian.Uint32(saltBuf[:]) != r.fid {
+			return nil, io.EOF
+		}
+		r.salted = true
+		h.meta &^= bitSalted
+	} else if r.salted {
+		return nil, io.EOF
+	}
 	if h.klen > maxKeySize {
 		return nil, errTruncate
 	}
@@ -136,7 +215,6 @@ func (r *safeRead) Entry(reader *bufio.Reader) (*Entry, error) {
 	}
 
 	e := &Entry{}
-	e.offset = r.recordOffset
 	e.Key = r.k[:kl]
 	e.Value = r.v[:vl]
 	if h.umlen > 0 {
@@ -180,8 +258,9 @@ func (r *safeRead) Entry(reader *bufio.Reader) (*Entry, error) {
 }
 
 // iterate iterates over log file. It doesn't not allocate new memory for every kv pair.
-// Therefore, the kv pair is only valid for the duration of fn call.
-func (vlog *valueLog) iterate(lf *logFile, offset uint32, fn logEntry) (uint32, error) {
+// Therefore, the kv pair is only valid for the duration of fn call. It stops at the first
+// corrupted record if rec is nil, otherwise the corruption is handled by rec.
+func (vlog *valueLog) iterate(lf *logFile, offset uint32, rec *logRecovery, fn logEntry) (uint32, error) {
 	_, err := lf.fd.Seek(int64(offset), io.SeekStart)
 	if err != nil {
 		return 0, y.Wrap(err)
@@ -192,47 +271,114 @@ func (vlog *valueLog) iterate(lf *logFile, offset uint32, fn logEntry) (uint32,
 		k:            make([]byte, 10),
 		v:            make([]byte, 10),
 		recordOffset: offset,
+		fid:          lf.fid,
+	}
+	if offset > 0 {
+		if read.salted, err = lf.isSalted(); err != nil {
+			return 0, err
+		}
 	}
 
 	var lastCommit uint64
+	// resynced is set after skipping a corruption, the entries up to the next txn boundary are
+	// dropped as the txn may be broken by the corruption. droppedTs is the txn being dropped.
+	var resynced bool
+	var droppedTs uint64
+	// tailEnd is the end of the records dropped from the tail.
+	var tailEnd uint32
 	validEndOffset := read.recordOffset
 	for {
 		e, err := read.Entry(reader)
 		if err == io.EOF {
 			break
-		} else if err == io.ErrUnexpectedEOF || err == errTruncate {
-			break
-		} else if err != nil {
+		}
+		corrupted := err == io.ErrUnexpectedEOF || err == errTruncate
+		if err != nil && !corrupted {
 			return validEndOffset, err
-		} else if e == nil {
-			continue
+		}
+		corruptedOffset := read.recordOffset
+		var lostBlob bool
+		if !corrupted {
+			corruptedOffset = e.offset
+			// The value is lost with the end of the blob file if it's not there, so are the values
+			// after it.
+			lostBlob = e.meta&bitValuePointer > 0 && !vlog.kv.blobManger.hasValue(e.Value)
+			corrupted = lostBlob
 		}
 
-		read.recordOffset += uint32(headerBufSize + len(e.Key) + len(e.Value) + len(e.UserMeta) + 4) // len(crcBuf)
+		if !corrupted && resynced {
+			if e.meta&bitTxn > 0 {
+				if txnTs := y.ParseTs(e.Key); txnTs != droppedTs {
+					droppedTs = txnTs
+					rec.lostTxn(txnTs)
+				}
+				continue
+			}
+			resynced = false
+			if e.meta&bitFinTxn > 0 {
+				if txnTs, err := strconv.ParseUint(string(e.Value), 10, 64); err == nil && txnTs != droppedTs {
+					rec.lostTxn(txnTs)
+				}
+				validEndOffset = read.recordOffset
+				continue
+			}
+		}
 
-		if e.meta&bitTxn > 0 {
+		switch {
+		case corrupted:
+		case e.meta&bitTxn > 0:
 			txnTs := y.ParseTs(e.Key)
 			if lastCommit == 0 {
 				lastCommit = txnTs
 			}
-			if lastCommit != txnTs {
+			corrupted = lastCommit != txnTs
+		case e.meta&bitFinTxn > 0:
+			txnTs, err := strconv.ParseUint(string(e.Value), 10, 64)
+			corrupted = err != nil || lastCommit != txnTs
+			if !corrupted {
+				// Got the end of txn. Now we can store them.
+				lastCommit = 0
+				validEndOffset = read.recordOffset
+			}
+		default:
+			// This is most likely an entry which was moved as part of GC.
+			// We shouldn't get this entry in the middle of a transaction.
+			corrupted = lastCommit != 0
+			if !corrupted {
+				validEndOffset = read.recordOffset
+			}
+		}
+
+		if corrupted {
+			if rec == nil {
 				break
 			}
-		} else if e.meta&bitFinTxn > 0 {
-			txnTs, err := strconv.ParseUint(string(e.Value), 10, 64)
-			if err != nil || lastCommit != txnTs {
+			var next uint32
+			var ok bool
+			if !lostBlob {
+				if next, ok, err = rec.skip(vlog, lf, corruptedOffset, read.salted); err != nil {
+					return validEndOffset, err
+				}
+			}
+			if !ok {
+				tailEnd = read.recordOffset
+				if corruptedOffset == read.recordOffset {
+					tailEnd += uint32(read.raw.count)
+				}
 				break
 			}
-			// Got the end of txn. Now we can store them.
-			lastCommit = 0
-			validEndOffset = read.recordOffset
-		} else {
 			if lastCommit != 0 {
-				// This is most likely an entry which was moved as part of GC.
-				// We shouldn't get this entry in the middle of a transaction.
-				break
+				rec.lostTxn(lastCommit)
+				lastCommit = 0
+			}
+			if _, err = lf.fd.Seek(int64(next), io.SeekStart); err != nil {
+				return validEndOffset, y.Wrap(err)
 			}
-			validEndOffset = read.recordOffset
+			reader.Reset(lf.fd)
+			read.batch.Reset(nil)
+			read.recordOffset = next
+			resynced, droppedTs = true, 0
+			continue
 		}
 
 		if vlog.opt.ReadOnly {
@@ -246,7 +392,18 @@ func (vlog *valueLog) iterate(lf *logFile, offset uint32, fn logEntry) (uint32,
 		}
 	}
 
-	return validEndOffset, nil
+	if rec == nil {
+		return validEndOffset, nil
+	}
+	// torn is set if the records are intact but the last txn misses its end.
+	var torn bool
+	if lastCommit != 0 {
+		rec.lostTxn(lastCommit)
+		if tailEnd == 0 {
+			tailEnd, torn = read.recordOffset, true
+		}
+	}
+	return validEndOffset, rec.dropTail(lf, validEndOffset, tailEnd, torn)
 }
 
 func (vlog *valueLog) deleteLogFile(lf *logFile) error {
@@ -265,15 +422,25 @@ type lfDiscardStats struct {
 }
 
 type valueLog struct {
-	buf        bytes.Buffer
-	pendingLen int
-	dirPath    string
-	curWriter  *fileutil.BufferedWriter
-	files      []*logFile
+	buf         bytes.Buffer
+	compressBuf []byte
+	pendingLen  int
+	dirPath     string
+	curWriter   *fileutil.BufferedWriter
+	files       []*logFile
 
 	kv     *DB
 	maxPtr uint64
 
+	// blobWriter is nil unless SeparateValuesOnWrite is set.
+	blobWriter *blobWriter
+
+	// recoveryReport describes the corruption handled by Replay.
+	recoveryReport RecoveryReport
+
+	// recycledFiles are the paths of the obsolete log files kept to be reused.
+	recycledFiles []string
+
 	numEntriesWritten uint32
 	opt               Options
 	metrics           *y.MetricsSet
@@ -370,11 +537,19 @@ func (vlog *valueLog) createVlogFile(fid uint32) error {
 	vlog.numEntriesWritten = 0
 
 	var err error
-	if lf.fd, err = y.CreateSyncedFile(path, false); err != nil {
-		return errors.Wrapf(err, "Unable to create value log file")
-	}
-	if err = fileutil.Preallocate(lf.fd, vlog.opt.ValueLogFileSize); err != nil {
-		return errors.Wrap(err, "Unable to preallocate value log file")
+	if len(vlog.recycledFiles) > 0 {
+		lf.fd, err = recycleLogFile(vlog.recycledFiles[0], path)
+		vlog.recycledFiles = vlog.recycledFiles[1:]
+		if err != nil {
+			return err
+		}
+	} else {
+		if lf.fd, err = y.CreateSyncedFile(path, false); err != nil {
+			return errors.Wrapf(err, "Unable to create value log file")
+		}
+		if err = fileutil.Preallocate(lf.fd, vlog.opt.ValueLogFileSize); err != nil {
+			return errors.Wrap(err, "Unable to preallocate value log file")
+		}
 	}
 	opt := &vlog.opt.ValueLogWriteOptions
 	if vlog.curWriter == nil {
@@ -391,8 +566,12 @@ func (vlog *valueLog) createVlogFile(fid uint32) error {
 	for len(vlog.files) > vlog.opt.ValueLogMaxNumFiles {
 		deleteCandidate := vlog.files[0]
 		if deleteCandidate.fid < syncedFid {
-			os.Remove(deleteCandidate.path)
 			deleteCandidate.fd.Close()
+			if len(vlog.recycledFiles) < vlog.opt.ValueLogNumRecycledFiles {
+				vlog.recycledFiles = append(vlog.recycledFiles, deleteCandidate.path)
+			} else {
+				os.Remove(deleteCandidate.path)
+			}
 			vlog.files = vlog.files[1:]
 			continue
 		}
@@ -401,6 +580,29 @@ func (vlog *valueLog) createVlogFile(fid uint32) error {
 	return nil
 }
 
+// recycleLogFile renames the obsolete log file at oldPath to path and returns it opened for
+// writing. The first header is zeroed so the file reads as empty, the stale records after the new
+// ones are rejected by their salt.
+func recycleLogFile(oldPath, path string) (*os.File, error) {
+	fd, err := os.OpenFile(oldPath, os.O_RDWR, 0666)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Unable to open value log file %q to recycle", oldPath)
+	}
+	if _, err = fd.WriteAt(make([]byte, headerBufSize), 0); err != nil {
+		fd.Close()
+		return nil, errors.Wrapf(err, "Unable to reset recycled value log file %q", oldPath)
+	}
+	if err = fileutil.Fdatasync(fd); err != nil {
+		fd.Close()
+		return nil, errors.Wrapf(err, "Unable to sync recycled value log file %q", oldPath)
+	}
+	if err = os.Rename(oldPath, path); err != nil {
+		fd.Close()
+		return nil, errors.Wrapf(err, "Unable to rename recycled value log file %q", oldPath)
+	}
+	return fd, nil
+}
+
 func (vlog *valueLog) Open(kv *DB, opt Options) error {
 	vlog.dirPath = opt.ValueDir
 	vlog.opt = opt
@@ -408,15 +610,21 @@ func (vlog *valueLog) Open(kv *DB, opt Options) error {
 	if err := vlog.openOrCreateFiles(kv.opt.ReadOnly); err != nil {
 		return errors.Wrapf(err, "Unable to open value log")
 	}
+	if opt.SeparateValuesOnWrite && opt.ValueThreshold > 0 {
+		vlog.blobWriter = &blobWriter{bm: &kv.blobManger, maxFileSize: opt.ValueLogFileSize}
+	}
 	return nil
 }
 
 func (vlog *valueLog) Close() error {
 	var err error
+	if vlog.blobWriter != nil {
+		err = vlog.blobWriter.finish()
+	}
 	for _, f := range vlog.files {
 		// A successful close does not guarantee that the data has been successfully saved to disk, as the kernel defers writes.
 		// It is not common for a file system to flush the buffers when the stream is closed.
-		if syncErr := fileutil.Fdatasync(f.fd); syncErr != nil {
+		if syncErr := fileutil.Fdatasync(f.fd); syncErr != nil && err == nil {
 			err = syncErr
 		}
 		if closeErr := f.fd.Close(); closeErr != nil && err == nil {
@@ -439,7 +647,13 @@ func (vlog *valueLog) Replay(off logOffset, fn logEntry) error {
 		if lf.fid > fid {
 			of = 0
 		}
-		endAt, err := vlog.iterate(lf, of, fn)
+		rec := &logRecovery{
+			mode:     vlog.opt.RecoveryMode,
+			truncate: vlog.opt.Truncate,
+			isLast:   lf.fid == vlog.maxFid(),
+			report:   &vlog.recoveryReport,
+		}
+		endAt, err := vlog.iterate(lf, of, rec, fn)
 		if err != nil {
 			return errors.Wrapf(err, "Unable to replay value log: %q", lf.path)
 		}
@@ -448,9 +662,20 @@ func (vlog *valueLog) Replay(off logOffset, fn logEntry) error {
 		}
 	}
 
+	if !vlog.recoveryReport.empty() {
+		r := &vlog.recoveryReport
+		log.Warnf("Value log recovered with %d skipped ranges, %d lost txns and %d truncated bytes",
+			len(r.SkippedRanges), len(r.LostTxns), r.TruncatedBytes)
+	}
+
 	// Seek to the end to start writing.
 	var err error
 	last := vlog.files[len(vlog.files)-1]
+	if lastOffset > 0 {
+		if last.salted, err = last.isSalted(); err != nil {
+			return err
+		}
+	}
 	_, err = last.fd.Seek(int64(lastOffset), io.SeekStart)
 	atomic.AddUint64(&vlog.maxPtr, uint64(lastOffset))
 	return errors.Wrapf(err, "Unable to seek to end of value log: %q", last.path)
@@ -486,6 +711,11 @@ type request struct {
 	off     logOffset
 	Wg      sync.WaitGroup
 	Err     error
+
+	size  int64
+	start time.Time
+	// sync tells whether the value log must be synced before the request is done.
+	sync bool
 }
 
 func (req *request) Wait() error {
@@ -513,6 +743,12 @@ func (vlog *valueLog) flush() error {
 	if vlog.pendingLen == 0 {
 		return nil
 	}
+	if vlog.blobWriter != nil {
+		// The values must be in the blob file before the pointers are in the value log.
+		if err := vlog.blobWriter.flush(); err != nil {
+			return errors.Wrap(err, "Unable to write to blob file")
+		}
+	}
 	err := vlog.curWriter.Flush()
 	if err != nil {
 		return errors.Wrapf(err, "Unable to write to value log file: %q", curlf.path)
@@ -536,24 +772,79 @@ func (vlog *valueLog) flush() error {
 	return nil
 }
 
+// encodeRequest encodes the entries of a request into vlog.buf and returns the encoded length. The
+// entries are compressed into one record if it saves space.
+func (vlog *valueLog) encodeRequest(entries []*Entry) (int, error) {
+	salt := vlog.recordSalt()
+	var plen int
+	for _, e := range entries {
+		n, err := encodeEntry(e, &vlog.buf, salt) // Now encode the entry into buffer.
+		if err != nil {
+			return 0, err
+		}
+		plen += n
+	}
+	compression := vlog.opt.ValueLogWriteOptions.Compression
+	if compression != options.Snappy {
+		return plen, nil
+	}
+	vlog.compressBuf = snappy.Encode(vlog.compressBuf[:cap(vlog.compressBuf)], vlog.buf.Bytes())
+	if headerBufSize+1+len(vlog.compressBuf)+4 >= plen {
+		return plen, nil
+	}
+	vlog.buf.Reset()
+	return encodeEntry(&Entry{
+		Value:    vlog.compressBuf,
+		UserMeta: []byte{byte(compression)},
+		meta:     bitCompressed,
+	}, &vlog.buf, salt)
+}
+
+// recordSalt returns the salt of the records written to the current log file. A file is salted if
+// recycling is enabled when its first record is written, so a recycled file can tell its records
+// from the stale ones.
+func (vlog *valueLog) recordSalt() uint32 {
+	lf := vlog.currentLogFile()
+	if vlog.writableOffset()+uint32(vlog.pendingLen) == 0 {
+		lf.salted = vlog.opt.ValueLogNumRecycledFiles > 0
+	}
+	if lf.salted {
+		return lf.fid
+	}
+	return noSalt
+}
+
 // write is thread-unsafe by design and should not be called concurrently.
 func (vlog *valueLog) write(reqs []*request) error {
 	for i := range reqs {
 		b := reqs[i]
-		for j := range b.Entries {
-			e := b.Entries[j]
-			plen, err := encodeEntry(e, &vlog.buf) // Now encode the entry into buffer.
-			if err != nil {
-				return err
+		if len(b.Entries) == 0 {
+			continue
+		}
+		if vlog.blobWriter != nil {
+			for _, e := range b.Entries {
+				if e.meta&bitFinTxn != 0 || len(e.Value) <= vlog.opt.ValueThreshold {
+					continue
+				}
+				bp, err := vlog.blobWriter.append(e.Value)
+				if err != nil {
+					return err
+				}
+				e.Value = bp
+				e.meta |= bitValuePointer
 			}
-			vlog.curWriter.Append(vlog.buf.Bytes())
-			vlog.buf.Reset()
-			vlog.pendingLen += plen
-
-			b.off.fid = vlog.currentLogFile().fid
-			// Use the offset including buffer length so far.
-			b.off.offset = vlog.writableOffset() + uint32(vlog.pendingLen)
 		}
+		plen, err := vlog.encodeRequest(b.Entries)
+		if err != nil {
+			return err
+		}
+		vlog.curWriter.Append(vlog.buf.Bytes())
+		vlog.buf.Reset()
+		vlog.pendingLen += plen
+
+		b.off.fid = vlog.currentLogFile().fid
+		// Use the offset including buffer length so far.
+		b.off.offset = vlog.writableOffset() + uint32(vlog.pendingLen)
 		vlog.numEntriesWritten += uint32(len(b.Entries))
 		// We write to disk here so that all entries that are part of the same transaction are
 		// written to the same vlog file.
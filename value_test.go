@@ -19,12 +19,17 @@ package badger
 import (
 	"bufio"
 	"bytes"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strconv"
 	"testing"
 
+	"github.com/coocood/badger/options"
 	"github.com/coocood/badger/y"
+	"github.com/pingcap/errors"
 	"github.com/stretchr/testify/require"
 )
 
@@ -304,3 +309,284 @@ func checkKeys(t *testing.T, kv *DB, keys [][]byte) {
 	}
 	require.Equal(t, i, len(keys))
 }
+
+func TestValueLogCompression(t *testing.T) {
+	dirs := make([]string, 3)
+	for i := range dirs {
+		dir, err := ioutil.TempDir("", "badger")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+		dirs[i] = dir
+	}
+	// copyDir copies the files of an open DB to simulate a crash, so the value log is replayed.
+	copyDir := func(src, dst string) {
+		files, err := ioutil.ReadDir(src)
+		require.NoError(t, err)
+		for _, fi := range files {
+			data, err := ioutil.ReadFile(filepath.Join(src, fi.Name()))
+			require.NoError(t, err)
+			require.NoError(t, ioutil.WriteFile(filepath.Join(dst, fi.Name()), data, 0666))
+		}
+	}
+	val := bytes.Repeat([]byte("value"), 100)
+	writeBatches := func(db *DB, prefix string) {
+		for i := 0; i < 10; i++ {
+			require.NoError(t, db.Update(func(txn *Txn) error {
+				for j := 0; j < 10; j++ {
+					if err := txn.Set([]byte(fmt.Sprintf("%s%d-%d", prefix, i, j)), val); err != nil {
+						return err
+					}
+				}
+				return nil
+			}))
+		}
+	}
+	checkBatches := func(db *DB, prefix string) {
+		require.NoError(t, db.View(func(txn *Txn) error {
+			for i := 0; i < 10; i++ {
+				for j := 0; j < 10; j++ {
+					item, err := txn.Get([]byte(fmt.Sprintf("%s%d-%d", prefix, i, j)))
+					require.NoError(t, err)
+					require.Equal(t, val, getItemValue(t, item))
+				}
+			}
+			return nil
+		}))
+	}
+
+	opts := getTestOptions(dirs[0])
+	opts.ValueThreshold = 0
+	db, err := Open(opts)
+	require.NoError(t, err)
+	start := db.vlog.writableOffset()
+	writeBatches(db, "plain")
+	plainSize := db.vlog.writableOffset() - start
+	copyDir(dirs[0], dirs[1])
+	require.NoError(t, db.Close())
+
+	// The uncompressed records are replayed with compression enabled.
+	opts.Dir, opts.ValueDir = dirs[1], dirs[1]
+	opts.ValueLogWriteOptions.Compression = options.Snappy
+	db, err = Open(opts)
+	require.NoError(t, err)
+	checkBatches(db, "plain")
+	start = db.vlog.writableOffset()
+	writeBatches(db, "snappy")
+	require.True(t, db.vlog.writableOffset()-start < plainSize/5)
+	copyDir(dirs[1], dirs[2])
+	require.NoError(t, db.Close())
+
+	// The value log has both uncompressed and compressed records.
+	opts.Dir, opts.ValueDir = dirs[2], dirs[2]
+	opts.ValueLogWriteOptions.Compression = options.NoCompression
+	db, err = Open(opts)
+	require.NoError(t, err)
+	checkBatches(db, "plain")
+	checkBatches(db, "snappy")
+	var numEntries int
+	require.NoError(t, db.IterateVLog(0, func(e Entry) {
+		if bytes.HasPrefix(e.Key, []byte("snappy")) {
+			require.Equal(t, val, e.Value)
+			numEntries++
+		}
+	}))
+	require.Equal(t, 100, numEntries)
+	require.NoError(t, db.Close())
+}
+
+func TestValueLogRecycle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	replayDir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(replayDir)
+
+	opts := getTestOptions(dir)
+	opts.ValueLogFileSize = 1 << 20
+	opts.ValueLogNumRecycledFiles = 2
+	db, err := Open(opts)
+	require.NoError(t, err)
+
+	// Move the commit ts to 5 digits so all the records below have the same size, the stale
+	// records after the new ones in a recycled file are aligned and pass the checksum.
+	for db.orc.readTs() < 10000 {
+		txnSet(t, db, []byte("pad"), nil, 0)
+	}
+	padFid := db.vlog.maxFid()
+
+	val := make([]byte, 1024)
+	infos := map[uint32]os.FileInfo{}
+	// firstIdx is a lower bound of the keys written to each log file.
+	firstIdx := map[uint32]int{}
+	var recycled bool
+	var i int
+	for ; i < 20000 && !(recycled && db.vlog.writableOffset() > 64<<10); i++ {
+		txnSet(t, db, []byte(fmt.Sprintf("key%06d", i)), val, 0)
+		fid := db.vlog.maxFid()
+		if _, ok := firstIdx[fid]; ok || fid == padFid {
+			continue
+		}
+		firstIdx[fid] = i
+		info, err := os.Stat(db.vlog.fpath(fid))
+		require.NoError(t, err)
+		recycled = false
+		for oldFid, old := range infos {
+			recycled = recycled || (oldFid > padFid && os.SameFile(old, info))
+		}
+		infos[fid] = info
+	}
+	require.True(t, recycled)
+	require.True(t, len(db.vlog.files)+len(db.vlog.recycledFiles) <= 1+opts.ValueLogMaxNumFiles+2)
+
+	// The recycled log file has the stale records of its previous incarnation after the new ones.
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	for _, fi := range files {
+		data, err := ioutil.ReadFile(filepath.Join(dir, fi.Name()))
+		require.NoError(t, err)
+		require.NoError(t, ioutil.WriteFile(filepath.Join(replayDir, fi.Name()), data, 0666))
+	}
+	require.NoError(t, db.Close())
+
+	opts.Dir, opts.ValueDir = replayDir, replayDir
+	db, err = Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+	fid := db.vlog.maxFid()
+	var numEntries int
+	require.NoError(t, db.IterateVLog(uint64(fid)<<32, func(e Entry) {
+		var idx int
+		_, err := fmt.Sscanf(string(y.ParseKey(e.Key)), "key%06d", &idx)
+		require.NoError(t, err)
+		require.True(t, idx >= firstIdx[fid])
+		numEntries++
+	}))
+	require.True(t, numEntries > 0)
+	require.NoError(t, db.View(func(txn *Txn) error {
+		for j := 0; j < i; j++ {
+			item, err := txn.Get([]byte(fmt.Sprintf("key%06d", j)))
+			require.NoError(t, err)
+			require.Equal(t, val, getItemValue(t, item))
+		}
+		return nil
+	}))
+}
+
+func TestValueLogRecoveryModes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	opts.ValueLogFileSize = 100 * 1024 * 1024
+	db, err := Open(opts)
+	require.NoError(t, err)
+	val := bytes.Repeat([]byte("value"), 20)
+	for i := 0; i < 10; i++ {
+		txnSet(t, db, []byte(fmt.Sprintf("key%d", i)), val, 0)
+	}
+	offsets := map[string]uint32{}
+	commitTs := map[string]uint64{}
+	require.NoError(t, db.IterateVLog(0, func(e Entry) {
+		offsets[string(y.ParseKey(e.Key))] = e.offset
+		commitTs[string(y.ParseKey(e.Key))] = y.ParseTs(e.Key)
+	}))
+	buf, err := ioutil.ReadFile(vlogFilePath(dir, 0))
+	require.NoError(t, err)
+	buf = buf[:db.vlog.writableOffset()]
+	require.NoError(t, db.Close())
+
+	corruptAt := func(offset uint32) []byte {
+		corrupted := y.Copy(buf)
+		corrupted[offset+headerBufSize+4]++
+		return corrupted
+	}
+	// A torn write at the end of the last txn.
+	torn := buf[:len(buf)-5]
+	// The last txn misses its end.
+	finLen := headerBufSize + len(txnKey) + 8 + len(strconv.FormatUint(commitTs["key9"], 10)) + 4
+	unfinished := buf[:len(buf)-finLen]
+	// openCorrupted opens a DB with the corrupted value log.
+	var dirs []string
+	defer func() {
+		for _, dir := range dirs {
+			os.RemoveAll(dir)
+		}
+	}()
+	openCorrupted := func(mode options.RecoveryMode, truncate bool, vlog []byte) (*DB, error) {
+		dir, err := ioutil.TempDir("", "badger")
+		require.NoError(t, err)
+		dirs = append(dirs, dir)
+		opts := getTestOptions(dir)
+		opts.ValueLogFileSize = 100 * 1024 * 1024
+		opts.RecoveryMode = mode
+		opts.Truncate = truncate
+		db, err := Open(opts)
+		require.NoError(t, err)
+		require.NoError(t, db.Close())
+		require.NoError(t, ioutil.WriteFile(vlogFilePath(dir, 0), vlog, 0666))
+		return Open(opts)
+	}
+	checkKeys := func(db *DB, lost string) {
+		require.NoError(t, db.View(func(txn *Txn) error {
+			for i := 0; i < 10; i++ {
+				key := fmt.Sprintf("key%d", i)
+				item, err := txn.Get([]byte(key))
+				if key == lost {
+					require.Equal(t, ErrKeyNotFound, err)
+					continue
+				}
+				require.NoError(t, err)
+				require.Equal(t, val, getItemValue(t, item))
+			}
+			return nil
+		}))
+	}
+
+	// A corrupted record in the middle.
+	_, err = openCorrupted(options.TolerateCorruptedTail, true, corruptAt(offsets["key4"]))
+	require.Equal(t, ErrValueLogCorrupted, errors.Cause(err))
+	_, err = openCorrupted(options.AbsoluteConsistency, true, corruptAt(offsets["key4"]))
+	require.Equal(t, ErrValueLogCorrupted, errors.Cause(err))
+	db, err = openCorrupted(options.SkipCorruptedRecords, false, corruptAt(offsets["key4"]))
+	require.NoError(t, err)
+	checkKeys(db, "key4")
+	report := db.RecoveryReport()
+	require.Len(t, report.SkippedRanges, 1)
+	require.Equal(t, uint32(0), report.SkippedRanges[0].Fid)
+	require.Equal(t, offsets["key4"], report.SkippedRanges[0].Offset)
+	require.True(t, report.SkippedRanges[0].Offset+report.SkippedRanges[0].Len < offsets["key5"])
+	require.Equal(t, []uint64{commitTs["key4"]}, report.LostTxns)
+	require.Equal(t, int64(0), report.TruncatedBytes)
+	require.NoError(t, db.Close())
+
+	_, err = openCorrupted(options.AbsoluteConsistency, true, torn)
+	require.Equal(t, ErrValueLogCorrupted, errors.Cause(err))
+	for _, mode := range []options.RecoveryMode{options.TolerateCorruptedTail, options.SkipCorruptedRecords} {
+		for _, truncate := range []bool{false, true} {
+			db, err = openCorrupted(mode, truncate, torn)
+			require.NoError(t, err)
+			checkKeys(db, "key9")
+			report = db.RecoveryReport()
+			require.Len(t, report.SkippedRanges, 0)
+			require.Equal(t, []uint64{commitTs["key9"]}, report.LostTxns)
+			require.Equal(t, int64(len(torn))-int64(offsets["key9"]), report.TruncatedBytes)
+			// The new writes go over the torn tail if it's not truncated.
+			txnSet(t, db, []byte("key9"), val, 0)
+			require.NoError(t, db.Close())
+			db, err = Open(db.opt)
+			require.NoError(t, err)
+			checkKeys(db, "")
+			require.NoError(t, db.Close())
+		}
+	}
+	for _, mode := range []options.RecoveryMode{options.TolerateCorruptedTail, options.AbsoluteConsistency} {
+		db, err = openCorrupted(mode, false, unfinished)
+		require.NoError(t, err)
+		checkKeys(db, "key9")
+		report = db.RecoveryReport()
+		require.Equal(t, []uint64{commitTs["key9"]}, report.LostTxns)
+		require.Equal(t, int64(len(unfinished))-int64(offsets["key9"]), report.TruncatedBytes)
+		require.NoError(t, db.Close())
+	}
+}
@@ -0,0 +1,114 @@
+/*
+ * Copyright 2026 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// WriteBufferManager limits the total memory of the memtables, both the active ones and the ones
+// waiting to be flushed, of the DB instances sharing it. When the memory exceeds the buffer size,
+// the DB with the largest active memtable flushes it, even if it's not being written.
+type WriteBufferManager struct {
+	bufferSize  int64
+	memoryUsed  int64
+	mutableUsed int64
+
+	mu  sync.Mutex
+	dbs map[*DB]struct{}
+}
+
+// NewWriteBufferManager returns a WriteBufferManager with the buffer size in bytes, set 0 to only
+// track the memory usage.
+func NewWriteBufferManager(bufferSize int64) *WriteBufferManager {
+	return &WriteBufferManager{bufferSize: bufferSize, dbs: map[*DB]struct{}{}}
+}
+
+// BufferSize returns the buffer size.
+func (m *WriteBufferManager) BufferSize() int64 {
+	return m.bufferSize
+}
+
+// MemoryUsage returns the memory of all the memtables.
+func (m *WriteBufferManager) MemoryUsage() int64 {
+	return atomic.LoadInt64(&m.memoryUsed)
+}
+
+// MutableMemoryUsage returns the memory of the active memtables.
+func (m *WriteBufferManager) MutableMemoryUsage() int64 {
+	return atomic.LoadInt64(&m.mutableUsed)
+}
+
+// reserve adds size bytes to the active memtables, size may be negative.
+func (m *WriteBufferManager) reserve(size int64) {
+	atomic.AddInt64(&m.memoryUsed, size)
+	atomic.AddInt64(&m.mutableUsed, size)
+}
+
+// scheduleFree moves size bytes of an active memtable to the memtables waiting to be flushed.
+func (m *WriteBufferManager) scheduleFree(size int64) {
+	atomic.AddInt64(&m.mutableUsed, -size)
+}
+
+// free releases size bytes of a flushed memtable.
+func (m *WriteBufferManager) free(size int64) {
+	atomic.AddInt64(&m.memoryUsed, -size)
+}
+
+func (m *WriteBufferManager) register(db *DB) {
+	m.mu.Lock()
+	m.dbs[db] = struct{}{}
+	m.mu.Unlock()
+}
+
+// unregister removes db, it must be called before db stops taking writes.
+func (m *WriteBufferManager) unregister(db *DB) {
+	m.mu.Lock()
+	delete(m.dbs, db)
+	m.mu.Unlock()
+}
+
+// flushLargest asks the DB with the largest active memtable to flush it.
+func (m *WriteBufferManager) flushLargest() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var largest *DB
+	var largestSize int64
+	for db := range m.dbs {
+		if size := atomic.LoadInt64(&db.mtSize); largest == nil || size > largestSize {
+			largest, largestSize = db, size
+		}
+	}
+	if largest != nil {
+		largest.requestFlush()
+	}
+}
+
+// shouldFlush returns true if an active memtable should be flushed. It flushes when the active
+// memtables take most of the buffer, or when the buffer is full and flushing the active memtables
+// frees at least half of it.
+func (m *WriteBufferManager) shouldFlush() bool {
+	if m.bufferSize <= 0 {
+		return false
+	}
+	mutable := m.MutableMemoryUsage()
+	if mutable > m.bufferSize*7/8 {
+		return true
+	}
+	return m.MemoryUsage() >= m.bufferSize && mutable >= m.bufferSize/2
+}
@@ -19,6 +19,7 @@ package badger
 import (
 	"os"
 	"runtime"
+	"sync/atomic"
 	"time"
 
 	"github.com/coocood/badger/fileutil"
@@ -35,61 +36,63 @@ type writeWorker struct {
 }
 
 type postLogTask struct {
-	logFile *os.File
-	reqs    []*request
+	logFile  *os.File
+	blobFile *os.File
+	reqs     []*request
+	// sync is true if any of the requests needs to be synced.
+	sync bool
 }
 
 func startWriteWorker(db *DB) *y.Closer {
-	numWorkers := 3
-	if db.opt.SyncWrites {
-		numWorkers += 1
-	}
-	closer := y.NewCloser(numWorkers)
+	closer := y.NewCloser(4)
 	w := &writeWorker{
 		DB:         db,
 		writeLSMCh: make(chan postLogTask, 1),
 		mergeLSMCh: make(chan *table.MemTable, 1),
 		flushCh:    make(chan postLogTask),
 	}
-	if db.opt.SyncWrites {
-		go w.runFlusher(closer)
-	}
+	go w.runFlusher(closer)
 	go w.runWriteVLog(closer)
 	go w.runWriteLSM(closer)
 	go w.runMergeLSM(closer)
 	return closer
 }
 
+// runFlusher syncs the value log for the tasks which need sync. All the tasks pass it so they are
+// written to the LSM tree in the order of the value log.
 func (w *writeWorker) runFlusher(lc *y.Closer) {
 	defer lc.Done()
-	for {
-		select {
-		case t := <-w.flushCh:
+	for t := range w.flushCh {
+		if t.sync {
 			start := time.Now()
-			err := fileutil.Fdatasync(t.logFile)
+			var err error
+			if t.blobFile != nil {
+				err = fileutil.Fdatasync(t.blobFile)
+			}
+			if err == nil {
+				err = fileutil.Fdatasync(t.logFile)
+			}
 			w.metrics.VlogSyncDuration.Observe(time.Since(start).Seconds())
 			if err != nil {
 				w.done(t.reqs, err)
 				continue
 			}
-			w.writeLSMCh <- t
-		case <-lc.HasBeenClosed():
-			return
 		}
+		w.writeLSMCh <- t
 	}
+	close(w.writeLSMCh)
 }
 
 func (w *writeWorker) runWriteVLog(lc *y.Closer) {
 	defer lc.Done()
+	defer close(w.flushCh)
 	for {
 		var r *request
 		select {
 		case task := <-w.ingestCh:
 			w.ingestTables(task)
 		case r = <-w.writeCh:
-			reqs := make([]*request, len(w.writeCh)+1)
-			reqs[0] = r
-			w.pollWriteCh(reqs[1:])
+			reqs := w.collectBatch(r)
 			if err := w.writeVLog(reqs); err != nil {
 				return
 			}
@@ -100,6 +103,59 @@ func (w *writeWorker) runWriteVLog(lc *y.Closer) {
 	}
 }
 
+// collectBatch groups the queued requests with r into a write batch, it waits up to GroupCommitDelay
+// for more requests unless the batch reaches GroupCommitMaxBytes or GroupCommitMaxEntries. Without
+// any of them, it only takes the requests queued when it's called.
+func (w *writeWorker) collectBatch(r *request) []*request {
+	opt := &w.opt.ValueLogWriteOptions
+	queued := len(w.writeCh)
+	w.metrics.WriteQueueDepth.Observe(float64(queued))
+	reqs := []*request{r}
+	size, count := r.size, len(r.Entries)
+	var timeout <-chan time.Time
+	if opt.GroupCommitDelay > 0 {
+		timer := time.NewTimer(opt.GroupCommitDelay)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	// Without a delay or limits, only the queued requests are taken, otherwise the batch keeps
+	// growing while the requests arrive faster than they are written.
+	unlimited := timeout == nil && opt.GroupCommitMaxBytes <= 0 && opt.GroupCommitMaxEntries <= 0
+	for (!unlimited || len(reqs) <= queued) &&
+		(opt.GroupCommitMaxBytes <= 0 || size < int64(opt.GroupCommitMaxBytes)) &&
+		(opt.GroupCommitMaxEntries <= 0 || count < opt.GroupCommitMaxEntries) {
+		r = w.pollRequest(timeout)
+		if r == nil {
+			break
+		}
+		reqs = append(reqs, r)
+		size += r.size
+		count += len(r.Entries)
+	}
+	w.metrics.WriteBatchSize.Observe(float64(size))
+	w.metrics.WriteBatchRequests.Observe(float64(len(reqs)))
+	return reqs
+}
+
+// pollRequest returns a queued request, or waits for one until timeout if there is none.
+// It returns nil if there is no request.
+func (w *writeWorker) pollRequest(timeout <-chan time.Time) *request {
+	select {
+	case r := <-w.writeCh:
+		return r
+	default:
+	}
+	if timeout == nil {
+		return nil
+	}
+	select {
+	case r := <-w.writeCh:
+		return r
+	case <-timeout:
+		return nil
+	}
+}
+
 func (w *writeWorker) pollWriteCh(buf []*request) []*request {
 	for i := 0; i < len(buf); i++ {
 		buf[i] = <-w.writeCh
@@ -117,11 +173,13 @@ func (w *writeWorker) writeVLog(reqs []*request) error {
 		logFile: w.vlog.currentLogFile().fd,
 		reqs:    reqs,
 	}
-	if w.opt.SyncWrites {
-		w.flushCh <- t
-	} else {
-		w.writeLSMCh <- t
+	if w.vlog.blobWriter != nil {
+		t.blobFile = w.vlog.blobWriter.activeFile()
+	}
+	for _, r := range reqs {
+		t.sync = t.sync || r.sync
 	}
+	w.flushCh <- t
 	return nil
 }
 
@@ -140,10 +198,13 @@ func (w *writeWorker) runWriteLSM(lc *y.Closer) {
 	}
 }
 
+// runMergeLSM merges the entries in the pending list of the memtable into its skiplist. The pending
+// list accumulates the requests of the write batches while a merge is running, so they are merged
+// together by MemTableInsertConcurrency goroutines.
 func (w *writeWorker) runMergeLSM(lc *y.Closer) {
 	defer lc.Done()
 	for mt := range w.mergeLSMCh {
-		mt.MergeListToSkl()
+		mt.MergeListToSklConcurrently(w.opt.MemTableInsertConcurrency)
 		mt.DecrRef()
 	}
 }
@@ -154,20 +215,20 @@ func (w *writeWorker) closeWriteVLog() {
 	for r := range w.writeCh { // Flush the channel.
 		reqs = append(reqs, r)
 	}
-	err := w.vlog.write(reqs)
-	if err != nil {
+	if err := w.vlog.write(reqs); err != nil {
 		w.done(reqs, err)
-	} else {
-		if err := w.vlog.curWriter.Sync(); err != nil {
-			w.done(reqs, err)
-		} else {
-			w.writeLSMCh <- postLogTask{
-				logFile: w.vlog.currentLogFile().fd,
-				reqs:    reqs,
-			}
-		}
+		return
 	}
-	close(w.writeLSMCh)
+	// Sync on close.
+	t := postLogTask{
+		logFile: w.vlog.currentLogFile().fd,
+		reqs:    reqs,
+		sync:    true,
+	}
+	if w.vlog.blobWriter != nil {
+		t.blobFile = w.vlog.blobWriter.activeFile()
+	}
+	w.flushCh <- t
 }
 
 // writeLSM is called serially by only one goroutine.
@@ -175,6 +236,13 @@ func (w *writeWorker) writeLSM(reqs []*request) {
 	if len(reqs) == 0 {
 		return
 	}
+	if atomic.LoadInt32(&w.flushRequested) != 0 {
+		// The flush requested by the WriteBufferManager is done even if the requests are empty.
+		if err := w.ensureRoomForWrite(); err != nil {
+			w.done(reqs, err)
+			return
+		}
+	}
 	var count int
 	for _, b := range reqs {
 		if len(b.Entries) == 0 {
@@ -195,6 +263,9 @@ func (w *writeWorker) writeLSM(reqs []*request) {
 
 func (w *writeWorker) done(reqs []*request, err error) {
 	for _, r := range reqs {
+		if !r.start.IsZero() {
+			w.metrics.CommitDuration.Observe(time.Since(r.start).Seconds())
+		}
 		r.Err = err
 		r.Wg.Done()
 	}
@@ -123,7 +123,7 @@ func (w *writeWorker) ingestTable(tbl *table.Table, splitHints [][]byte) error {
 		return w.runIngestCompact(targetLevel, tbl, overlappingTables, splitHints)
 	}
 
-	change := makeTableCreateChange(tbl.ID(), targetLevel)
+	change := makeTableCreateChange(tbl.ID(), targetLevel, w.dataPathID(tbl.Filename()))
 	if err := w.manifest.addChanges([]*protos.ManifestChange{change}, nil); err != nil {
 		return err
 	}
@@ -138,7 +138,7 @@ func (w *writeWorker) runIngestCompact(level int, tbl *table.Table, overlappingT
 		nextRange: getKeyRange(overlappingTables),
 	}
 	w.lc.fillBottomTables(&cd, overlappingTables)
-	newTables, err := w.lc.compactBuildTables(level-1, cd, w.limiter, splitHints)
+	newTables, err := w.lc.compactBuildTables(level-1, cd, w.limiter, splitHints, nil, nil)
 	if err != nil {
 		return err
 	}
@@ -146,7 +146,7 @@ func (w *writeWorker) runIngestCompact(level int, tbl *table.Table, overlappingT
 
 	var changes []*protos.ManifestChange
 	for _, t := range newTables {
-		changes = append(changes, makeTableCreateChange(t.ID(), level))
+		changes = append(changes, makeTableCreateChange(t.ID(), level, w.dataPathID(t.Filename())))
 	}
 	for _, t := range cd.bot {
 		changes = append(changes, makeTableDeleteChange(t.ID()))
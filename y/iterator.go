@@ -16,6 +16,9 @@
 
 package y
 
+// BitDelete is set in ValueStruct.Meta if the key has been deleted.
+const BitDelete byte = 1 << 0
+
 // ValueStruct represents the value info that can be associated with a key, but also the internal
 // Meta field.
 type ValueStruct struct {
@@ -27,8 +30,8 @@ type ValueStruct struct {
 }
 
 // EncodedSize is the size of the ValueStruct when encoded
-func (v *ValueStruct) EncodedSize() uint16 {
-	return uint16(len(v.Value) + len(v.UserMeta) + 2) // meta
+func (v *ValueStruct) EncodedSize() uint32 {
+	return uint32(len(v.Value) + len(v.UserMeta) + 2) // meta
 }
 
 // Decode uses the length of the slice to infer the length of the Value field.
@@ -17,6 +17,8 @@
 package y
 
 import (
+	"sync"
+
 	"github.com/prometheus/client_golang/prometheus"
 )
 
@@ -144,6 +146,34 @@ var (
 		Name:      "lsm_multi_get_duration",
 		Buckets:   prometheus.ExponentialBuckets(0.0003, 1.5, 20),
 	}, []string{labelPath})
+
+	// WriteBatchSize is the size in bytes of the write batches.
+	WriteBatchSize = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "write_batch_size",
+		Buckets:   prometheus.ExponentialBuckets(256, 2, 20),
+	}, []string{labelPath})
+
+	// WriteBatchRequests is the number of write requests in the write batches.
+	WriteBatchRequests = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "write_batch_requests",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 12),
+	}, []string{labelPath})
+
+	// WriteQueueDepth is the number of queued write requests when a write batch starts.
+	WriteQueueDepth = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "write_queue_depth",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 12),
+	}, []string{labelPath})
+
+	// CommitDuration is the time from sending a write request to its completion.
+	CommitDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "commit_duration",
+		Buckets:   prometheus.ExponentialBuckets(0.0001, 1.5, 24),
+	}, []string{labelPath})
 )
 
 type MetricsSet struct {
@@ -161,6 +191,10 @@ type MetricsSet struct {
 	WriteLSMDuration    prometheus.Observer
 	LSMGetDuration      prometheus.Observer
 	LSMMultiGetDuration prometheus.Observer
+	WriteBatchSize      prometheus.Observer
+	WriteBatchRequests  prometheus.Observer
+	WriteQueueDepth     prometheus.Observer
+	CommitDuration      prometheus.Observer
 }
 
 func NewMetricSet(path string) *MetricsSet {
@@ -180,6 +214,10 @@ func NewMetricSet(path string) *MetricsSet {
 		WriteLSMDuration:    WriteLSMDuration.WithLabelValues(path),
 		LSMGetDuration:      LSMGetDuration.WithLabelValues(path),
 		LSMMultiGetDuration: LSMMultiGetDuration.WithLabelValues(path),
+		WriteBatchSize:      WriteBatchSize.WithLabelValues(path),
+		WriteBatchRequests:  WriteBatchRequests.WithLabelValues(path),
+		WriteQueueDepth:     WriteQueueDepth.WithLabelValues(path),
+		CommitDuration:      CommitDuration.WithLabelValues(path),
 	}
 }
 
@@ -207,6 +245,9 @@ type LevelMetricsSet struct {
 	NumCompactionBytesDiscard prometheus.Counter
 	NumLSMGets                prometheus.Counter
 	NumLSMBloomFalsePositive  prometheus.Counter
+
+	statsLock  sync.Mutex
+	totalStats CompactionStats
 }
 
 type CompactionStats struct {
@@ -227,6 +268,22 @@ func (m *LevelMetricsSet) UpdateCompactionStats(stats *CompactionStats) {
 
 	m.NumCompactionKeysDiscard.Add(float64(stats.KeysDiscard))
 	m.NumCompactionBytesDiscard.Add(float64(stats.BytesDiscard))
+
+	m.statsLock.Lock()
+	m.totalStats.KeysRead += stats.KeysRead
+	m.totalStats.BytesRead += stats.BytesRead
+	m.totalStats.KeysWrite += stats.KeysWrite
+	m.totalStats.BytesWrite += stats.BytesWrite
+	m.totalStats.KeysDiscard += stats.KeysDiscard
+	m.totalStats.BytesDiscard += stats.BytesDiscard
+	m.statsLock.Unlock()
+}
+
+// TotalCompactionStats returns the cumulative compaction stats of the level since the DB is opened.
+func (m *LevelMetricsSet) TotalCompactionStats() CompactionStats {
+	m.statsLock.Lock()
+	defer m.statsLock.Unlock()
+	return m.totalStats
 }
 
 // These variables are global and have cumulative values for all kv stores.
@@ -246,6 +303,10 @@ func init() {
 	prometheus.MustRegister(WriteLSMDuration)
 	prometheus.MustRegister(LSMGetDuration)
 	prometheus.MustRegister(LSMMultiGetDuration)
+	prometheus.MustRegister(WriteBatchSize)
+	prometheus.MustRegister(WriteBatchRequests)
+	prometheus.MustRegister(WriteQueueDepth)
+	prometheus.MustRegister(CommitDuration)
 	prometheus.MustRegister(NumCompactionBytesWrite)
 	prometheus.MustRegister(NumCompactionBytesRead)
 	prometheus.MustRegister(NumCompactionBytesDiscard)
@@ -1,6 +1,7 @@
 package y
 
 import (
+	"math"
 	"sync/atomic"
 	"testing"
 	"unsafe"
@@ -28,6 +29,22 @@ func TestFastWaterMark(t *testing.T) {
 	require.True(t, t3.next == nil)
 }
 
+func TestFastWaterMarkBeginAt(t *testing.T) {
+	fwm := NewFastWaterMark()
+	require.Equal(t, uint64(math.MaxUint64), fwm.MinAliveReadTS())
+	t1 := fwm.BeginAt(100)
+	t2 := fwm.BeginAt(90)
+	require.Equal(t, uint64(90), t2.ReadTS)
+	t3 := fwm.BeginAt(110)
+	require.Equal(t, uint64(90), fwm.MinAliveReadTS())
+	fwm.Done(t2)
+	require.Equal(t, uint64(100), fwm.MinAliveReadTS())
+	fwm.Done(t1)
+	require.Equal(t, uint64(110), fwm.MinAliveReadTS())
+	fwm.Done(t3)
+	require.Equal(t, uint64(math.MaxUint64), fwm.MinAliveReadTS())
+}
+
 var counter uint64
 
 func BenchmarkFastWaterMark(b *testing.B) {
@@ -18,6 +18,7 @@ package y
 
 import (
 	"container/heap"
+	"math"
 	"sync/atomic"
 	"unsafe"
 )
@@ -160,6 +161,23 @@ func (wm *FastWaterMark) Begin(readTSHint uint64) *WaterMarkNode {
 	}
 }
 
+// BeginAt marks readTS like Begin, but the ReadTS of the returned WaterMarkNode is always readTS.
+// It is used by managed transactions whose readTS is not increasing monotonically, MinAliveReadTS
+// should be used instead of MinReadTS to get the minimum readTS in use.
+func (wm *FastWaterMark) BeginAt(readTS uint64) *WaterMarkNode {
+	n := &WaterMarkNode{
+		ReadTS:  readTS,
+		isAlive: 1,
+	}
+	for {
+		headPtr := atomic.LoadPointer(&wm.head)
+		n.next = headPtr
+		if atomic.CompareAndSwapPointer(&wm.head, headPtr, unsafe.Pointer(n)) {
+			return n
+		}
+	}
+}
+
 // Done unmark the WaterMarkNode.ReadTS, it may increase the MinReadTS if the all the older WaterMarkNode is dead.
 func (wm *FastWaterMark) Done(n *WaterMarkNode) {
 	next := (*WaterMarkNode)(atomic.LoadPointer(&n.next))
@@ -185,3 +203,17 @@ func (wm *FastWaterMark) Done(n *WaterMarkNode) {
 func (wm *FastWaterMark) MinReadTS() uint64 {
 	return atomic.LoadUint64(&wm.minReadTS)
 }
+
+// MinAliveReadTS returns the minimum ReadTS of the WaterMarkNodes which are not done, it returns
+// math.MaxUint64 if there is none.
+func (wm *FastWaterMark) MinAliveReadTS() uint64 {
+	minReadTS := uint64(math.MaxUint64)
+	n := (*WaterMarkNode)(atomic.LoadPointer(&wm.head))
+	for n != nil {
+		if atomic.LoadUint64(&n.isAlive) > 0 && n.ReadTS < minReadTS {
+			minReadTS = n.ReadTS
+		}
+		n = (*WaterMarkNode)(atomic.LoadPointer(&n.next))
+	}
+	return minReadTS
+}